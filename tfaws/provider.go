@@ -18,8 +18,7 @@ const ProviderName = "aws"
 
 func init() {
 	mod := gomod.Root(tfaws.Provider)
-	tfx.Providers.Add(ProviderName, mod.Version(), factory)
-	tfx.Deps.Add(depMap)
+	tfx.RegisterProvider(ProviderName, mod.Version(), factory, depMap)
 }
 
 // SessionLoader is called from ConfigureFunc to load default provider config.
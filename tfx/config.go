@@ -1,40 +1,346 @@
 package tfx
 
 import (
+	"bytes"
 	"encoding/json"
-	"io"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/printer"
 	"github.com/hashicorp/terraform/config"
 	"github.com/hashicorp/terraform/config/module"
+	"github.com/hashicorp/terraform/helper/schema"
+	tf "github.com/hashicorp/terraform/terraform"
 )
 
-// LoadModule reads module config from a file or directory ("" or "-" mean
-// stdin).
+// LoadModule reads module config from a file or directory ("-" means stdin).
 func LoadModule(path string) (*module.Tree, error) {
-	var c *config.Config
-	var err error
+	c, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return loadTree(c)
+}
+
+// LoadModuleWithTFVars reads module config from modulePath and uses the
+// variables from one or more tfvars files as the defaults for the root module
+// variables. Files are merged in order, so later files take precedence.
+// Variables that are not declared by the module are ignored.
+func LoadModuleWithTFVars(modulePath string, tfvars ...string) (*module.Tree, error) {
+	c, err := loadConfig(modulePath)
+	if err != nil {
+		return nil, err
+	}
+	vars, err := LoadTFVars(tfvars...)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range c.Variables {
+		if val, ok := vars[v.Name]; ok {
+			v.Default = val
+		}
+	}
+	return loadTree(c)
+}
+
+// LoadTFVars reads variable values from one or more HCL or JSON tfvars files
+// ("-" means stdin). Files are merged in order: map values are merged key by
+// key and all other values are replaced. Primitive values are converted to
+// strings, matching how Terraform represents variables internally.
+func LoadTFVars(paths ...string) (map[string]interface{}, error) {
+	if len(paths) == 0 {
+		return nil, errNoPath
+	}
+	vars := make(map[string]interface{})
+	for _, path := range paths {
+		r, err := open(path)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		f, err := hcl.Parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("tfx: error parsing %s: %v", path, err)
+		}
+		var raw map[string]interface{}
+		if err = hcl.DecodeObject(&raw, f); err != nil {
+			return nil, fmt.Errorf("tfx: error decoding %s: %v", path, err)
+		}
+		for k, v := range raw {
+			v = normTFVar(v)
+			if m, ok := v.(map[string]interface{}); ok {
+				if prev, ok := vars[k].(map[string]interface{}); ok {
+					for mk, mv := range m {
+						prev[mk] = mv
+					}
+					continue
+				}
+			}
+			vars[k] = v
+		}
+	}
+	return vars, nil
+}
+
+// normTFVar converts a decoded HCL value into the form used for Terraform
+// variables. HCL decodes objects as lists of maps, which are flattened into a
+// single map.
+func normTFVar(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []map[string]interface{}:
+		m := make(map[string]interface{})
+		for _, e := range v {
+			for k, ev := range e {
+				m[k] = normTFVar(ev)
+			}
+		}
+		return m
+	case map[string]interface{}:
+		for k, ev := range v {
+			v[k] = normTFVar(ev)
+		}
+		return v
+	case []interface{}:
+		for i, ev := range v {
+			v[i] = normTFVar(ev)
+		}
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return v
+}
+
+// loadConfig reads config from a file or directory ("-" means stdin).
+func loadConfig(path string) (*config.Config, error) {
+	if path == "" {
+		return nil, errNoPath
+	}
 	if isStdio(path) {
-		var b []byte
-		b, err = ioutil.ReadAll(io.LimitReader(os.Stdin, stdinLimit))
-		if err == nil {
-			c, err = config.LoadJSON(json.RawMessage(b))
+		b, err := ioutil.ReadAll(limitReader(os.Stdin))
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		var st os.FileInfo
-		if st, err = os.Stat(path); err == nil && st.IsDir() {
-			c, err = config.LoadDir(path)
-		} else {
-			c, err = config.LoadFile(path)
+		return config.LoadJSON(json.RawMessage(b))
+	}
+	if st, err := os.Stat(path); err == nil && st.IsDir() {
+		return config.LoadDir(path)
+	}
+	return config.LoadFile(path)
+}
+
+// loadTree returns a module tree for config c with all child modules loaded.
+func loadTree(c *config.Config) (*module.Tree, error) {
+	t := module.NewTree("", c)
+	if err := t.Load(&module.Storage{Mode: module.GetModeNone}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// SingleResourceModule returns a module containing one managed resource with
+// the specified type, name, and attributes. If the resource type is registered
+// in the default provider registry, the attributes are validated against the
+// resource schema.
+func SingleResourceModule(typ, name string, attrs map[string]interface{}) (*module.Tree, error) {
+	if !config.NameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("tfx: invalid resource name %q", name)
+	}
+	raw, err := config.NewRawConfig(attrs)
+	if err != nil {
+		return nil, err
+	}
+	if _, s := Providers.ResourceSchema(typ); s != nil {
+		if _, es := s.Validate(tf.NewResourceConfig(raw)); len(es) > 0 {
+			return nil, multierror.Append(nil, es...)
 		}
 	}
+	count, err := config.NewRawConfig(map[string]interface{}{"count": "1"})
 	if err != nil {
 		return nil, err
 	}
+	c := &config.Config{Resources: []*config.Resource{{
+		Mode:      config.ManagedResourceMode,
+		Name:      name,
+		Type:      typ,
+		RawCount:  count,
+		RawConfig: raw,
+	}}}
+	if err = c.Validate().Err(); err != nil {
+		return nil, err
+	}
 	t := module.NewTree("", c)
 	if err = t.Load(&module.Storage{Mode: module.GetModeNone}); err != nil {
 		t = nil
 	}
 	return t, err
 }
+
+// StateToHCL generates configuration for all managed resources in the root
+// module of s. Only required and optional attributes are included. Nested
+// resources within lists and sets are rendered as blocks. Resources with a
+// count index are given "<name>_<index>" names. Dependencies between resources
+// are not preserved.
+func StateToHCL(s *tf.State, pm ProviderMap) ([]byte, error) {
+	var b bytes.Buffer
+	for _, m := range s.Modules {
+		if len(m.Resources) == 0 {
+			continue
+		}
+		if !isRootModule(m.Path) {
+			return nil, fmt.Errorf("tfx: cannot generate config for module %q",
+				strings.Join(m.Path, "."))
+		}
+		keys := make([]string, 0, len(m.Resources))
+		for k := range m.Resources {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			key, err := tf.ParseResourceStateKey(k)
+			if err != nil {
+				return nil, err
+			}
+			r := m.Resources[k]
+			if key.Mode != config.ManagedResourceMode || r.Primary == nil {
+				continue
+			}
+			_, rs := pm.ResourceSchema(key.Type)
+			if rs == nil {
+				return nil, ErrUnknownType(key.Type)
+			}
+			name := key.Name
+			if key.Index >= 0 {
+				name += "_" + strconv.Itoa(key.Index)
+			}
+			d := rs.Data(r.Primary)
+			attrs := make(map[string]interface{}, len(rs.Schema))
+			for k, s := range rs.Schema {
+				if !s.Required && !s.Optional {
+					continue
+				}
+				v, ok := d.GetOk(k)
+				if !ok && hasNonZeroDefault(s) {
+					// Keep explicit zero values that differ from the default
+					if _, ok = r.Primary.Attributes[k]; ok {
+						v = d.Get(k)
+					}
+				}
+				if ok {
+					attrs[k] = makeRaw(v)
+				}
+			}
+			fmt.Fprintf(&b, "resource %q %q {\n", key.Type, name)
+			writeHCLBlock(&b, rs.Schema, attrs)
+			b.WriteString("}\n\n")
+		}
+	}
+	return printer.Format(b.Bytes())
+}
+
+// writeHCLBlock writes the contents of a configuration block to b.
+func writeHCLBlock(b *bytes.Buffer, s map[string]*schema.Schema, attrs map[string]interface{}) {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, sch := attrs[k], s[k]
+		if sch == nil || (!sch.Required && !sch.Optional) {
+			continue
+		}
+		if r, ok := sch.Elem.(*schema.Resource); ok {
+			if l, ok := v.([]interface{}); ok {
+				for _, e := range l {
+					m, _ := e.(map[string]interface{})
+					fmt.Fprintf(b, "%s {\n", k)
+					writeHCLBlock(b, r.Schema, m)
+					b.WriteString("}\n")
+				}
+				continue
+			}
+		}
+		if !sch.Required && isZero(v) && !hasNonZeroDefault(sch) {
+			continue
+		}
+		b.WriteString(k)
+		b.WriteString(" = ")
+		writeHCLValue(b, v)
+		b.WriteByte('\n')
+	}
+}
+
+// writeHCLValue writes an HCL literal for v to b.
+func writeHCLValue(b *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		b.WriteString(strings.Replace(strconv.Quote(v), "${", "$${", -1))
+	case []interface{}:
+		b.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeHCLValue(b, e)
+		}
+		b.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteString("{\n")
+		for _, k := range keys {
+			fmt.Fprintf(b, "%q = ", k)
+			writeHCLValue(b, v[k])
+			b.WriteByte('\n')
+		}
+		b.WriteByte('}')
+	default:
+		fmt.Fprint(b, v)
+	}
+}
+
+// hasNonZeroDefault returns true if s has a default value that is not the zero
+// value of its type.
+func hasNonZeroDefault(s *schema.Schema) bool {
+	return s.Default != nil && !isZero(s.Default)
+}
+
+// isZero returns true if v is nil, an empty collection, or a primitive zero
+// value.
+func isZero(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case int:
+		return v == 0
+	case float64:
+		return v == 0
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package tfx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform/builtin/providers/test"
+	"github.com/hashicorp/terraform/helper/schema"
+	tf "github.com/hashicorp/terraform/terraform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSingleResourceModule(t *testing.T) {
+	Providers.Add("test", "", MakeFactory(test.Provider))
+	defer delete(Providers, "test")
+
+	_, err := SingleResourceModule("test_resource", "r", map[string]interface{}{
+		"required": "x",
+	})
+	require.Error(t, err)
+	_, err = SingleResourceModule("test_resource", "r", map[string]interface{}{
+		"required":     "x",
+		"required_map": map[string]interface{}{"k": "v"},
+		"unknown":      "y",
+	})
+	require.Error(t, err)
+	_, err = SingleResourceModule("test_resource", "r.x", nil)
+	require.Error(t, err)
+
+	m, err := SingleResourceModule("test_resource", "r", map[string]interface{}{
+		"required":     "x",
+		"required_map": map[string]interface{}{"k": "v"},
+	})
+	require.NoError(t, err)
+	s, err := Context().Apply(m, nil)
+	require.NoError(t, err)
+	r := s.RootModule().Resources["test_resource.r"]
+	require.NotNil(t, r)
+	assert.Equal(t, "x", r.Primary.Attributes["required"])
+	assert.Equal(t, "v", r.Primary.Attributes["required_map.k"])
+}
+
+func TestStateToHCL(t *testing.T) {
+	var pm ProviderMap
+	pm.Add("test", "", func() (tf.ResourceProvider, error) {
+		p := test.Provider().(*schema.Provider)
+		p.ResourcesMap["test_hcl"] = &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"name":    {Type: schema.TypeString, Required: true},
+				"enabled": {Type: schema.TypeBool, Optional: true},
+				"arn":     {Type: schema.TypeString, Computed: true},
+				"tags":    {Type: schema.TypeMap, Optional: true},
+				"ports":   {Type: schema.TypeList, Optional: true, Elem: &schema.Schema{Type: schema.TypeInt}},
+				"rule": {Type: schema.TypeList, Optional: true, Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"cidr": {Type: schema.TypeString, Required: true},
+						"id":   {Type: schema.TypeString, Computed: true},
+					},
+				}},
+			},
+			Create: func(d *schema.ResourceData, _ interface{}) error {
+				d.SetId("a")
+				return nil
+			},
+			Read:   func(*schema.ResourceData, interface{}) error { return nil },
+			Delete: func(*schema.ResourceData, interface{}) error { return nil },
+		}
+		return p, nil
+	})
+	s := NewState()
+	s.RootModule().Resources["test_hcl.a.1"] = &tf.ResourceState{
+		Type: "test_hcl",
+		Primary: &tf.InstanceState{ID: "a", Attributes: map[string]string{
+			"id":          "a",
+			"name":        "${x}",
+			"enabled":     "true",
+			"arn":         "arn:a",
+			"tags.%":      "1",
+			"tags.k":      "v",
+			"ports.#":     "2",
+			"ports.0":     "80",
+			"ports.1":     "443",
+			"rule.#":      "1",
+			"rule.0.cidr": "0.0.0.0/0",
+			"rule.0.id":   "r",
+		}},
+	}
+	s.RootModule().Resources["data.test_hcl.b"] = &tf.ResourceState{
+		Type:    "test_hcl",
+		Primary: &tf.InstanceState{ID: "b"},
+	}
+	b, err := StateToHCL(s, pm)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `resource "test_hcl" "a_1" {`)
+	assert.NotContains(t, string(b), "arn")
+	assert.NotContains(t, string(b), "test_hcl\" \"b\"")
+
+	out, err := (&Ctx{Providers: pm}).Apply(loadCfg(t, string(b)), nil)
+	require.NoError(t, err)
+	r := out.RootModule().Resources["test_hcl.a_1"]
+	require.NotNil(t, r)
+	want := s.RootModule().Resources["test_hcl.a.1"].Primary.Attributes
+	for k, v := range r.Primary.Attributes {
+		if k != "id" {
+			assert.Equal(t, want[k], v, "%s", k)
+		}
+	}
+	for _, k := range []string{"name", "enabled", "tags.k", "ports.1", "rule.0.cidr"} {
+		assert.Equal(t, want[k], r.Primary.Attributes[k], "%s", k)
+	}
+
+	s.RootModule().Resources["test_unknown.c"] = &tf.ResourceState{
+		Type:    "test_unknown",
+		Primary: &tf.InstanceState{ID: "c"},
+	}
+	_, err = StateToHCL(s, pm)
+	assert.Equal(t, ErrUnknownType("test_unknown"), err)
+}
+
+func TestLoadTFVars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfx")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"main.tf": `
+			variable "name" {}
+			variable "size" { default = 1 }
+			variable "tags" { type = "map" }
+		`,
+		"a.tfvars": `
+			name  = "a"
+			size  = 2
+			tags  = { x = "1", y = "2" }
+			other = true
+		`,
+		"b.tfvars.json": `{"name": "b", "tags": {"y": "3"}}`,
+	}
+	for name, src := range files {
+		file := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(file, []byte(src), 0666))
+	}
+	a := filepath.Join(dir, "a.tfvars")
+	b := filepath.Join(dir, "b.tfvars.json")
+
+	vars, err := LoadTFVars(a)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"name":  "a",
+		"size":  "2",
+		"tags":  map[string]interface{}{"x": "1", "y": "2"},
+		"other": "true",
+	}, vars)
+
+	vars, err = LoadTFVars(a, b)
+	require.NoError(t, err)
+	assert.Equal(t, "b", vars["name"])
+	assert.Equal(t, map[string]interface{}{"x": "1", "y": "3"}, vars["tags"])
+
+	m, err := LoadModuleWithTFVars(dir, a, b)
+	require.NoError(t, err)
+	want := map[string]interface{}{
+		"name": "b",
+		"size": "2",
+		"tags": map[string]interface{}{"x": "1", "y": "3"},
+	}
+	for _, v := range m.Config().Variables {
+		assert.Equal(t, want[v.Name], v.Default, "%s", v.Name)
+	}
+
+	_, err = LoadTFVars()
+	assert.Equal(t, errNoPath, err)
+}
+
+func TestStateToHCLDefaults(t *testing.T) {
+	var pm ProviderMap
+	pm.Add("test", "", func() (tf.ResourceProvider, error) {
+		p := test.Provider().(*schema.Provider)
+		p.ResourcesMap["test_hcl"] = &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"enabled": {Type: schema.TypeBool, Optional: true, Default: true},
+				"size":    {Type: schema.TypeInt, Optional: true, Default: 3},
+				"mode":    {Type: schema.TypeString, Optional: true, Default: "x"},
+				"other":   {Type: schema.TypeBool, Optional: true, Default: true},
+				"plain":   {Type: schema.TypeBool, Optional: true, Default: false},
+			},
+			Create: func(d *schema.ResourceData, _ interface{}) error {
+				d.SetId("a")
+				return nil
+			},
+			Read:   func(*schema.ResourceData, interface{}) error { return nil },
+			Delete: func(*schema.ResourceData, interface{}) error { return nil },
+		}
+		return p, nil
+	})
+	s := NewState()
+	s.RootModule().Resources["test_hcl.a"] = &tf.ResourceState{
+		Type: "test_hcl",
+		Primary: &tf.InstanceState{ID: "a", Attributes: map[string]string{
+			"id":      "a",
+			"enabled": "false",
+			"size":    "0",
+			"mode":    "",
+			"plain":   "false",
+		}},
+	}
+	b, err := StateToHCL(s, pm)
+	require.NoError(t, err)
+	hcl := string(b)
+	assert.Contains(t, hcl, "enabled = false")
+	assert.Contains(t, hcl, "size    = 0")
+	assert.Contains(t, hcl, `mode    = ""`)
+	assert.NotContains(t, hcl, "other")
+	assert.NotContains(t, hcl, "plain")
+
+	out, err := (&Ctx{Providers: pm}).Apply(loadCfg(t, hcl), nil)
+	require.NoError(t, err)
+	r := out.RootModule().Resources["test_hcl.a"]
+	require.NotNil(t, r)
+	assert.Equal(t, "false", r.Primary.Attributes["enabled"])
+	assert.Equal(t, "0", r.Primary.Attributes["size"])
+	assert.Equal(t, "true", r.Primary.Attributes["other"])
+}
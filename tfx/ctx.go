@@ -2,44 +2,222 @@
 package tfx
 
 import (
+	"context"
+	"fmt"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/terraform/config"
 	"github.com/hashicorp/terraform/config/module"
 	"github.com/hashicorp/terraform/helper/schema"
 	tf "github.com/hashicorp/terraform/terraform"
+	"github.com/hashicorp/terraform/tfdiags"
 )
 
 // TODO: Pass provider alias configs via Ctx?
 
 // Ctx implements standard and non-standard Terraform operations using a
-// provider registry.
+// provider registry. ProviderParallelism limits the number of concurrent
+// provider operations that may make API calls (apply, refresh, data source
+// reads, and imports) for the specified providers. It applies to all instances
+// of a provider, including aliases, within one operation, and it cannot raise
+// the limit set by Parallelism. PatchMode controls the handling of unknown
+// Terraform types by Patch.
 type Ctx struct {
-	Meta        tf.ContextMeta
-	Parallelism int
-	Providers   ProviderMap
+	Meta                tf.ContextMeta
+	Parallelism         int
+	Providers           ProviderMap
+	ProviderParallelism map[string]int
+	PatchMode           PatchMode
 }
 
 // Context returns a new context configured to use default providers.
 func Context() *Ctx { return &Ctx{Providers: Providers} }
 
+// SetProvider registers an existing provider instance under the specified name,
+// replacing any previous registration (see FixedFactory). The provider map is
+// copied first, so other contexts that share it, including the global Providers
+// map used by Context, are not affected. It panics if the map is frozen.
+func (c *Ctx) SetProvider(name string, p tf.ResourceProvider) {
+	if c.Providers.Frozen() {
+		panic("tfx: provider map is frozen: " + name)
+	}
+	pm := make(ProviderMap, len(c.Providers)+1)
+	for k, v := range c.Providers {
+		if k != name {
+			pm[k] = v
+		}
+	}
+	pm.Add(name, "", FixedFactory(p))
+	c.Providers = pm
+}
+
+// Workspace sets the name of the workspace (environment) used for subsequent
+// operations, which is available to config as "${terraform.workspace}". An
+// empty name selects the "default" workspace.
+func (c *Ctx) Workspace(name string) { c.Meta.Env = name }
+
 // Refresh updates the state of all resources in s and returns the new state.
 func (c *Ctx) Refresh(s *tf.State) (*tf.State, error) {
+	return c.RefreshContext(context.Background(), s, nil)
+}
+
+// RefreshContext is a cancellable version of Refresh. If progress is not nil, it
+// is called after each resource is refreshed with the resource address (in the
+// same format as ExplainDiff) and whether the resource still exists. Progress
+// calls are serialized. If ctx is canceled, the refresh is stopped and ctx.Err()
+// is returned.
+func (c *Ctx) RefreshContext(ctx context.Context, s *tf.State, progress func(addr string, exists bool)) (*tf.State, error) {
 	opts := c.opts(module.NewEmptyTree(), s, c.Providers.DefaultResolver())
+	if progress != nil {
+		opts.Hooks = append(opts.Hooks, &refreshHook{fn: progress})
+	}
 	tc, err := tf.NewContext(&opts)
 	if err != nil {
 		return nil, err
 	}
-	return tc.Refresh()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			tc.Stop()
+		case <-done:
+		}
+	}()
+	s, err = tc.Refresh()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return s, err
+}
+
+// refreshHook reports refresh progress.
+type refreshHook struct {
+	tf.NilHook
+	mu sync.Mutex
+	fn func(addr string, exists bool)
+}
+
+// PostRefresh implements tf.Hook.
+func (h *refreshHook) PostRefresh(info *tf.InstanceInfo, s *tf.InstanceState) (tf.HookAction, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fn(modulePrefix(info.ModulePath)+info.Id, s != nil && s.ID != "")
+	return tf.HookActionContinue, nil
+}
+
+// RefreshResource refreshes a single resource in s, identified by address addr
+// (see AddressToStateKey), and returns its new state. Other resources are not
+// refreshed and s is not modified. It returns nil if the resource no longer
+// exists.
+func (c *Ctx) RefreshResource(s *tf.State, addr string) (*tf.ResourceState, error) {
+	path, key, err := AddressToStateKey(addr)
+	if err != nil {
+		return nil, err
+	}
+	if path[0] != "root" {
+		path = append([]string{"root"}, path...)
+	}
+	m := s.ModuleByPath(path)
+	if m == nil || m.Resources[key] == nil {
+		return nil, fmt.Errorf("tfx: resource %q not found", addr)
+	}
+	k, err := tf.ParseResourceStateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	target := tf.ResourceAddress{
+		Path:  path[1:],
+		Index: k.Index,
+		Name:  k.Name,
+		Type:  k.Type,
+		Mode:  k.Mode,
+	}
+	opts := c.opts(module.NewEmptyTree(), s.DeepCopy(), c.Providers.DefaultResolver())
+	opts.Targets = []string{target.String()}
+	tc, err := tf.NewContext(&opts)
+	if err != nil {
+		return nil, err
+	}
+	if s, err = tc.Refresh(); err != nil {
+		return nil, err
+	}
+	if m = s.ModuleByPath(path); m != nil {
+		return m.Resources[key], nil
+	}
+	return nil, nil
+}
+
+// Import performs the equivalent of 'terraform import' for a single resource of
+// the specified type and ID. Unlike NewResource, the importer is followed by a
+// provider Read, which may make API calls, so the returned resources have
+// actual attribute values. The first resource is the one that was requested.
+// Any additional states returned by the importer follow it, sorted by key.
+func (c *Ctx) Import(typ, id string) ([]Resource, error) {
+	if _, s := c.Providers.ResourceSchema(typ); s == nil {
+		return nil, ErrUnknownType(typ)
+	}
+	if id == "" {
+		return nil, fmt.Errorf("tfx: empty id for resource type %q", typ)
+	}
+
+	// An empty module and state do not require any providers, so the provider
+	// for typ must be added to the config explicitly.
+	t := module.NewEmptyTree()
+	raw, err := config.NewRawConfig(map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	t.Config().ProviderConfigs = []*config.ProviderConfig{{
+		Name:      config.ResourceProviderFullName(typ, ""),
+		RawConfig: raw,
+	}}
+	opts := c.opts(t, NewState(), c.Providers.DefaultResolver())
+	tc, err := tf.NewContext(&opts)
+	if err != nil {
+		return nil, err
+	}
+	key := typ + "." + makeName(id)
+	s, err := tc.Import(&tf.ImportOpts{
+		Module:  t,
+		Targets: []*tf.ImportTarget{{Addr: key, ID: id}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	root := s.RootModule()
+	if r := root.Resources[key]; r == nil || r.Primary == nil {
+		return nil, fmt.Errorf("tfx: failed to import %s %q", typ, id)
+	}
+	keys := make([]string, 0, len(root.Resources))
+	for k := range root.Resources {
+		if k != key {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	rs := make([]Resource, 0, len(root.Resources))
+	for _, k := range append([]string{key}, keys...) {
+		rs = append(rs, Resource{Key: k, ResourceState: root.Resources[k]})
+	}
+	return rs, nil
 }
 
 // SetDefaults sets default values for any missing resource attributes in s.
-// This is only needed after refreshing a scanned state.
-func (c *Ctx) SetDefaults(s *tf.State) {
+// This is only needed after refreshing a scanned state. Resources of unknown
+// types are skipped.
+func (c *Ctx) SetDefaults(s *tf.State) { c.SetDefaultsFiltered(s, nil) }
+
+// SetDefaultsFiltered is like SetDefaults, but it only sets eligible attributes
+// for which keep returns true. A nil keep function keeps all attributes.
+func (c *Ctx) SetDefaultsFiltered(s *tf.State, keep func(typ, attr string) bool) {
 	for _, m := range s.Modules {
 		for _, r := range m.Resources {
 			if _, s := c.Providers.ResourceSchema(r.Type); s != nil {
-				setDefaults(r.Primary.Attributes, s.Schema)
+				setDefaults(r.Type, r.Primary.Attributes, s.Schema, keep)
 			}
 		}
 	}
@@ -48,20 +226,89 @@ func (c *Ctx) SetDefaults(s *tf.State) {
 // Apply does a plan/apply operation to ensure that state s matches config t and
 // returns the new state.
 func (c *Ctx) Apply(t *module.Tree, s *tf.State) (*tf.State, error) {
+	s, _, err := c.ApplyWith(t, s, nil)
+	return s, err
+}
+
+// ApplyOpts specifies optional apply behavior. If NoDestroy is set, resources
+// that are planned to be destroyed or re-created are left unchanged. All other
+// changes are applied.
+type ApplyOpts struct{ NoDestroy bool }
+
+// ApplyWith is like Apply, but with additional options. It also returns the
+// addresses of resources that were not destroyed or re-created because of
+// opts, in which case the new state still differs from config t. Addresses are
+// formatted the same way as in ExplainDiff.
+func (c *Ctx) ApplyWith(t *module.Tree, s *tf.State, opts *ApplyOpts) (*tf.State, []string, error) {
+	s, _, skipped, err := c.apply(t, s, opts)
+	return s, skipped, err
+}
+
+// ApplyWithPlan is like Apply, but it also returns the plan that was applied.
+// The plan is nil if planning failed.
+func (c *Ctx) ApplyWithPlan(t *module.Tree, s *tf.State) (*tf.State, *tf.Plan, error) {
+	s, p, _, err := c.apply(t, s, nil)
+	return s, p, err
+}
+
+// ApplyWithActions is like Apply, but it also returns the actions that were
+// planned and applied, in the same order as DiffActions. Every resource in the
+// plan is included, even if its diff does not change any values. Resources
+// with empty diffs are reported with tf.DiffNone change type, and those with
+// only no-op attribute diffs (e.g. Old == New) are reported as updates, since
+// Terraform still calls the provider for them. Resources that were already in
+// the desired state, and were therefore left out of the plan, are not
+// included. Actions are also returned if the apply operation fails, in which
+// case some of them may not have completed.
+func (c *Ctx) ApplyWithActions(t *module.Tree, s *tf.State) (*tf.State, []ResourceAction, error) {
+	s, p, _, err := c.apply(t, s, nil)
+	var actions []ResourceAction
+	if p != nil {
+		d := p.Diff.DeepCopy()
+		sort.Slice(d.Modules, func(i, j int) bool {
+			return lessModulePath(d.Modules[i].Path, d.Modules[j].Path)
+		})
+		actions = diffActions(d, true)
+	}
+	return s, actions, err
+}
+
+// apply implements Apply, ApplyWith, ApplyWithPlan, and ApplyWithActions.
+func (c *Ctx) apply(t *module.Tree, s *tf.State, opts *ApplyOpts) (*tf.State, *tf.Plan, []string, error) {
 	// TODO: Test whether using schema-only resolver for Plan is really faster
 	// for complex providers.
-	opts := c.opts(t, s, c.Providers.SchemaResolver())
-	tc, err := tf.NewContext(&opts)
+	o := c.opts(t, s, c.Providers.SchemaResolver())
+	tc, err := tf.NewContext(&o)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 	p, err := tc.Plan()
-	if err != nil || p.Diff.Empty() {
-		return tc.State(), err
+	if err != nil {
+		return tc.State(), nil, nil, err
+	}
+	var skipped []string
+	if opts != nil && opts.NoDestroy {
+		skipped = skipDestroy(p.Diff)
 	}
-	opts.Diff = p.Diff
-	opts.ProviderResolver = c.Providers.DefaultResolver()
-	tc, err = tf.NewContext(&opts)
+	if p.Diff.Empty() {
+		return tc.State(), p, skipped, nil
+	}
+	o.Diff = p.Diff
+	o.ProviderResolver = c.Providers.DefaultResolver()
+	if tc, err = tf.NewContext(&o); err != nil {
+		return nil, p, skipped, err
+	}
+	s, err = tc.Apply()
+	return s, p, skipped, err
+}
+
+// ApplyPlan applies plan p, which may have been read from a saved plan file,
+// and returns the new state. This is the equivalent of 'terraform apply
+// <planfile>'. The plan's module, state, and diff are used as-is, so the
+// changes that are applied match the ones that were planned.
+func (c *Ctx) ApplyPlan(p *tf.Plan) (*tf.State, error) {
+	opts := c.opts(p.Module, p.State, c.Providers.DefaultResolver())
+	tc, err := p.Context(&opts)
 	if err != nil {
 		return nil, err
 	}
@@ -72,7 +319,12 @@ func (c *Ctx) Apply(t *module.Tree, s *tf.State) (*tf.State, error) {
 // returns the new state. The providers are prevented from making any API calls,
 // and the resulting (invalid) state becomes a copy of the input config.
 func (c *Ctx) Passthrough(t *module.Tree, s *tf.State) (*tf.State, error) {
-	opts := c.opts(t, s, c.Providers.PassthroughResolver())
+	return c.passthrough(t, s, passthroughMode)
+}
+
+// passthrough implements Passthrough using the specified provider mode.
+func (c *Ctx) passthrough(t *module.Tree, s *tf.State, mode providerMode) (*tf.State, error) {
+	opts := c.opts(t, s, c.Providers.resolver(mode))
 	tc, err := tf.NewContext(&opts)
 	if err != nil {
 		return nil, err
@@ -88,11 +340,37 @@ func (c *Ctx) Passthrough(t *module.Tree, s *tf.State) (*tf.State, error) {
 // by building and walking a modified apply graph that omits all config
 // references, which means that node evaluation may have slightly different
 // behavior. For example, resource lifecycle information is only available in
-// the config, so create-before-destroy behavior cannot be implemented.
+// the config, so create-before-destroy behavior cannot be implemented. Graph
+// elements that are not recognized are handled according to c.PatchMode.
 func (c *Ctx) Patch(s *tf.State, d *tf.Diff) (*tf.State, error) {
 	opts := c.opts(nil, s, c.Providers.DefaultResolver())
 	opts.Diff = d
-	return patch(&opts)
+	return patch(&opts, c.PatchMode)
+}
+
+// PatchResource is like Patch, but it applies a single resource diff d to the
+// resource at address addr (see AddressToStateKey), which must exist in s.
+func (c *Ctx) PatchResource(s *tf.State, addr string, d *tf.InstanceDiff) (*tf.State, error) {
+	path, key, err := AddressToStateKey(addr)
+	if err != nil {
+		return nil, err
+	}
+	if path[0] != "root" {
+		path = append([]string{"root"}, path...)
+	}
+	if d == nil {
+		return nil, fmt.Errorf("tfx: nil diff for resource %q", addr)
+	}
+	var m *tf.ModuleState
+	if s != nil {
+		m = s.ModuleByPath(path)
+	}
+	if m == nil || m.Resources[key] == nil {
+		return nil, fmt.Errorf("tfx: resource %q not found", addr)
+	}
+	diff := new(tf.Diff)
+	diff.AddModule(path).Resources[key] = d
+	return c.Patch(s, diff)
 }
 
 // Diff return the changes required to apply configuration t to state s. If s is
@@ -108,21 +386,167 @@ func (c *Ctx) Diff(t *module.Tree, s *tf.State) (*tf.Diff, error) {
 // Plan returns a plan to apply configuration t to state s. If s is nil, an
 // empty state is assumed.
 func (c *Ctx) Plan(t *module.Tree, s *tf.State) (*tf.Plan, error) {
-	opts := c.opts(t, s, c.Providers.SchemaResolver())
-	tc, err := tf.NewContext(&opts)
+	return c.PlanWith(t, s, nil)
+}
+
+// PlanOpts specifies optional plan behavior. IgnoreAttrs is the equivalent of
+// the ignore_changes lifecycle setting. It maps resource types to attribute
+// names whose changes are removed from update and replace diffs. Ignoring an
+// attribute also ignores all of its nested values (e.g. "tags" ignores
+// "tags.%" and "tags.Name"). The "*" type applies to all resources. Resource
+// diffs that have no remaining changes are removed from the plan.
+type PlanOpts struct{ IgnoreAttrs map[string][]string }
+
+// PlanWith is like Plan, but with additional options.
+func (c *Ctx) PlanWith(t *module.Tree, s *tf.State, opts *PlanOpts) (*tf.Plan, error) {
+	return c.plan(t, s, opts, c.Providers.SchemaResolver())
+}
+
+// PlanResult is a plan together with the results of data source reads that
+// were performed while planning. Data maps data source addresses, formatted as
+// in ExplainDiff, to their new states.
+type PlanResult struct {
+	*tf.Plan
+	Data map[string]*tf.InstanceState
+}
+
+// PlanData is like PlanWith, but it also returns the results of all data
+// source reads, which may affect the plan via interpolation even when the diff
+// is empty. Data sources whose config cannot be resolved until apply are not
+// read, and appear in the plan diff instead. Unlike Plan, providers are
+// configured and data sources are read by the provider, which may require
+// credentials and make API calls.
+func (c *Ctx) PlanData(t *module.Tree, s *tf.State, opts *PlanOpts) (*PlanResult, error) {
+	h := &dataHook{data: make(map[string]*tf.InstanceState)}
+	p, err := c.plan(t, s, opts, c.Providers.DefaultResolver(), h)
+	if err != nil {
+		return nil, err
+	}
+	return &PlanResult{p, h.data}, nil
+}
+
+// dataHook records data source read results.
+type dataHook struct {
+	tf.NilHook
+	mu   sync.Mutex
+	data map[string]*tf.InstanceState
+}
+
+// PostRefresh implements tf.Hook.
+func (h *dataHook) PostRefresh(info *tf.InstanceInfo, s *tf.InstanceState) (tf.HookAction, error) {
+	if s != nil && strings.HasPrefix(info.Id, "data.") {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.data[modulePrefix(info.ModulePath)+info.Id] = s.DeepCopy()
+	}
+	return tf.HookActionContinue, nil
+}
+
+// plan creates a plan using the specified provider resolver and hooks.
+func (c *Ctx) plan(t *module.Tree, s *tf.State, opts *PlanOpts, r tf.ResourceProviderResolver, hooks ...tf.Hook) (*tf.Plan, error) {
+	o := c.opts(t, s, r)
+	o.Hooks = append(o.Hooks, hooks...)
+	tc, err := tf.NewContext(&o)
 	if err != nil {
 		return nil, err
 	}
 	p, err := tc.Plan()
 	if err == nil {
 		normDiff(p.Diff)
+		if opts != nil && len(opts.IgnoreAttrs) > 0 {
+			ignoreAttrs(p.Diff, opts.IgnoreAttrs, c.Providers)
+		}
 	}
 	return p, err
 }
 
+// Validate performs the equivalent of 'terraform validate' for module t and
+// returns all errors. Since CustomizeDiff functions are only called while
+// planning, t is also planned against an empty state if validation succeeds.
+// Providers are not configured and no API calls are made.
+func (c *Ctx) Validate(t *module.Tree) []error {
+	opts := c.opts(t, nil, c.Providers.SchemaResolver())
+	tc, err := tf.NewContext(&opts)
+	if err == nil {
+		var errs []error
+		for _, d := range tc.Validate() {
+			if d.Severity() == tfdiags.Error {
+				errs = append(errs, tfdiags.Diagnostics{d}.Err())
+			}
+		}
+		if len(errs) > 0 {
+			return errs
+		}
+		if _, err = tc.Plan(); err == nil {
+			return nil
+		}
+	}
+	if e, ok := multierror.Flatten(err).(*multierror.Error); ok {
+		return e.Errors
+	}
+	return []error{err}
+}
+
+// ValidateProviderConfig validates raw provider configuration against the
+// schema of the named provider and returns all errors. The provider is not
+// configured, so credentials and other values that require API calls are not
+// verified.
+func (c *Ctx) ValidateProviderConfig(name string, raw map[string]interface{}) []error {
+	p := c.Providers.Schema(name)
+	if p == nil {
+		return []error{fmt.Errorf("tfx: unknown provider %q", name)}
+	}
+	r, err := config.NewRawConfig(raw)
+	if err != nil {
+		return []error{err}
+	}
+	if _, errs := p.Validate(tf.NewResourceConfig(r)); len(errs) > 0 {
+		return errs
+	}
+	if _, err = Config(p.Schema, raw); err != nil {
+		return []error{err}
+	}
+	return nil
+}
+
+// Outputs evaluates root module outputs of configuration t against state s
+// without making any API calls. If s is nil, an empty state is assumed. Outputs
+// that cannot be determined without an apply operation, such as those that
+// refer to resources missing from s, have the value config.UnknownVariableValue.
+func (c *Ctx) Outputs(t *module.Tree, s *tf.State) (map[string]interface{}, error) {
+	cfg := t.Config().Outputs
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+	opts := c.opts(t, s, c.Providers.SchemaResolver())
+	tc, err := tf.NewContext(&opts)
+	if err != nil {
+		return nil, err
+	}
+	if s, err = tc.Refresh(); err != nil {
+		return nil, err
+	}
+	var have map[string]*tf.OutputState
+	if root := s.RootModule(); root != nil {
+		have = root.Outputs
+	}
+	out := make(map[string]interface{}, len(cfg))
+	for _, o := range cfg {
+		if v := have[o.Name]; v != nil {
+			out[o.Name] = v.Value
+		} else {
+			out[o.Name] = config.UnknownVariableValue
+		}
+	}
+	return out, nil
+}
+
 // Conform returns a transformation that associates root module resource states
-// in s with their configurations in t. If strict is true, the transform will
-// remove any non-conforming resources.
+// in s with their configurations in t. Resources in s that are already at their
+// config addresses (e.g. after an import) are matched by ID first, so they keep
+// their addresses even if other resources have identical attributes. All other
+// resources are matched by DiffScore (see conformDiff). If strict is true, the
+// transform will remove any non-conforming resources.
 func (c *Ctx) Conform(t *module.Tree, s *tf.State, strict bool) (StateTransform, error) {
 	root := s.RootModule()
 	if len(root.Resources) == 0 {
@@ -136,64 +560,112 @@ func (c *Ctx) Conform(t *module.Tree, s *tf.State, strict bool) (StateTransform,
 		return nil, err
 	}
 
+	// Use the IDs of resources that already have the correct address
+	for _, m := range nilDiff.Modules {
+		if !isRootModule(m.Path) {
+			continue
+		}
+		for k, d := range m.Resources {
+			r := root.Resources[k]
+			if r == nil || r.Primary == nil || r.Primary.ID == "" {
+				continue
+			}
+			if id := d.Attributes["id"]; id == nil || id.NewComputed {
+				if d.Attributes == nil {
+					d.Attributes = make(map[string]*tf.ResourceAttrDiff)
+				}
+				d.Attributes["id"] = &tf.ResourceAttrDiff{
+					New:         r.Primary.ID,
+					RequiresNew: true,
+				}
+			}
+		}
+	}
+
 	// Create a type index for all resources in root
+	types, err := conformTypes(root, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// For each resource in nilDiff, find the best match in types
+	st, _, err := conformDiff(nilDiff, types, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove non-conforming resources
+	if strict {
+		for _, states := range types {
+			for addr := range states {
+				st[addr] = ""
+			}
+		}
+	}
+	return st, nil
+}
+
+// ConformState returns a transformation that gives resources in cur the
+// addresses of matching resources in want. This is the state-to-state version
+// of Ctx.Conform, which can be used to align the addressing of two states
+// (e.g. after resources were renamed elsewhere). Resources in all modules are
+// considered. They are matched by ID first, and then by DiffScore, requiring at
+// least one matching attribute value. A match is ambiguous if there was more
+// than one equally good candidate for a resource in want. An error is returned
+// if the number of ambiguous matches exceeds maxAmbiguous, unless maxAmbiguous
+// is negative. If strict is true, the transform will remove any resources that
+// were not matched. Resources that keep their address are omitted.
+func ConformState(cur, want *tf.State, strict bool, maxAmbiguous int) (StateTransform, error) {
+	if cur == nil || want == nil {
+		return nil, nil
+	}
 	types := make(map[string]map[string]*tf.ResourceState)
-	for k, r := range root.Resources {
-		sk, err := tf.ParseResourceStateKey(k)
-		if err != nil {
+	for _, m := range cur.Modules {
+		if _, err := conformTypes(m, types); err != nil {
 			return nil, err
 		}
-		if sk.Mode != config.ManagedResourceMode {
-			continue // TODO: Figure out how data resources should be handled
-		}
-		states := types[sk.Type]
-		if states == nil {
-			states = make(map[string]*tf.ResourceState)
-			types[sk.Type] = states
-		}
-		states[k] = r
 	}
 
-	// For each resource in nilDiff, find the best match in types
-	st := make(StateTransform)
-	for _, m := range nilDiff.Modules {
-		for k, d := range m.Resources {
-			sk, _ := tf.ParseResourceStateKey(k)
-			if sk.Mode != config.ManagedResourceMode {
+	// Convert want into a diff that would create each of its resources
+	d := new(tf.Diff)
+	for _, m := range want.Modules {
+		var md *tf.ModuleDiff
+		for k, r := range m.Resources {
+			if r.Primary == nil {
 				continue
 			}
-			states := types[sk.Type]
-			bestScore := -1
-			var bestKey string
-			for sk, s := range states {
-				if ds := diffScore(s.Primary, d); bestScore < ds {
-					bestScore, bestKey = ds, sk
-				}
+			rd := &tf.InstanceDiff{Attributes: make(
+				map[string]*tf.ResourceAttrDiff, len(r.Primary.Attributes))}
+			for ak, av := range r.Primary.Attributes {
+				rd.Attributes[ak] = &tf.ResourceAttrDiff{New: av}
 			}
-			if bestScore < 0 {
-				continue // TODO: Require at least one attribute match?
+			if id := r.Primary.ID; id != "" {
+				rd.Attributes["id"] = &tf.ResourceAttrDiff{New: id}
+			} else {
+				delete(rd.Attributes, "id")
 			}
-			src, err := stateKeyToAddress(nil, bestKey)
-			if err != nil {
-				return nil, err
+			if md == nil {
+				md = d.AddModule(m.Path)
 			}
-			dst, err := stateKeyToAddress(m.Path, k)
-			if err != nil {
-				return nil, err
-			}
-			st[src] = dst
-			delete(states, bestKey)
+			md.Resources[k] = rd
+		}
+	}
+	st, ambiguous, err := conformDiff(d, types, 1)
+	if err != nil {
+		return nil, err
+	}
+	if maxAmbiguous >= 0 && len(ambiguous) > maxAmbiguous {
+		return nil, fmt.Errorf("tfx: %d ambiguous resource matches (max %d): %s",
+			len(ambiguous), maxAmbiguous, strings.Join(ambiguous, ", "))
+	}
+	for src, dst := range st {
+		if src == dst {
+			delete(st, src)
 		}
 	}
-
-	// Remove non-conforming resources
 	if strict {
 		for _, states := range types {
-			for k := range states {
-				addr, err := stateKeyToAddress(nil, k)
-				if err != nil {
-					return nil, err
-				}
+			for addr := range states {
 				st[addr] = ""
 			}
 		}
@@ -201,6 +673,34 @@ func (c *Ctx) Conform(t *module.Tree, s *tf.State, strict bool) (StateTransform,
 	return st, nil
 }
 
+// conformTypes adds all managed resources in m to types, which is indexed by
+// type and resource address. A new map is allocated if types is nil.
+func conformTypes(m *tf.ModuleState, types map[string]map[string]*tf.ResourceState) (map[string]map[string]*tf.ResourceState, error) {
+	if types == nil {
+		types = make(map[string]map[string]*tf.ResourceState)
+	}
+	for k, r := range m.Resources {
+		sk, err := tf.ParseResourceStateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		if sk.Mode != config.ManagedResourceMode {
+			continue // TODO: Figure out how data resources should be handled
+		}
+		addr, err := StateKeyToAddress(m.Path, k)
+		if err != nil {
+			return nil, err
+		}
+		states := types[sk.Type]
+		if states == nil {
+			states = make(map[string]*tf.ResourceState)
+			types[sk.Type] = states
+		}
+		states[addr] = r
+	}
+	return types, nil
+}
+
 // opts returns the options for creating a new Terraform context.
 func (c *Ctx) opts(t *module.Tree, s *tf.State, r tf.ResourceProviderResolver) tf.ContextOpts {
 	if c.Meta.Env == "" {
@@ -219,12 +719,12 @@ func (c *Ctx) opts(t *module.Tree, s *tf.State, r tf.ResourceProviderResolver) t
 		Module:           t,
 		Parallelism:      c.Parallelism,
 		State:            s,
-		ProviderResolver: r,
+		ProviderResolver: limitResolver(r, c.ProviderParallelism),
 	}
 }
 
 // setDefaults sets missing attributes in attrs to their default values.
-func setDefaults(attrs map[string]string, s map[string]*schema.Schema) {
+func setDefaults(typ string, attrs map[string]string, s map[string]*schema.Schema, keep func(typ, attr string) bool) {
 	w := schema.MapFieldWriter{Schema: s}
 	for k, s := range s {
 		// Only set primitive types
@@ -241,7 +741,8 @@ func setDefaults(attrs map[string]string, s map[string]*schema.Schema) {
 		if _, ok := attrs[k]; ok || s.Default == nil ||
 			!s.Optional || s.Computed || s.ForceNew ||
 			len(s.ComputedWhen) > 0 || len(s.ConflictsWith) > 0 ||
-			s.Deprecated != "" || s.Removed != "" {
+			s.Deprecated != "" || s.Removed != "" ||
+			(keep != nil && !keep(typ, k)) {
 			continue
 		}
 
@@ -254,6 +755,115 @@ func setDefaults(attrs map[string]string, s map[string]*schema.Schema) {
 	}
 }
 
+// conformDiff matches resource diffs in d with resource states in types, which
+// are indexed by type and resource address. Matched states are removed from
+// types. If the ID of a resource is known in d, it is matched with the state
+// that has the same ID. All other resources are matched by DiffScore, which must
+// be at least minScore. Terraform marks the IDs of new resources as computed, so
+// a diff planned against an empty state only has known IDs if they were set by
+// the caller (see Conform). The addresses of resources in d that had
+// more than one best-scoring match are returned in ambiguous.
+func conformDiff(d *tf.Diff, types map[string]map[string]*tf.ResourceState, minScore int) (st StateTransform, ambiguous []string, err error) {
+	type res struct {
+		path []string
+		key  string
+		addr string
+		typ  string
+		diff *tf.InstanceDiff
+	}
+	var rs []res
+	for _, m := range d.Modules {
+		prefix := modulePrefix(m.Path)
+		for k, d := range m.Resources {
+			sk, err := tf.ParseResourceStateKey(k)
+			if err != nil {
+				return nil, nil, err
+			}
+			if sk.Mode == config.ManagedResourceMode {
+				rs = append(rs, res{m.Path, k, prefix + k, sk.Type, d})
+			}
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].addr < rs[j].addr })
+	st = make(StateTransform)
+	bind := func(r *res, src string) error {
+		dst, err := StateKeyToAddress(r.path, r.key)
+		if err != nil {
+			return err
+		}
+		st[src] = dst
+		delete(types[r.typ], src)
+		r.diff = nil
+		return nil
+	}
+
+	// Bind known IDs
+	for i := range rs {
+		r := &rs[i]
+		id := r.diff.Attributes["id"]
+		if id == nil || id.NewComputed || id.New == "" {
+			continue
+		}
+		for k, s := range types[r.typ] {
+			if s.Primary != nil && s.Primary.ID == id.New {
+				if err = bind(r, k); err != nil {
+					return nil, nil, err
+				}
+				break
+			}
+		}
+	}
+
+	// Bind remaining resources by score
+	for i := range rs {
+		r := &rs[i]
+		if r.diff == nil {
+			continue
+		}
+		bestScore := -1
+		var bestKey string
+		var tie bool
+		for k, s := range types[r.typ] {
+			ds := DiffScore(s.Primary, r.diff)
+			if bestScore < ds {
+				bestScore, bestKey, tie = ds, k, false
+			} else if bestScore == ds {
+				if tie = true; k < bestKey {
+					bestKey = k
+				}
+			}
+		}
+		if bestScore < 0 || bestScore < minScore {
+			continue
+		}
+		if tie {
+			ambiguous = append(ambiguous, r.addr)
+		}
+		if err = bind(r, bestKey); err != nil {
+			return nil, nil, err
+		}
+	}
+	return st, ambiguous, nil
+}
+
+// skipDestroy removes all resource diffs that destroy or re-create a resource
+// from d and returns the addresses of those resources.
+func skipDestroy(d *tf.Diff) (skipped []string) {
+	for _, m := range d.Modules {
+		prefix := modulePrefix(m.Path)
+		for k, r := range m.Resources {
+			switch r.ChangeType() {
+			case tf.DiffDestroy, tf.DiffDestroyCreate:
+				delete(m.Resources, k)
+				skipped = append(skipped, prefix+k)
+			}
+		}
+		m.Destroy = false
+	}
+	sort.Strings(skipped)
+	return
+}
+
 // implicitProviderConfig adds AWS provider aliases that set the correct region.
 // It returns true if config c was updated.
 func implicitProviderConfig(s *tf.State, c *config.Config) bool {
@@ -1,10 +1,17 @@
 package tfx
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"strings"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/terraform/builtin/providers/test"
 	"github.com/hashicorp/terraform/config"
@@ -18,21 +25,9 @@ import (
 // TODO: Clean this up
 
 func TestCtx(t *testing.T) {
-	renameTypes := func(name string, src map[string]*schema.Resource) {
-		tmp := make(map[string]*schema.Resource, len(src))
-		for typ, r := range src {
-			tmp[name+strings.TrimPrefix(typ, "test")] = r
-			delete(src, typ)
-		}
-		for typ, r := range tmp {
-			src[typ] = r
-		}
-	}
-	newFactory := func(name string, cfgCount *int32) tf.ResourceProviderFactory {
+	newFactory := func(cfgCount *int32) tf.ResourceProviderFactory {
 		return func() (tf.ResourceProvider, error) {
 			p := test.Provider().(*schema.Provider)
-			renameTypes(name, p.ResourcesMap)
-			renameTypes(name, p.DataSourcesMap)
 			p.ConfigureFunc = func(d *schema.ResourceData) (interface{}, error) {
 				return atomic.AddInt32(cfgCount, 1), nil
 			}
@@ -42,8 +37,15 @@ func TestCtx(t *testing.T) {
 
 	var cfgCount [2]int32
 	var ctx Ctx
-	ctx.Providers.Add("test1", "", newFactory("test1", &cfgCount[0]))
-	ctx.Providers.Add("test2", "", newFactory("test2", &cfgCount[1]))
+	ctx.Providers.AddAs("test1", "test", "", newFactory(&cfgCount[0]))
+	ctx.Providers.AddAs("test2", "test", "", newFactory(&cfgCount[1]))
+	_, s1 := ctx.Providers.ResourceSchema("test1_resource")
+	_, s2 := ctx.Providers.ResourceSchema("test2_resource")
+	require.NotNil(t, s1)
+	require.NotNil(t, s2)
+	assert.True(t, s1 != s2)
+	_, s0 := ctx.Providers.ResourceSchema("test_resource")
+	assert.Nil(t, s0)
 
 	s, err := ctx.Apply(loadCfg(t, applyCfg1), nil)
 	require.NoError(t, err)
@@ -66,6 +68,844 @@ func TestCtx(t *testing.T) {
 	assert.Equal(t, "t2-alias", s.Modules[0].Resources["test2_resource.t2-alias"].Primary.Attributes["required"])
 }
 
+func TestSetProvider(t *testing.T) {
+	var ctx Ctx
+	ctx.SetProvider("test", test.Provider())
+	ctx.SetProvider("test", test.Provider())
+	s, err := ctx.Apply(loadCfg(t, `
+		resource "test_resource" "a" {
+			required     = "a"
+			required_map = {x = 0}
+		}
+	`), nil)
+	require.NoError(t, err)
+	r := s.RootModule().Resources["test_resource.a"]
+	require.NotNil(t, r)
+	assert.Equal(t, "a", r.Primary.Attributes["required"])
+
+	Providers.Add("test", "", MakeFactory(test.Provider))
+	defer delete(Providers, "test")
+	global := Providers["test"]
+	c := Context()
+	c.SetProvider("test", test.Provider())
+	assert.True(t, Providers["test"] == global)
+	assert.False(t, c.Providers["test"] == global)
+}
+
+func TestApplyPlan(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", MakeFactory(test.Provider))
+	p, err := ctx.Plan(loadCfg(t, outputsCfg), nil)
+	require.NoError(t, err)
+	var b bytes.Buffer
+	require.NoError(t, tf.WritePlan(p, &b))
+	p, err = tf.ReadPlan(&b)
+	require.NoError(t, err)
+	s, err := ctx.ApplyPlan(p)
+	require.NoError(t, err)
+	rs := s.RootModule().Resources
+	require.Len(t, rs, 2)
+	assert.Equal(t, "r", rs["test_resource.r"].Primary.Attributes["required"])
+	assert.Equal(t, "m", rs["test_resource.m"].Primary.Attributes["required"])
+}
+
+func TestPlanFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "tfx")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	file := filepath.Join(tmp, "tfplan")
+
+	var ctx Ctx
+	ctx.Providers.Add("test", "", MakeFactory(test.Provider))
+	p, err := ctx.Plan(loadCfg(t, outputsCfg), nil)
+	require.NoError(t, err)
+	require.NoError(t, WritePlanFile(file, p))
+	d, err := ReadDiffFile(file)
+	require.NoError(t, err)
+	assert.True(t, p.Diff.Equal(d))
+	p, err = ReadPlanFile(file)
+	require.NoError(t, err)
+	s, err := ctx.ApplyPlan(p)
+	require.NoError(t, err)
+	assert.Len(t, s.RootModule().Resources, 2)
+}
+
+func TestWorkspace(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", MakeFactory(test.Provider))
+	cfg := `
+		resource "test_resource" "r" {
+			required     = "${terraform.workspace}"
+			required_map = {x = 0}
+		}
+	`
+	d, err := ctx.Diff(loadCfg(t, cfg), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "default", d.RootModule().Resources["test_resource.r"].Attributes["required"].New)
+
+	ctx.Workspace("staging")
+	d, err = ctx.Diff(loadCfg(t, cfg), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "staging", d.RootModule().Resources["test_resource.r"].Attributes["required"].New)
+
+	ctx.Workspace("")
+	d, err = ctx.Diff(loadCfg(t, cfg), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "default", d.RootModule().Resources["test_resource.r"].Attributes["required"].New)
+}
+
+func TestApplyWithPlan(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", MakeFactory(test.Provider))
+	s, p, err := ctx.ApplyWithPlan(loadCfg(t, outputsCfg), nil)
+	require.NoError(t, err)
+	require.NotNil(t, p)
+	rd := p.Diff.RootModule().Resources
+	require.Len(t, rd, 2)
+	assert.Equal(t, tf.DiffCreate, rd["test_resource.r"].ChangeType())
+	assert.Equal(t, "r", rd["test_resource.r"].Attributes["required"].New)
+	assert.Equal(t, "r", s.RootModule().Resources["test_resource.r"].Primary.Attributes["required"])
+
+	s2, p, err := ctx.ApplyWithPlan(loadCfg(t, outputsCfg), s)
+	require.NoError(t, err)
+	assert.True(t, p.Diff.Empty())
+	assert.Len(t, s2.RootModule().Resources, 2)
+}
+
+func TestApplyWithActions(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", MakeFactory(test.Provider))
+	s, actions, err := ctx.ApplyWithActions(loadCfg(t, outputsCfg), nil)
+	require.NoError(t, err)
+	require.Len(t, actions, 2)
+	assert.Equal(t, "test_resource.m", actions[0].Addr)
+	assert.Equal(t, tf.DiffCreate, actions[0].Change)
+	assert.Equal(t, "test_resource.r", actions[1].Addr)
+	assert.Equal(t, "r", actions[1].Attrs["required"].New)
+	assert.Len(t, s.RootModule().Resources, 2)
+
+	s, actions, err = ctx.ApplyWithActions(loadCfg(t, `
+		resource "test_resource" "r" {
+			required     = "r2"
+			required_map = {x = 0}
+		}
+	`), s)
+	require.NoError(t, err)
+	require.Len(t, actions, 2)
+	assert.Equal(t, "test_resource.m", actions[0].Addr)
+	assert.Equal(t, tf.DiffDestroy, actions[0].Change)
+	assert.Equal(t, "test_resource.r", actions[1].Addr)
+	assert.Equal(t, "r2", actions[1].Attrs["required"].New)
+	assert.Len(t, s.RootModule().Resources, 1)
+
+	_, actions, err = ctx.ApplyWithActions(loadCfg(t, `
+		resource "test_resource" "r" {
+			required     = "r2"
+			required_map = {x = 0}
+		}
+	`), s)
+	require.NoError(t, err)
+	assert.Empty(t, actions)
+}
+
+func TestApplyNoDestroy(t *testing.T) {
+	var deleted []string
+	var ctx Ctx
+	ctx.Providers.Add("test", "", func() (tf.ResourceProvider, error) {
+		p := test.Provider().(*schema.Provider)
+		p.ResourcesMap["test_nodestroy"] = &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"value": {Type: schema.TypeString, Required: true, ForceNew: true},
+				"tag":   {Type: schema.TypeString, Optional: true},
+			},
+			Create: func(d *schema.ResourceData, _ interface{}) error {
+				d.SetId(d.Get("value").(string))
+				return nil
+			},
+			Read:   func(*schema.ResourceData, interface{}) error { return nil },
+			Update: func(*schema.ResourceData, interface{}) error { return nil },
+			Delete: func(d *schema.ResourceData, _ interface{}) error {
+				deleted = append(deleted, d.Id())
+				return nil
+			},
+		}
+		return p, nil
+	})
+	s, err := ctx.Apply(loadCfg(t, `
+		resource "test_nodestroy" "a" { value = "a" }
+		resource "test_nodestroy" "b" { value = "b" }
+		resource "test_nodestroy" "c" { value = "c" }
+	`), nil)
+	require.NoError(t, err)
+
+	cfg := loadCfg(t, `
+		resource "test_nodestroy" "a" {
+			value = "a"
+			tag   = "x"
+		}
+		resource "test_nodestroy" "b" { value = "b2" }
+		resource "test_nodestroy" "d" { value = "d" }
+	`)
+	s, skipped, err := ctx.ApplyWith(cfg, s, &ApplyOpts{NoDestroy: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test_nodestroy.b", "test_nodestroy.c"}, skipped)
+	assert.Empty(t, deleted)
+	rs := s.RootModule().Resources
+	assert.Equal(t, "x", rs["test_nodestroy.a"].Primary.Attributes["tag"])
+	assert.Equal(t, "b", rs["test_nodestroy.b"].Primary.ID)
+	assert.NotNil(t, rs["test_nodestroy.c"])
+	assert.NotNil(t, rs["test_nodestroy.d"])
+
+	s, skipped, err = ctx.ApplyWith(cfg, s, nil)
+	require.NoError(t, err)
+	assert.Empty(t, skipped)
+	assert.ElementsMatch(t, []string{"b", "c"}, deleted)
+	rs = s.RootModule().Resources
+	assert.Equal(t, "b2", rs["test_nodestroy.b"].Primary.ID)
+	assert.Nil(t, rs["test_nodestroy.c"])
+}
+
+func TestPlanIgnoreAttrs(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", func() (tf.ResourceProvider, error) {
+		p := test.Provider().(*schema.Provider)
+		p.ResourcesMap["test_ignore"] = &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"value": {Type: schema.TypeString, Required: true, ForceNew: true},
+				"tag":   {Type: schema.TypeString, Optional: true},
+				"note":  {Type: schema.TypeString, Optional: true},
+				"arn":   {Type: schema.TypeString, Computed: true},
+			},
+			Create: func(d *schema.ResourceData, _ interface{}) error {
+				d.SetId(d.Get("value").(string))
+				return d.Set("arn", "arn:"+d.Id())
+			},
+			Read:   func(*schema.ResourceData, interface{}) error { return nil },
+			Update: func(*schema.ResourceData, interface{}) error { return nil },
+			Delete: func(*schema.ResourceData, interface{}) error { return nil },
+		}
+		return p, nil
+	})
+	s, err := ctx.Apply(loadCfg(t, `
+		resource "test_ignore" "a" { value = "a" }
+		resource "test_ignore" "b" { value = "b" }
+		resource "test_ignore" "c" { value = "c" }
+	`), nil)
+	require.NoError(t, err)
+
+	cfg := loadCfg(t, `
+		resource "test_ignore" "a" {
+			value = "a"
+			tag   = "x"
+		}
+		resource "test_ignore" "b" {
+			value = "b"
+			tag   = "x"
+			note  = "y"
+		}
+		resource "test_ignore" "c" { value = "c2" }
+	`)
+	p, err := ctx.Plan(cfg, s)
+	require.NoError(t, err)
+	assert.Len(t, p.Diff.RootModule().Resources, 3)
+
+	p, err = ctx.PlanWith(cfg, s, &PlanOpts{IgnoreAttrs: map[string][]string{
+		"test_ignore": {"tag"},
+		"*":           {"note"},
+	}})
+	require.NoError(t, err)
+	rs := p.Diff.RootModule().Resources
+	assert.Nil(t, rs["test_ignore.a"])
+	assert.Nil(t, rs["test_ignore.b"])
+	require.NotNil(t, rs["test_ignore.c"])
+	assert.Equal(t, tf.DiffDestroyCreate, rs["test_ignore.c"].ChangeType())
+
+	p, err = ctx.PlanWith(cfg, s, &PlanOpts{IgnoreAttrs: map[string][]string{
+		"*": {"note"},
+	}})
+	require.NoError(t, err)
+	rs = p.Diff.RootModule().Resources
+	require.NotNil(t, rs["test_ignore.b"])
+	assert.Contains(t, rs["test_ignore.b"].Attributes, "tag")
+	assert.NotContains(t, rs["test_ignore.b"].Attributes, "note")
+
+	// Ignoring the ForceNew attribute must not leave computed-only changes
+	p, err = ctx.PlanWith(cfg, s, &PlanOpts{IgnoreAttrs: map[string][]string{
+		"test_ignore": {"value"},
+	}})
+	require.NoError(t, err)
+	rs = p.Diff.RootModule().Resources
+	assert.Nil(t, rs["test_ignore.c"])
+	require.NotNil(t, rs["test_ignore.a"])
+	assert.Equal(t, tf.DiffUpdate, rs["test_ignore.a"].ChangeType())
+}
+
+func TestProviderParallelism(t *testing.T) {
+	var cur, max int32
+	var overlap chan struct{} // Closed once two calls overlap
+	var once sync.Once
+	create := func(d *schema.ResourceData, _ interface{}) error {
+		n := atomic.AddInt32(&cur, 1)
+		defer atomic.AddInt32(&cur, -1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		if overlap != nil {
+			if n > 1 {
+				once.Do(func() { close(overlap) })
+			}
+			select {
+			case <-overlap:
+			case <-time.After(5 * time.Second):
+				return errors.New("no concurrent create")
+			}
+		}
+		d.SetId("x")
+		return nil
+	}
+	noop := func(*schema.ResourceData, interface{}) error { return nil }
+	var ctx Ctx
+	ctx.Providers.Add("test", "", func() (tf.ResourceProvider, error) {
+		p := test.Provider().(*schema.Provider)
+		p.ResourcesMap["test_slow"] = &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"n": {Type: schema.TypeInt, Required: true, ForceNew: true},
+			},
+			Create: create,
+			Read:   noop,
+			Delete: noop,
+		}
+		return p, nil
+	})
+	cfg := loadCfg(t, `
+resource "test_slow" "r" {
+	count = 4
+	n     = "${count.index}"
+}
+`)
+	overlap = make(chan struct{})
+	_, err := ctx.Apply(cfg, nil)
+	require.NoError(t, err)
+	assert.True(t, max > 1, "%d", max)
+
+	overlap, max = nil, 0
+	ctx.ProviderParallelism = map[string]int{"test": 1}
+	_, err = ctx.Apply(cfg, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), max)
+}
+
+func TestRefreshResource(t *testing.T) {
+	var reads []string
+	var ctx Ctx
+	ctx.Providers.Add("test", "", func() (tf.ResourceProvider, error) {
+		p := test.Provider().(*schema.Provider)
+		p.ResourcesMap["test_refresh"] = &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"value": {Type: schema.TypeString, Computed: true},
+			},
+			Create: func(*schema.ResourceData, interface{}) error { return nil },
+			Read: func(d *schema.ResourceData, _ interface{}) error {
+				reads = append(reads, d.Id())
+				if d.Id() == "gone" {
+					d.SetId("")
+					return nil
+				}
+				return d.Set("value", "read-"+d.Id())
+			},
+			Delete: func(*schema.ResourceData, interface{}) error { return nil },
+		}
+		return p, nil
+	})
+	s := NewState()
+	for _, id := range []string{"a", "b", "gone"} {
+		r, err := ctx.Providers.NewResource("test_refresh", id, false)
+		require.NoError(t, err)
+		s.RootModule().Resources[r.Key] = r.ResourceState
+	}
+
+	r, err := ctx.RefreshResource(s, "test_refresh.a")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, reads)
+	assert.Equal(t, "read-a", r.Primary.Attributes["value"])
+	assert.NotContains(t, s.RootModule().Resources["test_refresh.a"].Primary.Attributes, "value")
+
+	r, err = ctx.RefreshResource(s, "test_refresh.gone")
+	require.NoError(t, err)
+	assert.Nil(t, r)
+	assert.Equal(t, []string{"a", "gone"}, reads)
+
+	_, err = ctx.RefreshResource(s, "test_refresh.c")
+	assert.Error(t, err)
+}
+
+func TestRefreshContext(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", func() (tf.ResourceProvider, error) {
+		p := test.Provider().(*schema.Provider)
+		p.ResourcesMap["test_refresh"] = &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"value": {Type: schema.TypeString, Computed: true},
+			},
+			Create: func(*schema.ResourceData, interface{}) error { return nil },
+			Read: func(d *schema.ResourceData, _ interface{}) error {
+				if d.Id() == "gone" {
+					d.SetId("")
+				}
+				return nil
+			},
+			Delete: func(*schema.ResourceData, interface{}) error { return nil },
+		}
+		return p, nil
+	})
+	s := NewState()
+	for _, id := range []string{"a", "gone"} {
+		r, err := ctx.Providers.NewResource("test_refresh", id, false)
+		require.NoError(t, err)
+		s.RootModule().Resources[r.Key] = r.ResourceState
+	}
+
+	progress := make(map[string]bool)
+	out, err := ctx.RefreshContext(context.Background(), s, func(addr string, exists bool) {
+		progress[addr] = exists
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{
+		"test_refresh.a":    true,
+		"test_refresh.gone": false,
+	}, progress)
+	assert.Len(t, out.RootModule().Resources, 1)
+
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	out, err = ctx.RefreshContext(cctx, s, nil)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, out)
+}
+
+func TestSetDefaultsFiltered(t *testing.T) {
+	var pm ProviderMap
+	pm.Add("test", "", func() (tf.ResourceProvider, error) {
+		p := test.Provider().(*schema.Provider)
+		p.ResourcesMap["test_defaults"] = &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"a": {Type: schema.TypeString, Optional: true, Default: "x"},
+				"b": {Type: schema.TypeInt, Optional: true, Default: 1},
+			},
+		}
+		return p, nil
+	})
+	newState := func() *tf.State {
+		s := NewState()
+		s.RootModule().Resources["test_defaults.r"] = &tf.ResourceState{
+			Type: "test_defaults",
+			Primary: &tf.InstanceState{ID: "r", Attributes: map[string]string{
+				"id": "r",
+			}},
+		}
+		return s
+	}
+	attrs := func(s *tf.State) map[string]string {
+		return s.RootModule().Resources["test_defaults.r"].Primary.Attributes
+	}
+	c := Ctx{Providers: pm}
+
+	s := newState()
+	c.SetDefaults(s)
+	assert.Equal(t, map[string]string{"id": "r", "a": "x", "b": "1"}, attrs(s))
+
+	s = newState()
+	var seen []string
+	c.SetDefaultsFiltered(s, func(typ, attr string) bool {
+		assert.Equal(t, "test_defaults", typ)
+		seen = append(seen, attr)
+		return attr == "b"
+	})
+	assert.Equal(t, map[string]string{"id": "r", "b": "1"}, attrs(s))
+	assert.ElementsMatch(t, []string{"a", "b"}, seen)
+}
+
+func TestImport(t *testing.T) {
+	read := func(d *schema.ResourceData, _ interface{}) error {
+		return d.Set("value", "read-"+d.Id())
+	}
+	newResource := func() *schema.Resource {
+		return &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"value": {Type: schema.TypeString, Computed: true},
+			},
+			Create: func(*schema.ResourceData, interface{}) error { return nil },
+			Read:   read,
+			Delete: func(*schema.ResourceData, interface{}) error { return nil },
+		}
+	}
+	var ctx Ctx
+	ctx.Providers.Add("test", "", func() (tf.ResourceProvider, error) {
+		p := test.Provider().(*schema.Provider)
+		a, b := newResource(), newResource()
+		a.Importer = &schema.ResourceImporter{
+			State: func(d *schema.ResourceData, _ interface{}) ([]*schema.ResourceData, error) {
+				extra := b.Data(nil)
+				extra.SetId(d.Id() + "-b")
+				extra.SetType("test_import_b")
+				return []*schema.ResourceData{d, extra}, nil
+			},
+		}
+		p.ResourcesMap["test_import_a"] = a
+		p.ResourcesMap["test_import_b"] = b
+		return p, nil
+	})
+
+	rs, err := ctx.Import("test_import_a", "x")
+	require.NoError(t, err)
+	require.Len(t, rs, 2)
+	assert.Equal(t, "test_import_a.x", rs[0].Key)
+	assert.Equal(t, "x", rs[0].Primary.ID)
+	assert.Equal(t, "read-x", rs[0].Primary.Attributes["value"])
+	assert.Equal(t, "test_import_b.x", rs[1].Key)
+	assert.Equal(t, "x-b", rs[1].Primary.ID)
+	assert.Equal(t, "read-x-b", rs[1].Primary.Attributes["value"])
+
+	_, err = ctx.Import("test_unknown", "x")
+	assert.Equal(t, ErrUnknownType("test_unknown"), err)
+	_, err = ctx.Import("test_import_a", "")
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", func() (tf.ResourceProvider, error) {
+		p := test.Provider().(*schema.Provider)
+		p.ResourcesMap["test_customize"] = &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"value": {Type: schema.TypeString, Optional: true},
+			},
+			CustomizeDiff: func(d *schema.ResourceDiff, _ interface{}) error {
+				if d.Get("value").(string) == "bad" {
+					return errors.New("bad value")
+				}
+				return nil
+			},
+			Create: func(*schema.ResourceData, interface{}) error { return nil },
+			Read:   func(*schema.ResourceData, interface{}) error { return nil },
+			Delete: func(*schema.ResourceData, interface{}) error { return nil },
+		}
+		return p, nil
+	})
+	assert.Empty(t, ctx.Validate(loadCfg(t, outputsCfg)))
+
+	errs := ctx.Validate(loadCfg(t, `
+		resource "test_resource" "a" {
+			required_map = {x = 0}
+		}
+		resource "test_resource" "b" {
+			required     = "b"
+			required_map = {x = 0}
+			unknown      = "b"
+		}
+	`))
+	assert.Len(t, errs, 2)
+
+	errs = ctx.Validate(loadCfg(t, `
+		resource "test_customize" "a" {
+			value = "bad"
+		}
+	`))
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "bad value")
+}
+
+func TestValidateProviderConfig(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", func() (tf.ResourceProvider, error) {
+		p := test.Provider().(*schema.Provider)
+		p.Schema = map[string]*schema.Schema{
+			"region": {
+				Type:     schema.TypeString,
+				Required: true,
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					if v.(string) == "bad" {
+						return nil, []error{errors.New("bad region")}
+					}
+					return nil, nil
+				},
+			},
+			"retries": {Type: schema.TypeInt, Optional: true},
+		}
+		p.ConfigureFunc = func(*schema.ResourceData) (interface{}, error) {
+			panic("configure called")
+		}
+		return p, nil
+	})
+	assert.Empty(t, ctx.ValidateProviderConfig("test", map[string]interface{}{
+		"region":  "us-east-1",
+		"retries": 3,
+	}))
+	assert.Len(t, ctx.ValidateProviderConfig("test", map[string]interface{}{
+		"retries": 3,
+	}), 1)
+	errs := ctx.ValidateProviderConfig("test", map[string]interface{}{
+		"region":  "bad",
+		"unknown": "x",
+	})
+	assert.Len(t, errs, 2)
+	assert.Len(t, ctx.ValidateProviderConfig("other", nil), 1)
+}
+
+func TestOutputs(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", MakeFactory(test.Provider))
+	cfg := loadCfg(t, outputsCfg)
+	out, err := ctx.Outputs(cfg, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"literal":  "abc",
+		"computed": config.UnknownVariableValue,
+		"missing":  config.UnknownVariableValue,
+	}, out)
+
+	r, err := ctx.Providers.NewResource("test_resource", "r-id", false)
+	require.NoError(t, err)
+	r.Primary.Attributes["required"] = "r"
+	r.Primary.Attributes["required_map.%"] = "1"
+	r.Primary.Attributes["required_map.x"] = "0"
+	s := NewState()
+	s.RootModule().Resources["test_resource.r"] = r.ResourceState
+	out, err = ctx.Outputs(cfg, s)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"literal":  "abc",
+		"computed": "r-id",
+		"missing":  config.UnknownVariableValue,
+	}, out)
+}
+
+func TestPlanData(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", MakeFactory(test.Provider))
+	r, err := ctx.PlanData(loadCfg(t, `
+		data "test_data_source" "d" {
+			input = "abc"
+		}
+
+		resource "test_resource" "r" {
+			required     = "${data.test_data_source.d.output}"
+			required_map = {x = 0}
+		}
+	`), nil, nil)
+	require.NoError(t, err)
+	require.Len(t, r.Data, 1)
+	d := r.Data["data.test_data_source.d"]
+	require.NotNil(t, d)
+	assert.Equal(t, "abc", d.Attributes["output"])
+	rd := r.Diff.RootModule().Resources["test_resource.r"]
+	require.NotNil(t, rd)
+	assert.Equal(t, "abc", rd.Attributes["required"].New)
+
+	r, err = ctx.PlanData(loadCfg(t, `
+		data "test_data_source" "d" {
+			input = "abc"
+		}
+	`), nil, nil)
+	require.NoError(t, err)
+	assert.True(t, r.Diff.Empty())
+	assert.Equal(t, "abc", r.Data["data.test_data_source.d"].Attributes["output"])
+}
+
+func TestPatchResource(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", MakeFactory(test.Provider))
+	s, err := ctx.Apply(loadCfg(t, outputsCfg), nil)
+	require.NoError(t, err)
+
+	d := &tf.InstanceDiff{Attributes: map[string]*tf.ResourceAttrDiff{
+		"required": {Old: "r", New: "patched"},
+	}}
+	out, err := ctx.PatchResource(s, "test_resource.r", d)
+	require.NoError(t, err)
+	r := out.RootModule().Resources["test_resource.r"]
+	require.NotNil(t, r)
+	assert.Equal(t, "patched", r.Primary.Attributes["required"])
+	assert.Equal(t, "r", s.RootModule().Resources["test_resource.r"].
+		Primary.Attributes["required"])
+	assert.NotNil(t, out.RootModule().Resources["test_resource.m"])
+
+	_, err = ctx.PatchResource(s, "test_resource.x", d)
+	assert.EqualError(t, err, `tfx: resource "test_resource.x" not found`)
+
+	m := out.DeepCopy()
+	st := StateTransform{"test_resource.r": "module.net.test_resource.r"}
+	require.NoError(t, st.Apply(m))
+	d = &tf.InstanceDiff{Attributes: map[string]*tf.ResourceAttrDiff{
+		"required": {Old: "patched", New: "module"},
+	}}
+	out, err = ctx.PatchResource(m, "module.net.test_resource.r", d)
+	require.NoError(t, err)
+	r = out.ModuleByPath([]string{"root", "net"}).Resources["test_resource.r"]
+	require.NotNil(t, r)
+	assert.Equal(t, "module", r.Primary.Attributes["required"])
+	_, err = ctx.PatchResource(m, "test_resource.r", d)
+	assert.Error(t, err)
+
+	_, err = ctx.PatchResource(s, "module.a.test_resource.r", d)
+	assert.Error(t, err)
+	_, err = ctx.PatchResource(s, "test_resource", d)
+	assert.Error(t, err)
+	_, err = ctx.PatchResource(s, "test_resource.r", nil)
+	assert.Error(t, err)
+}
+
+func TestConformID(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", MakeFactory(test.Provider))
+	cfg := loadCfg(t, `
+		resource "test_resource" "a" {
+			required     = "v"
+			required_map = {x = 0}
+		}
+
+		resource "test_resource" "b" {
+			required     = "v"
+			required_map = {x = 0}
+		}
+	`)
+	res := func(id string) *tf.ResourceState {
+		return &tf.ResourceState{Type: "test_resource", Primary: &tf.InstanceState{
+			ID: id,
+			Attributes: map[string]string{
+				"id":             id,
+				"required":       "v",
+				"required_map.%": "1",
+				"required_map.x": "0",
+			},
+		}}
+	}
+	s := NewState()
+	s.RootModule().Resources["test_resource.b"] = res("id-2")
+	s.RootModule().Resources["test_resource.old"] = res("id-1")
+	st, err := ctx.Conform(cfg, s, false)
+	require.NoError(t, err)
+	assert.Equal(t, StateTransform{
+		"module.root.test_resource.b":   "module.root.test_resource.b",
+		"module.root.test_resource.old": "module.root.test_resource.a",
+	}, st)
+}
+
+func TestConformDiff(t *testing.T) {
+	newTypes := func() map[string]map[string]*tf.ResourceState {
+		return map[string]map[string]*tf.ResourceState{"test_resource": {
+			"module.root.test_resource.x": {Type: "test_resource", Primary: &tf.InstanceState{
+				ID:         "id-1",
+				Attributes: map[string]string{"id": "id-1", "required": "v"},
+			}},
+			"module.root.test_resource.y": {Type: "test_resource", Primary: &tf.InstanceState{
+				ID:         "id-2",
+				Attributes: map[string]string{"id": "id-2", "required": "v"},
+			}},
+		}}
+	}
+	newDiff := func(id string) *tf.InstanceDiff {
+		d := &tf.InstanceDiff{Attributes: map[string]*tf.ResourceAttrDiff{
+			"id":       {NewComputed: true, RequiresNew: true},
+			"required": {New: "v", RequiresNew: true},
+		}}
+		if id != "" {
+			d.Attributes["id"] = &tf.ResourceAttrDiff{New: id, RequiresNew: true}
+		}
+		return d
+	}
+	d := &tf.Diff{Modules: []*tf.ModuleDiff{{
+		Path: tf.RootModulePath,
+		Resources: map[string]*tf.InstanceDiff{
+			"test_resource.a": newDiff(""),
+			"test_resource.b": newDiff(""),
+		},
+	}}}
+	types := newTypes()
+	st, ambiguous, err := conformDiff(d, types, 0)
+	require.NoError(t, err)
+	assert.Equal(t, StateTransform{
+		"module.root.test_resource.x": "module.root.test_resource.a",
+		"module.root.test_resource.y": "module.root.test_resource.b",
+	}, st)
+	assert.Empty(t, types["test_resource"])
+	assert.Equal(t, []string{"test_resource.a"}, ambiguous)
+
+	d.Modules[0].Resources["test_resource.a"] = newDiff("id-2")
+	d.Modules[0].Resources["test_resource.b"] = newDiff("id-1")
+	st, ambiguous, err = conformDiff(d, newTypes(), 0)
+	require.NoError(t, err)
+	assert.Empty(t, ambiguous)
+	assert.Equal(t, StateTransform{
+		"module.root.test_resource.y": "module.root.test_resource.a",
+		"module.root.test_resource.x": "module.root.test_resource.b",
+	}, st)
+}
+
+func TestConformState(t *testing.T) {
+	res := func(id, v string) *tf.ResourceState {
+		return &tf.ResourceState{Type: "test_resource", Primary: &tf.InstanceState{
+			ID:         id,
+			Attributes: map[string]string{"id": id, "required": v},
+		}}
+	}
+	cur := NewState()
+	cur.RootModule().Resources = map[string]*tf.ResourceState{
+		"test_resource.a": res("i1", "x"),
+		"test_resource.b": res("i2", "y"),
+		"test_resource.c": res("i3", "z"),
+		"test_resource.d": res("i4", "q"),
+	}
+	want := NewState()
+	want.RootModule().Resources = map[string]*tf.ResourceState{
+		"test_resource.a2": res("i1", "changed"),
+		"test_resource.c":  res("i3", "z"),
+		"test_resource.e":  res("i5", "none"),
+	}
+	want.AddModule([]string{"root", "m"}).Resources = map[string]*tf.ResourceState{
+		"test_resource.b": res("other", "y"),
+	}
+	st, err := ConformState(cur, want, false, 0)
+	require.NoError(t, err)
+	assert.Equal(t, StateTransform{
+		"module.root.test_resource.a": "module.root.test_resource.a2",
+		"module.root.test_resource.b": "module.root.module.m.test_resource.b",
+	}, st)
+
+	st, err = ConformState(cur, want, true, 0)
+	require.NoError(t, err)
+	assert.Equal(t, "", st["module.root.test_resource.d"])
+	assert.Len(t, st, 3)
+	require.NoError(t, st.Apply(cur))
+	assert.Len(t, cur.RootModule().Resources, 2)
+	assert.NotNil(t, cur.ModuleByPath([]string{"root", "m"}).Resources["test_resource.b"])
+
+	cur = NewState()
+	cur.RootModule().Resources = map[string]*tf.ResourceState{
+		"test_resource.a": res("i1", "x"),
+		"test_resource.b": res("i2", "x"),
+	}
+	want = NewState()
+	want.RootModule().Resources = map[string]*tf.ResourceState{
+		"test_resource.c": res("i3", "x"),
+	}
+	_, err = ConformState(cur, want, false, 0)
+	assert.EqualError(t, err,
+		"tfx: 1 ambiguous resource matches (max 0): test_resource.c")
+	st, err = ConformState(cur, want, false, 1)
+	require.NoError(t, err)
+	assert.Equal(t, StateTransform{
+		"module.root.test_resource.a": "module.root.test_resource.c",
+	}, st)
+
+	want.RootModule().Resources["bad"] = res("i4", "x")
+	_, err = ConformState(cur, want, false, -1)
+	assert.Error(t, err)
+}
+
 func loadCfg(t *testing.T, cfg string) *module.Tree {
 	c, err := config.LoadJSON(json.RawMessage(cfg))
 	require.NoError(t, err)
@@ -98,3 +938,27 @@ resource "test2_resource" "t2-alias" {
 	required_map = {x = 0}
 }
 `
+
+const outputsCfg = `
+resource "test_resource" "r" {
+	required     = "r"
+	required_map = {x = 0}
+}
+
+output "literal" {
+	value = "abc"
+}
+
+resource "test_resource" "m" {
+	required     = "m"
+	required_map = {x = 0}
+}
+
+output "computed" {
+	value = "${test_resource.r.id}"
+}
+
+output "missing" {
+	value = "${test_resource.m.id}"
+}
+`
@@ -9,11 +9,13 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"runtime"
 	"sort"
 	"strings"
@@ -38,17 +40,40 @@ import (
 func init() { log.SetFlags(0) }
 
 // Parser extracts interpolated attribute values from HCL examples.
+// IdentityFuncs are the names of interpolation functions that return a value
+// derived from their first argument, such that a resource reference in that
+// argument is still considered simple (e.g. "${lower(type.name.attr)}"). If
+// nil, DefaultIdentityFuncs are used. Suggested contains low-confidence specs
+// generated by ParseProvider, which are not included in the Model. If
+// IndexWildcards is true, attribute names include a "*" segment for each list
+// of nested blocks (e.g. "ip_configuration.*.subnet_id"). By default, such
+// indices are collapsed (e.g. "ip_configuration.subnet_id"). If
+// IncludeDataSources is true, data source blocks are parsed as well, and their
+// types are recorded with a "data." prefix (e.g. "data.aws_iam_policy"). If
+// ModuleOutputs is true, simple module output references (e.g.
+// "${module.name.output}") are recorded in Attr.Modules. These cannot be
+// represented by a DepSpec, so they are not included in the Model, but they
+// are available to custom logic via Call. FenceLanguages are the info strings
+// of markdown code blocks that contain HCL examples (e.g. "terraform"). If nil,
+// DefaultFenceLanguages are used.
 type Parser struct {
-	Provider *schema.Provider
-	Sources  []string
-	TypeMap  map[string]AttrMap
+	Provider           *schema.Provider
+	Sources            []string
+	TypeMap            map[string]AttrMap
+	IdentityFuncs      map[string]bool
+	Suggested          tfx.DepMap
+	IndexWildcards     bool
+	IncludeDataSources bool
+	ModuleOutputs      bool
+	FenceLanguages     []string
 
-	root string
-	file string
-	typ  string
-	attr []string
-	fset *token.FileSet
-	buf  bytes.Buffer
+	root  string
+	file  string
+	typ   string
+	attr  []string
+	slice []bool
+	fset  *token.FileSet
+	buf   bytes.Buffer
 
 	typPrefix string
 	schema    map[string]AttrSchema
@@ -84,6 +109,83 @@ func (p *Parser) ParseDir(root string) *Parser {
 	return p
 }
 
+// ParseReader parses a single source without accessing the file system. The
+// file type is determined by ext (".go", ".md", ".markdown", or ".tf"), and name
+// is recorded in p.Sources and used in log messages. Unlike ParseDir, which
+// records the directory as the source, each call adds a new p.Sources entry.
+// Go files are parsed even if the name does not end with "_test.go".
+func (p *Parser) ParseReader(name, ext string, r io.Reader) error {
+	if p.parser(ext) == nil {
+		return errUnsupported(ext)
+	}
+	p.Sources = append(p.Sources, name)
+	return p.parseSource(name, ext, r)
+}
+
+// ParseProvider generates dependency suggestions from the schema of p.Provider.
+// A top-level string attribute "<name>_id" or "<name>_arn" of one resource type
+// is assumed to refer to the "id" or "arn" attribute of "<prefix>_<name>" type,
+// where prefix is the provider's resource type prefix. Suggestions are logged
+// and stored in p.Suggested for review. Attributes that already have values in
+// p.TypeMap are skipped.
+func (p *Parser) ParseProvider() *Parser {
+	if p.Provider == nil {
+		return p
+	}
+	prefix := p.typPrefix
+	if prefix == "" {
+		for typ := range p.Provider.ResourcesMap {
+			if i := strings.IndexByte(typ, '_'); i > 0 {
+				prefix = typ[:i+1]
+				break
+			}
+		}
+	}
+	types := make([]string, 0, len(p.Provider.ResourcesMap))
+	for typ := range p.Provider.ResourcesMap {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		r := p.Provider.ResourcesMap[typ]
+		for name, s := range r.Schema {
+			if s.Type != schema.TypeString || p.TypeMap[typ][name] != nil {
+				continue
+			}
+			var src, srcAttr string
+			if strings.HasSuffix(name, "_id") {
+				src, srcAttr = strings.TrimSuffix(name, "_id"), "id"
+			} else if strings.HasSuffix(name, "_arn") {
+				src, srcAttr = strings.TrimSuffix(name, "_arn"), "arn"
+			} else {
+				continue
+			}
+			src = prefix + src
+			sr := p.Provider.ResourcesMap[src]
+			if sr == nil || src == typ ||
+				(srcAttr != "id" && sr.Schema[srcAttr] == nil) {
+				continue
+			}
+			if p.Suggested == nil {
+				p.Suggested = make(tfx.DepMap)
+			}
+			p.Suggested[typ] = append(p.Suggested[typ], tfx.DepSpec{
+				Attr:    name,
+				SrcType: src,
+				SrcAttr: srcAttr,
+			})
+		}
+	}
+	p.Suggested.Sort()
+	for _, typ := range types {
+		for _, ds := range p.Suggested[typ] {
+			log.Printf("Suggested dependency: %s.%s = ${%s.<name>.%s}",
+				typ, ds.Attr, ds.SrcType, ds.SrcAttr)
+		}
+	}
+	return p
+}
+
 // idHier is an AttrSchema hierarchy for the common "id" attribute.
 var idHier = []*schema.Schema{{
 	Type:     schema.TypeString,
@@ -91,6 +193,7 @@ var idHier = []*schema.Schema{{
 }}
 
 // Schema returns the schema of the specified resource attribute ("type.name").
+// Data source types must have a "data." prefix.
 func (p *Parser) Schema(typ, attr string) (s AttrSchema) {
 	k := typ
 	if attr != "" {
@@ -100,7 +203,11 @@ func (p *Parser) Schema(typ, attr string) (s AttrSchema) {
 	if ok || p.Provider == nil || typ == "" {
 		return
 	}
-	s.Resource = p.Provider.ResourcesMap[typ]
+	if strings.HasPrefix(typ, dataPrefix) {
+		s.Resource = p.Provider.DataSourcesMap[typ[len(dataPrefix):]]
+	} else {
+		s.Resource = p.Provider.ResourcesMap[typ]
+	}
 	if s.Resource != nil && attr != "" {
 		if attr == "id" {
 			s.Schema = idHier[0]
@@ -129,7 +236,7 @@ func (p *Parser) Apply(rules map[string]bool) *Parser {
 			if !ok {
 				keep, ok = rules[typ]
 				if !ok {
-					keep, ok = rules[t.Key[strings.IndexByte(t.Key, '.'):]]
+					keep, ok = rules[t.Key[len(typ):]]
 					if !ok {
 						continue
 					}
@@ -167,8 +274,70 @@ func (p *Parser) Call(fn func(*Attr) bool) *Parser {
 	return p
 }
 
+// SuggestRules returns a rule map for Apply containing the keys of all
+// attributes that Model would skip because of their values. All rules are set
+// to false. Attributes without a schema are not included because there is no
+// rule that would allow them to be kept. See FormatRules.
+func (p *Parser) SuggestRules() map[string]bool {
+	rules := make(map[string]bool)
+	for _, attrMap := range p.TypeMap {
+		for _, t := range attrMap {
+			if (p.Provider == nil || t.Schema != nil) && t.Explain() != "" {
+				rules[t.Key] = false
+			}
+		}
+	}
+	return rules
+}
+
+// FormatRules returns rules as a Go map literal with sorted keys.
+func FormatRules(rules map[string]bool) string {
+	keys := make([]string, 0, len(rules))
+	for k := range rules {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("map[string]bool{\n")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\t%q: %v,\n", k, rules[k])
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
 // Model converts parsed attribute information into a dependency map.
 func (p *Parser) Model() *Model {
+	_, main, _, _ := runtime.Caller(1)
+	return p.model(filepath.Dir(main))
+}
+
+// ParseProviders creates a new Parser for each provider, calls Parse, and
+// returns the resulting models indexed by provider name. Each Parser detects
+// its own resource type prefix and records its own sources. Models are written
+// to "depmap_<name>.go" in the directory of the caller, and the map variable
+// is named "<name>DepMap".
+func ParseProviders(providers map[string]func() tf.ResourceProvider) map[string]*Model {
+	_, main, _, _ := runtime.Caller(1)
+	dir := filepath.Dir(main)
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	models := make(map[string]*Model, len(names))
+	for _, name := range names {
+		var p Parser
+		m := p.Parse(providers[name]).model(dir)
+		m.Out = filepath.Join(dir, "depmap_"+name+".go")
+		m.MapVar = name + "DepMap"
+		models[name] = m
+	}
+	return models
+}
+
+// model implements Model for the specified output directory.
+func (p *Parser) model(dir string) *Model {
 	depMap := make(tfx.DepMap, len(p.TypeMap))
 	for _, typ := range p.sortedTypes() {
 		attrMap := p.TypeMap[typ]
@@ -194,8 +363,6 @@ func (p *Parser) Model() *Model {
 			depMap[typ] = spec
 		}
 	}
-	_, main, _, _ := runtime.Caller(1)
-	dir := filepath.Dir(main)
 	return &Model{
 		Out:     filepath.Join(dir, "depmap.go"),
 		Sources: p.Sources,
@@ -209,30 +376,59 @@ func (p *Parser) walkFiles(path string, fi os.FileInfo, err error) error {
 	if err != nil || !fi.Mode().IsRegular() {
 		return errors.Wrapf(err, "failed to walk %q", path)
 	}
-	var parse func(src []byte) error
-	switch filepath.Ext(path) {
+	ext := filepath.Ext(path)
+	if p.parser(ext) == nil ||
+		(ext == ".go" && !strings.HasSuffix(path, "_test.go")) {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open %q", path)
+	}
+	defer f.Close()
+	name, _ := filepath.Rel(p.root, path)
+	if name == "" {
+		name = path
+	}
+	return p.parseSource(name, ext, f)
+}
+
+// parser returns the parse function for the specified file extension or nil if
+// the file type is not supported.
+func (p *Parser) parser(ext string) func(b []byte) error {
+	switch ext {
 	case ".go":
-		if strings.HasSuffix(path, "_test.go") {
-			parse = p.parseGo
-		}
+		return p.parseGo
 	case ".md", ".markdown":
-		parse = p.parseMarkdown
+		return p.parseMarkdown
 	case ".tf":
-		parse = p.parseHCL
+		return p.parseHCL
 	}
+	return nil
+}
+
+// parseSource reads all data from r and parses it according to the file type
+// specified by ext. The name is used in error and log messages. This is the
+// common implementation of ParseReader and ParseDir, which differ only in how
+// they update p.Sources.
+func (p *Parser) parseSource(name, ext string, r io.Reader) error {
+	parse := p.parser(ext)
 	if parse == nil {
-		return nil
+		return errUnsupported(ext)
 	}
-	b, err := ioutil.ReadFile(path)
+	p.file = name
+	b, err := ioutil.ReadAll(r)
 	if err != nil {
 		return errors.Wrapf(err, "failed to read %q", p.file)
 	}
-	if p.file, _ = filepath.Rel(p.root, path); p.file == "" {
-		p.file = path
-	}
 	return parse(b)
 }
 
+// errUnsupported returns an error for an unsupported file type.
+func errUnsupported(ext string) error {
+	return fmt.Errorf("depgen: unsupported file type %q", ext)
+}
+
 func (p *Parser) parseGo(b []byte) error {
 	p.fset = token.NewFileSet()
 	f, err := parser.ParseFile(p.fset, p.file, b, 0)
@@ -242,13 +438,25 @@ func (p *Parser) parseGo(b []byte) error {
 	return errors.Wrapf(err, "failed to parse %q", p.file)
 }
 
+// parseMarkdown parses all HCL code blocks in a markdown document. Blocks that
+// contain only attribute assignments, without any top-level block, are
+// attributed to the resource type documented by the page (see docType).
 func (p *Parser) parseMarkdown(b []byte) error {
+	typ, b := p.docType(b)
 	block := 0
 	n := md.New(md.WithExtensions(md.FencedCode)).Parse(b)
 	n.Walk(func(n *md.Node, _ bool) md.WalkStatus {
-		if n.Type == md.CodeBlock && string(n.CodeBlockData.Info) == "hcl" {
+		if n.Type == md.CodeBlock && p.isHCLFence(string(n.CodeBlockData.Info)) {
 			if block++; bytes.Contains(n.Literal, []byte("${")) {
-				if err := p.parseHCL(n.Literal); err != nil {
+				src := n.Literal
+				if typ != "" && !topLevelBlock.Match(src) {
+					var b bytes.Buffer
+					fmt.Fprintf(&b, "resource %q \"example\" {\n", typ)
+					b.Write(src)
+					b.WriteString("\n}\n")
+					src = b.Bytes()
+				}
+				if err := p.parseHCL(src); err != nil {
 					log.Printf("Error parsing HCL in %q (block #%d): %v",
 						p.file, block, err)
 				}
@@ -259,18 +467,95 @@ func (p *Parser) parseMarkdown(b []byte) error {
 	return nil
 }
 
+// DefaultFenceLanguages are the markdown code block languages parsed by Parser
+// when Parser.FenceLanguages is nil.
+var DefaultFenceLanguages = []string{"hcl"}
+
+// isHCLFence returns true if a markdown code block with the specified info
+// string contains HCL.
+func (p *Parser) isHCLFence(info string) bool {
+	langs := p.FenceLanguages
+	if langs == nil {
+		langs = DefaultFenceLanguages
+	}
+	for _, lang := range langs {
+		if info == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// dataPrefix is the type prefix of data sources.
+const dataPrefix = "data."
+
+// topLevelBlock matches the start of a top-level block in HCL source.
+var topLevelBlock = regexp.MustCompile(`(?m)^\s*(?:(?:resource|data|module|` +
+	`output|variable|provider)\s+"|(?:locals|terraform)\s*\{)`)
+
+// docType returns the resource type documented by a markdown page and the page
+// contents without front matter. The type is the last word of the front matter
+// "page_title" (e.g. "AWS: aws_iam_user"). If there is no title and the page is
+// in an "r" directory (e.g. "r/iam_user.html.markdown"), the type is the
+// provider's resource type prefix followed by the file name up to the first
+// '.'. Data source pages in a "d" directory and types without the provider's
+// prefix are ignored, in which case an empty string is returned.
+func (p *Parser) docType(b []byte) (typ string, body []byte) {
+	body = b
+	if bytes.HasPrefix(b, []byte("---\n")) {
+		if i := bytes.Index(b[4:], []byte("\n---\n")); i >= 0 {
+			fm := b[4 : 4+i]
+			body = b[4+i+5:]
+			for _, ln := range strings.Split(string(fm), "\n") {
+				if v := strings.TrimPrefix(ln, "page_title:"); v != ln {
+					v = strings.Trim(strings.TrimSpace(v), `"'`)
+					if f := strings.Fields(v); len(f) > 0 {
+						typ = f[len(f)-1]
+					}
+					break
+				}
+			}
+		}
+	}
+	switch filepath.Base(filepath.Dir(p.file)) {
+	case "d":
+		return "", body // Data source
+	case "r":
+		if typ == "" && p.typPrefix != "" {
+			name := filepath.Base(p.file)
+			if i := strings.IndexByte(name, '.'); i > 0 {
+				typ = p.typPrefix + name[:i]
+			}
+		}
+	}
+	if !strings.HasPrefix(typ, p.typPrefix) || !strings.Contains(typ, "_") {
+		typ = ""
+	}
+	return
+}
+
 func (p *Parser) parseHCL(b []byte) error {
 	c, err := config.LoadJSON(json.RawMessage(b))
 	if err != nil {
 		return err
 	}
 	for _, r := range c.Resources {
-		if r.Mode == config.ManagedResourceMode &&
-			strings.HasPrefix(r.Type, p.typPrefix) {
+		if !strings.HasPrefix(r.Type, p.typPrefix) {
+			continue
+		}
+		switch r.Mode {
+		case config.ManagedResourceMode:
 			p.typ = r.Type
-			p.attr = p.attr[:0]
-			reflectwalk.Walk(r.RawConfig.Raw, attrWalker{p})
+		case config.DataResourceMode:
+			if !p.IncludeDataSources {
+				continue
+			}
+			p.typ = dataPrefix + r.Type
+		default:
+			continue
 		}
+		p.attr, p.slice = p.attr[:0], p.slice[:0]
+		reflectwalk.Walk(r.RawConfig.Raw, attrWalker{p})
 	}
 	return nil
 }
@@ -295,7 +580,14 @@ func (p *Parser) addVal(v *Val) {
 		}
 		attrMap[name] = t
 	}
-	if v.IsSimple() {
+	if v.IsModule() {
+		for _, m := range t.Modules {
+			if m.Module == v.Module && m.Output == v.Output {
+				return
+			}
+		}
+		t.Modules = append(t.Modules, v)
+	} else if v.IsSimple() {
 		for _, s := range t.Simple {
 			if s.Type == v.Type && s.Attr == v.Attr {
 				return // Ignore duplicates
@@ -371,7 +663,9 @@ func (s *AttrSchema) IsString() bool {
 // "${resource_type.name.attr}". Complex values may include literal text,
 // multiple interpolations, function calls, etc. These can normally be ignored
 // for the purposes of dependency inference, but sometimes may require
-// provider-specific logic to generate the correct DepSpec.
+// provider-specific logic to generate the correct DepSpec. Modules contains
+// simple module output references, which are only recorded if enabled by
+// Parser.ModuleOutputs.
 type Attr struct {
 	AttrSchema
 
@@ -380,6 +674,7 @@ type Attr struct {
 	Name    string
 	Simple  []*Val
 	Complex []*Val
+	Modules []*Val
 }
 
 // Keep hides all but the first simple value from view, allowing the attribute
@@ -434,20 +729,39 @@ func (t *Attr) String() string {
 }
 
 // Val is an attribute value that contains interpolations. AttrSchema, Type, and
-// Attr are set only for simple interpolations.
+// Attr are set only for simple interpolations. Module and Output are set instead
+// for simple module output references.
 type Val struct {
 	AttrSchema
 
-	File string
-	Raw  string
-	Type string
-	Attr string
-	Root *hast.Output
+	File   string
+	Raw    string
+	Type   string
+	Attr   string
+	Module string
+	Output string
+	Root   *hast.Output
 }
 
+// DefaultIdentityFuncs are the interpolation functions used by NewVal and by
+// Parser when Parser.IdentityFuncs is nil.
+var DefaultIdentityFuncs = map[string]bool{"element": true}
+
 // NewVal parses a HashiCorp Interpolation Language (HIL) string and returns a
 // new Val if it contains at least one interpolated resource expression.
 func NewVal(file, raw string) (*Val, error) {
+	return newVal(file, raw, DefaultIdentityFuncs, false)
+}
+
+// NewModuleVal is like NewVal, but module output references are also
+// recognized and reported via Val.Module and Val.Output.
+func NewModuleVal(file, raw string) (*Val, error) {
+	return newVal(file, raw, DefaultIdentityFuncs, true)
+}
+
+// newVal implements NewVal and NewModuleVal using the specified identity
+// functions.
+func newVal(file, raw string, identity map[string]bool, modules bool) (*Val, error) {
 	if !strings.Contains(raw, "${") {
 		return nil, nil
 	}
@@ -470,14 +784,13 @@ func NewVal(file, raw string) (*Val, error) {
 			s.pop(len(n.Exprs))
 			s.push(nil)
 		case *hast.Call:
-			if v := s.pop(len(n.Args)); n.Func == "element" {
+			if v := s.pop(len(n.Args)); len(v) > 0 && identity[n.Func] {
 				s.push(v[0])
 			} else {
 				s.push(nil)
 			}
 		case *hast.Conditional:
-			s.pop(3)
-			s.push(nil)
+			s.push(condVar(n, s.pop(3), modules))
 		case *hast.Index:
 			s.push(s.pop(2)[0])
 		case *hast.LiteralNode:
@@ -492,33 +805,86 @@ func NewVal(file, raw string) (*Val, error) {
 		return n
 	})
 
-	// Parse all VariableAccess nodes. At least one resource expression is
-	// needed to return a value.
+	// Parse all VariableAccess nodes. At least one resource (or module)
+	// expression is needed to return a value.
 	var v *Val
 	for _, va := range allVars {
 		interp, err := config.NewInterpolatedVariable(va.Name)
 		if err != nil {
 			return nil, err
 		}
-		r, _ := interp.(*config.ResourceVariable)
-		if r != nil && r.Mode == config.ManagedResourceMode {
+		simple := len(s) == 1 && s[0] == va
+		switch r := interp.(type) {
+		case *config.ResourceVariable:
+			if r.Mode != config.ManagedResourceMode {
+				continue
+			}
 			if v == nil {
 				v = &Val{File: file, Raw: raw, Root: n}
 			}
-			if len(s) == 1 && s[0] == va {
-				// Simple value
+			if simple {
 				v.Type = r.Type
 				v.Attr = r.Field
 			}
-			// Keep going to catch any errors
+		case *config.ModuleVariable:
+			if !modules {
+				continue
+			}
+			if v == nil {
+				v = &Val{File: file, Raw: raw, Root: n}
+			}
+			if simple {
+				v.Module = r.Name
+				v.Output = r.Field
+			}
 		}
+		// Keep going to catch any errors
 	}
 	return v, nil
 }
 
+// condVar returns the managed resource variable used as the true or false
+// expression of conditional n if that is the only managed resource variable
+// anywhere in the conditional. Otherwise, it returns nil. Stack values v are
+// the condition, true, and false expressions in that order. If modules is true,
+// module output variables are treated the same way as resource variables.
+func condVar(n *hast.Conditional, v []*hast.VariableAccess, modules bool) *hast.VariableAccess {
+	count := 0
+	n.Accept(func(n hast.Node) hast.Node {
+		if va, ok := n.(*hast.VariableAccess); ok && isRef(va, modules) {
+			count++
+		}
+		return n
+	})
+	if count == 1 {
+		for _, va := range v[1:] {
+			if va != nil && isRef(va, modules) {
+				return va
+			}
+		}
+	}
+	return nil
+}
+
+// isRef returns true if va refers to a managed resource attribute or, if
+// modules is true, to a module output.
+func isRef(va *hast.VariableAccess, modules bool) bool {
+	interp, _ := config.NewInterpolatedVariable(va.Name)
+	switch r := interp.(type) {
+	case *config.ResourceVariable:
+		return r.Mode == config.ManagedResourceMode
+	case *config.ModuleVariable:
+		return modules
+	}
+	return false
+}
+
 // IsSimple returns true for values with just one resource interpolation.
 func (v *Val) IsSimple() bool { return v.Type != "" }
 
+// IsModule returns true for values with just one module output interpolation.
+func (v *Val) IsModule() bool { return v.Module != "" }
+
 // String implements fmt.Stringer.
 func (v *Val) String() string { return v.Raw }
 
@@ -545,7 +911,7 @@ var {{.MapVar}} = {{.DepMapType}}{{with .DepMap}}{
 {{- range $k, $v := .}}
 	"{{$k}}": {
 	{{- range $v}}
-		{Attr: "{{.Attr}}", SrcType: "{{.SrcType}}", SrcAttr: "{{.SrcAttr}}"},
+		{Attr: "{{.Attr}}", SrcType: "{{.SrcType}}", SrcAttr: "{{.SrcAttr}}"{{if .SrcMulti}}, SrcMulti: true{{end}}{{if .NoSameType}}, NoSameType: true{{end}}},
 	{{- end}}
 	},
 {{- end}}
@@ -556,11 +922,21 @@ var {{.MapVar}} = {{.DepMapType}}{{with .DepMap}}{
 func (m *Model) DepMapType() reflect.Type { return reflect.TypeOf(m.DepMap) }
 
 // Write generates Go source code from the model and writes the output to m.Out.
+// The specs of each resource type are written in sorted order to make the
+// output deterministic. The model itself is not modified.
 func (m *Model) Write() {
+	c := *m
+	if m.DepMap != nil {
+		c.DepMap = make(tfx.DepMap, len(m.DepMap))
+		for typ, spec := range m.DepMap {
+			c.DepMap[typ] = append([]tfx.DepSpec(nil), spec...)
+		}
+		c.DepMap.Sort()
+	}
 	t, err := template.New("").Parse(tpl)
 	if err == nil {
 		var b bytes.Buffer
-		if err = t.Execute(&b, m); err == nil {
+		if err = t.Execute(&b, &c); err == nil {
 			if m.Out == "" || m.Out == "-" {
 				_, err = b.WriteTo(os.Stdout)
 			} else {
@@ -605,9 +981,29 @@ func (w attrWalker) MapElem(m, k, v reflect.Value) error {
 	return nil
 }
 
+func (attrWalker) Slice(reflect.Value) error { return nil }
+
+func (w attrWalker) SliceElem(_ int, v reflect.Value) error {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	block := w.IndexWildcards && v.Kind() == reflect.Map
+	if w.slice = append(w.slice, block); block {
+		w.attr = append(w.attr, "*")
+	}
+	return nil
+}
+
 func (w attrWalker) Exit(loc reflectwalk.Location) error {
-	if loc == reflectwalk.MapValue {
+	switch loc {
+	case reflectwalk.MapValue:
 		w.attr = w.attr[:len(w.attr)-1]
+	case reflectwalk.SliceElem:
+		i := len(w.slice) - 1
+		if w.slice[i] {
+			w.attr = w.attr[:len(w.attr)-1]
+		}
+		w.slice = w.slice[:i]
 	}
 	return nil
 }
@@ -619,7 +1015,11 @@ func (w attrWalker) Primitive(v reflect.Value) error {
 	if v.Kind() != reflect.String {
 		return nil
 	}
-	val, err := NewVal(w.file, v.String())
+	identity := w.IdentityFuncs
+	if identity == nil {
+		identity = DefaultIdentityFuncs
+	}
+	val, err := newVal(w.file, v.String(), identity, w.ModuleOutputs)
 	if val != nil {
 		w.addVal(val)
 	}
@@ -649,6 +1049,9 @@ func attrSchema(s *schema.Schema, next string, hier *[]*schema.Schema) bool {
 	}
 	switch *hier = append(*hier, s); s.Type {
 	case schema.TypeList, schema.TypeSet:
+		if next == "*" || strings.HasPrefix(next, "*.") {
+			next = strings.TrimPrefix(next[1:], ".") // Index wildcard
+		}
 		switch e := s.Elem.(type) {
 		case *schema.Schema:
 			return attrSchema(e, next, hier)
@@ -697,6 +1100,7 @@ func splitAttr(s string) (attr, next string) {
 // unfmt replaces fmt verbs in b with mock values. This allows parsing HCL
 // configs that are normally pre-processed with fmt.Sprintf().
 func unfmt(v []byte) []byte {
+	body := heredocs(v)
 	start, fill := -1, byte(' ')
 	for i, b := range v {
 		if start < 0 {
@@ -729,6 +1133,11 @@ func unfmt(v []byte) []byte {
 				fill = 'x' // Start of a block (%s for ident or string)
 			} else if bytes.HasSuffix(tail, []byte("EOF")) {
 				fill = '\n' // Heredoc
+			} else if inRange(body, start) {
+				// Heredoc bodies, such as policy documents, may contain
+				// interpolations that must be preserved, so only the verb is
+				// replaced.
+				fill = 'x'
 			} else {
 				start = bytes.LastIndexByte(v[:i], '\n') + 1
 				i = j - 1
@@ -747,3 +1156,51 @@ func unfmt(v []byte) []byte {
 	}
 	return v
 }
+
+// heredocs returns the [start, end) offsets of all heredoc bodies in v. Closing
+// markers may be preceded by a fmt verb (e.g. "%sEOF").
+func heredocs(v []byte) [][2]int {
+	var out [][2]int
+	var marker []byte
+	for i := 0; i < len(v); {
+		j := bytes.IndexByte(v[i:], '\n')
+		if j < 0 {
+			j = len(v)
+		} else {
+			j += i
+		}
+		line := bytes.TrimSpace(v[i:j])
+		if marker != nil {
+			if bytes.HasSuffix(line, marker) {
+				if p := line[:len(line)-len(marker)]; len(p) == 0 || p[0] == '%' {
+					out[len(out)-1][1] = i
+					marker = nil
+				}
+			}
+		} else if k := bytes.Index(line, []byte("<<")); k >= 0 {
+			m := bytes.TrimPrefix(line[k+2:], []byte("-"))
+			if len(m) > 0 && bytes.IndexFunc(m, notIdent) < 0 {
+				marker = m
+				out = append(out, [2]int{j + 1, len(v)})
+			}
+		}
+		i = j + 1
+	}
+	return out
+}
+
+// notIdent returns true if r is not a valid heredoc marker character.
+func notIdent(r rune) bool {
+	return !('0' <= r && r <= '9' || 'A' <= r && r <= 'Z' ||
+		'a' <= r && r <= 'z' || r == '_')
+}
+
+// inRange returns true if i is within one of the specified ranges.
+func inRange(ranges [][2]int, i int) bool {
+	for _, r := range ranges {
+		if r[0] <= i && i < r[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,7 @@ package depgen
 
 import (
 	"bytes"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/hashicorp/terraform/builtin/providers/test"
 	"github.com/hashicorp/terraform/helper/schema"
+	tf "github.com/hashicorp/terraform/terraform"
 	"github.com/mxk/go-gomod"
 	"github.com/mxk/go-terraform/tfx"
 	"github.com/stretchr/testify/assert"
@@ -28,6 +30,10 @@ func TestNewVal(t *testing.T) {
 		{"${resource_type.name.attr}", &Val{Type: "resource_type", Attr: "attr"}},
 		{"${element(resource_type.name.attr[0], count.index)}", &Val{Type: "resource_type", Attr: "attr"}},
 		{"complex${resource_type.name.attr}", &Val{}},
+		{`${var.enabled ? resource_type.name.attr : ""}`, &Val{Type: "resource_type", Attr: "attr"}},
+		{`${var.enabled ? var.other : resource_type.name.attr}`, &Val{Type: "resource_type", Attr: "attr"}},
+		{`${var.enabled ? resource_type.a.attr : resource_type.b.attr}`, &Val{}},
+		{`${resource_type.name.attr == "" ? "a" : "b"}`, &Val{}},
 	}
 	for _, tc := range tests {
 		v, err := NewVal("", tc.have)
@@ -44,6 +50,56 @@ func TestNewVal(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestNewModuleVal(t *testing.T) {
+	v, err := NewVal("", "${module.m.out}")
+	require.NoError(t, err)
+	assert.Nil(t, v)
+
+	v, err = NewModuleVal("", "${module.m.out}")
+	require.NoError(t, err)
+	require.NotNil(t, v)
+	assert.True(t, v.IsModule())
+	assert.False(t, v.IsSimple())
+	assert.Equal(t, "m", v.Module)
+	assert.Equal(t, "out", v.Output)
+
+	v, err = NewModuleVal("", `${var.x ? module.m.out : ""}`)
+	require.NoError(t, err)
+	require.NotNil(t, v)
+	assert.Equal(t, "m", v.Module)
+
+	v, err = NewModuleVal("", "${module.m.out}-${resource_type.name.attr}")
+	require.NoError(t, err)
+	require.NotNil(t, v)
+	assert.False(t, v.IsModule())
+	assert.False(t, v.IsSimple())
+}
+
+func TestParseModuleOutputs(t *testing.T) {
+	const cfg = `
+		resource "aws_iam_user" "u" {
+			name = "${module.names.user}"
+			path = "${aws_iam_group.g.path}"
+		}
+	`
+	var p Parser
+	require.NoError(t, p.ParseReader("a.tf", ".tf", strings.NewReader(cfg)))
+	assert.Nil(t, p.TypeMap["aws_iam_user"]["name"])
+
+	p = Parser{ModuleOutputs: true}
+	require.NoError(t, p.ParseReader("a.tf", ".tf", strings.NewReader(cfg)))
+	name := p.TypeMap["aws_iam_user"]["name"]
+	require.NotNil(t, name)
+	require.Len(t, name.Modules, 1)
+	assert.Equal(t, "names", name.Modules[0].Module)
+	assert.Equal(t, "user", name.Modules[0].Output)
+	assert.Empty(t, name.Simple)
+	assert.Empty(t, name.Complex)
+	assert.Equal(t, tfx.DepMap{"aws_iam_user": {
+		{Attr: "path", SrcType: "aws_iam_group", SrcAttr: "path"},
+	}}, p.Model().DepMap)
+}
+
 func TestParser(t *testing.T) {
 	dir := filepath.Dir(gomod.File(TestParser))
 	want := &Model{
@@ -78,6 +134,16 @@ func TestParser(t *testing.T) {
 		`Attribute with 0 simple values: azurerm_network_interface.location = ["%%0000-${azurerm_resource_group.test.location}"]`,
 		strings.TrimSpace(b.String()))
 
+	// Index wildcards
+	w := Parser{IndexWildcards: true}
+	nic := w.ParseDir(dir).Model().DepMap["azurerm_network_interface"]
+	assert.Equal(t, []tfx.DepSpec{
+		{Attr: "ip_configuration.*.public_ip_address_id", SrcType: "azurerm_public_ip", SrcAttr: "id"},
+		{Attr: "ip_configuration.*.subnet_id", SrcType: "azurerm_subnet", SrcAttr: "id"},
+		{Attr: "resource_group_name", SrcType: "azurerm_resource_group", SrcAttr: "name"},
+	}, nic)
+	b.Reset()
+
 	// Filter
 	p.Apply(map[string]bool{".location": false})
 	p.Call(func(t *Attr) bool { return t.Type != "aws_iam_user_group_membership" })
@@ -87,6 +153,356 @@ func TestParser(t *testing.T) {
 	assert.Empty(t, b.Bytes())
 }
 
+func TestParseReader(t *testing.T) {
+	b, err := ioutil.ReadFile("test.md")
+	require.NoError(t, err)
+	var p Parser
+	require.NoError(t, p.ParseReader("test.md", ".md", bytes.NewReader(b)))
+	require.Error(t, p.ParseReader("test.txt", ".txt", bytes.NewReader(b)))
+	assert.Equal(t, []string{"test.md"}, p.Sources)
+	want := tfx.DepMap{
+		"aws_iam_user_policy_attachment": {
+			{Attr: "policy_arn", SrcType: "aws_iam_policy", SrcAttr: "arn"},
+			{Attr: "user", SrcType: "aws_iam_user", SrcAttr: "name"},
+		},
+		"aws_iam_user_group_membership": {
+			{Attr: "groups", SrcType: "aws_iam_group", SrcAttr: "name"},
+			{Attr: "user", SrcType: "aws_iam_user", SrcAttr: "name"},
+		},
+	}
+	assert.Equal(t, want, p.Model().DepMap)
+}
+
+func TestParseFrontMatter(t *testing.T) {
+	const titled = "---\n" +
+		"layout: \"aws\"\n" +
+		"page_title: \"AWS: aws_iam_user_policy_attachment\"\n" +
+		"---\n\n" +
+		"```hcl\n" +
+		"policy_arn = \"${aws_iam_policy.policy.arn}\"\n" +
+		"```\n"
+	const untitled = "# Membership\n\n" +
+		"```hcl\n" +
+		"user = \"${aws_iam_user.user.name}\"\n" +
+		"```\n"
+	p := Parser{typPrefix: "aws_"}
+	require.NoError(t, p.ParseReader("r/a.html.markdown", ".markdown", strings.NewReader(titled)))
+	require.NoError(t, p.ParseReader("r/iam_user_group_membership.html.markdown", ".markdown", strings.NewReader(untitled)))
+	require.NoError(t, p.ParseReader("d/iam_user.html.markdown", ".markdown", strings.NewReader(untitled)))
+	require.NoError(t, p.ParseReader("x/iam_user.html.markdown", ".markdown", strings.NewReader(untitled)))
+	want := tfx.DepMap{
+		"aws_iam_user_policy_attachment": {
+			{Attr: "policy_arn", SrcType: "aws_iam_policy", SrcAttr: "arn"},
+		},
+		"aws_iam_user_group_membership": {
+			{Attr: "user", SrcType: "aws_iam_user", SrcAttr: "name"},
+		},
+	}
+	assert.Equal(t, want, p.Model().DepMap)
+}
+
+func TestParseTopLevelBlocks(t *testing.T) {
+	const doc = "---\n" +
+		"page_title: \"AWS: aws_iam_user_policy_attachment\"\n" +
+		"---\n\n" +
+		"```hcl\n" +
+		"output \"arn\" {\n" +
+		"  value = \"${aws_iam_policy.policy.arn}\"\n" +
+		"}\n" +
+		"```\n\n" +
+		"```hcl\n" +
+		"locals {\n" +
+		"  user = \"${aws_iam_user.user.name}\"\n" +
+		"}\n" +
+		"```\n\n" +
+		"```hcl\n" +
+		"provider = \"aws.west\"\n" +
+		"user     = \"${aws_iam_user.user.name}\"\n" +
+		"```\n"
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	defer log.SetOutput(os.Stderr)
+	p := Parser{typPrefix: "aws_"}
+	require.NoError(t, p.ParseReader("r/a.html.markdown", ".markdown", strings.NewReader(doc)))
+	want := tfx.DepMap{
+		"aws_iam_user_policy_attachment": {
+			{Attr: "user", SrcType: "aws_iam_user", SrcAttr: "name"},
+		},
+	}
+	assert.Equal(t, want, p.Model().DepMap)
+	assert.Empty(t, b.String())
+}
+
+func TestParseFenceLanguages(t *testing.T) {
+	const doc = "```terraform\n" +
+		"resource \"aws_iam_user_policy\" \"p\" {\n" +
+		"  user = \"${aws_iam_user.u.name}\"\n" +
+		"}\n" +
+		"```\n\n" +
+		"```tf\n" +
+		"resource \"aws_iam_user_policy\" \"p\" {\n" +
+		"  policy = \"${data.aws_iam_policy_document.doc.json}\"\n" +
+		"}\n" +
+		"```\n\n" +
+		"```terraform\n" +
+		"resource \"aws_iam_user_policy\" \"p\" {\n" +
+		"  name = \"literal\"\n" +
+		"}\n" +
+		"```\n"
+	var p Parser
+	require.NoError(t, p.ParseReader("a.md", ".md", strings.NewReader(doc)))
+	assert.Empty(t, p.Model().DepMap)
+
+	p = Parser{FenceLanguages: []string{"hcl", "terraform"}}
+	require.NoError(t, p.ParseReader("a.md", ".md", strings.NewReader(doc)))
+	want := tfx.DepMap{
+		"aws_iam_user_policy": {
+			{Attr: "user", SrcType: "aws_iam_user", SrcAttr: "name"},
+		},
+	}
+	assert.Equal(t, want, p.Model().DepMap)
+}
+
+func TestParseDataSources(t *testing.T) {
+	const md = "```hcl\n" +
+		"data \"aws_iam_policy_document\" \"doc\" {\n" +
+		"  statement {\n" +
+		"    resources = [\"${aws_s3_bucket.b.arn}\"]\n" +
+		"  }\n" +
+		"}\n" +
+		"resource \"aws_iam_policy\" \"p\" {\n" +
+		"  policy = \"${data.aws_iam_policy_document.doc.json}\"\n" +
+		"  name   = \"${aws_iam_user.u.name}\"\n" +
+		"}\n" +
+		"```\n"
+	var p Parser
+	require.NoError(t, p.ParseReader("a.md", ".md", strings.NewReader(md)))
+	assert.Equal(t, tfx.DepMap{
+		"aws_iam_policy": {
+			{Attr: "name", SrcType: "aws_iam_user", SrcAttr: "name"},
+		},
+	}, p.Model().DepMap)
+
+	p = Parser{IncludeDataSources: true}
+	require.NoError(t, p.ParseReader("a.md", ".md", strings.NewReader(md)))
+	assert.Equal(t, tfx.DepMap{
+		"aws_iam_policy": {
+			{Attr: "name", SrcType: "aws_iam_user", SrcAttr: "name"},
+		},
+		"data.aws_iam_policy_document": {
+			{Attr: "statement.resources", SrcType: "aws_s3_bucket", SrcAttr: "arn"},
+		},
+	}, p.Model().DepMap)
+	p.Apply(map[string]bool{".statement.resources": false})
+	assert.NotContains(t, p.Model().DepMap, "data.aws_iam_policy_document")
+}
+
+func TestUnfmtHeredoc(t *testing.T) {
+	const cfg = "\nresource \"aws_iam_user_policy\" \"p\" {\n" +
+		"  name   = \"${aws_iam_user.u.name}\"\n" +
+		"  user   = \"%s\"\n" +
+		"  policy = <<EOF\n" +
+		"{\n" +
+		"  \"Action\": \"%s\",\n" +
+		"  \"Resource\": \"${aws_s3_bucket.b.arn}/%[2]v\"\n" +
+		"}\n" +
+		"EOF\n" +
+		"}\n" +
+		"%s"
+	assert.Equal(t, "\nresource \"aws_iam_user_policy\" \"p\" {\n"+
+		"  name   = \"${aws_iam_user.u.name}\"\n"+
+		"               \n"+
+		"  policy = <<EOF\n"+
+		"{\n"+
+		"  \"Action\": \"xx\",\n"+
+		"  \"Resource\": \"${aws_s3_bucket.b.arn}/xxxxx\"\n"+
+		"}\n"+
+		"EOF\n"+
+		"}\n"+
+		"  ", string(unfmt([]byte(cfg))))
+
+	var p Parser
+	src := "package x\n\nconst cfg = `" + cfg + "`\n"
+	require.NoError(t, p.ParseReader("x.go", ".go", strings.NewReader(src)))
+	policy := p.TypeMap["aws_iam_user_policy"]["policy"]
+	require.NotNil(t, policy)
+	require.Len(t, policy.Complex, 1)
+	assert.Contains(t, policy.Complex[0].Raw, "${aws_s3_bucket.b.arn}/")
+	assert.Equal(t, tfx.DepMap{
+		"aws_iam_user_policy": {
+			{Attr: "name", SrcType: "aws_iam_user", SrcAttr: "name"},
+		},
+	}, p.Model().DepMap)
+}
+
+func TestSuggestRules(t *testing.T) {
+	const src = `
+		resource "a_x" "x1" {
+			good  = "${a_y.y.id}"
+			multi = "${a_y.y.id}"
+		}
+		resource "a_x" "x2" {
+			multi   = "${a_z.z.id}"
+			complex = "${a_y.y.id}-${a_z.z.id}"
+		}
+	`
+	var p Parser
+	require.NoError(t, p.ParseReader("main.tf", ".tf", strings.NewReader(src)))
+	rules := p.SuggestRules()
+	assert.Equal(t, map[string]bool{"a_x.complex": false, "a_x.multi": false}, rules)
+	want := "map[string]bool{\n" +
+		"\t\"a_x.complex\": false,\n" +
+		"\t\"a_x.multi\": false,\n" +
+		"}"
+	assert.Equal(t, want, FormatRules(rules))
+
+	rules["a_x.multi"] = true
+	p.Apply(rules)
+	assert.Equal(t, tfx.DepMap{"a_x": {
+		{Attr: "good", SrcType: "a_y", SrcAttr: "id"},
+		{Attr: "multi", SrcType: "a_y", SrcAttr: "id"},
+	}}, p.Model().DepMap)
+	assert.Empty(t, p.SuggestRules())
+}
+
+func TestModelStable(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "depgen")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	specs := []tfx.DepSpec{
+		{Attr: "a", SrcType: "b", SrcAttr: "id"},
+		{Attr: "a", SrcType: "a", SrcAttr: "id"},
+		{Attr: "b", SrcType: "a", SrcAttr: "name"},
+		{Attr: "b", SrcType: "a", SrcAttr: "id"},
+	}
+	var out [2][]byte
+	for i := range out {
+		// Merge the same specs in different order
+		dm := make(tfx.DepMap)
+		v := append([]tfx.DepSpec(nil), specs...)
+		if i == 1 {
+			v[0], v[1], v[2], v[3] = v[3], v[2], v[1], v[0]
+		}
+		dm.Add(tfx.DepMap{"x": v})
+		orig := append([]tfx.DepSpec(nil), dm["x"]...)
+		m := &Model{
+			Out:    filepath.Join(tmp, "depmap.go"),
+			Pkg:    "x",
+			MapVar: "depMap",
+			DepMap: dm,
+		}
+		m.Write()
+		out[i], err = ioutil.ReadFile(m.Out)
+		require.NoError(t, err)
+		assert.Equal(t, orig, m.DepMap["x"])
+
+		// Generate again from the same model
+		m.Write()
+		again, err := ioutil.ReadFile(m.Out)
+		require.NoError(t, err)
+		assert.Equal(t, out[i], again)
+	}
+	assert.Equal(t, out[0], out[1])
+	i := bytes.Index(out[0], []byte(`SrcType: "a", SrcAttr: "id"}`))
+	j := bytes.Index(out[0], []byte(`SrcType: "b", SrcAttr: "id"}`))
+	assert.True(t, 0 < i && i < j)
+}
+
+func TestIdentityFuncs(t *testing.T) {
+	const cfg = `
+resource "aws_iam_user_policy_attachment" "a" {
+  user       = "${lower(aws_iam_user.user1.name)}"
+  policy_arn = "${trimspace(aws_iam_policy.policy1.arn)}"
+}
+`
+	var p Parser
+	require.NoError(t, p.ParseReader("a.tf", ".tf", strings.NewReader(cfg)))
+	attr := p.TypeMap["aws_iam_user_policy_attachment"]["user"]
+	assert.Empty(t, attr.Simple)
+	assert.Len(t, attr.Complex, 1)
+
+	p = Parser{IdentityFuncs: map[string]bool{"lower": true}}
+	require.NoError(t, p.ParseReader("a.tf", ".tf", strings.NewReader(cfg)))
+	attr = p.TypeMap["aws_iam_user_policy_attachment"]["user"]
+	require.Len(t, attr.Simple, 1)
+	assert.Equal(t, "aws_iam_user", attr.Simple[0].Type)
+	assert.Equal(t, "name", attr.Simple[0].Attr)
+	assert.Empty(t, attr.Complex)
+	attr = p.TypeMap["aws_iam_user_policy_attachment"]["policy_arn"]
+	assert.Empty(t, attr.Simple)
+}
+
+func TestParseProviders(t *testing.T) {
+	str := &schema.Schema{Type: schema.TypeString, Optional: true}
+	newProvider := func(typ string, attrs ...string) func() tf.ResourceProvider {
+		return func() tf.ResourceProvider {
+			r := &schema.Resource{Schema: make(map[string]*schema.Schema)}
+			for _, attr := range attrs {
+				r.Schema[attr] = str
+			}
+			return &schema.Provider{
+				ResourcesMap: map[string]*schema.Resource{typ: r},
+			}
+		}
+	}
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	defer log.SetOutput(os.Stderr)
+
+	dir := filepath.Dir(gomod.File(TestParseProviders))
+	root := gomod.Root(TestParseProviders).Path()
+	models := ParseProviders(map[string]func() tf.ResourceProvider{
+		"aws":     newProvider("aws_iam_user_policy_attachment", "policy_arn", "user"),
+		"azurerm": newProvider("azurerm_network_interface", "resource_group_name"),
+	})
+	require.Len(t, models, 2)
+
+	aws := models["aws"]
+	assert.Equal(t, filepath.Join(dir, "depmap_aws.go"), aws.Out)
+	assert.Equal(t, "awsDepMap", aws.MapVar)
+	assert.Equal(t, []string{root}, aws.Sources)
+	assert.Equal(t, []tfx.DepSpec{
+		{Attr: "policy_arn", SrcType: "aws_iam_policy", SrcAttr: "arn"},
+		{Attr: "user", SrcType: "aws_iam_user", SrcAttr: "name"},
+	}, aws.DepMap["aws_iam_user_policy_attachment"])
+	assert.NotContains(t, aws.DepMap, "azurerm_network_interface")
+
+	az := models["azurerm"]
+	assert.Equal(t, "azurermDepMap", az.MapVar)
+	assert.Equal(t, []tfx.DepSpec{
+		{Attr: "resource_group_name", SrcType: "azurerm_resource_group", SrcAttr: "name"},
+	}, az.DepMap["azurerm_network_interface"])
+	assert.NotContains(t, az.DepMap, "aws_iam_user_policy_attachment")
+}
+
+func TestParseProvider(t *testing.T) {
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	defer log.SetOutput(os.Stderr)
+	str := &schema.Schema{Type: schema.TypeString, Optional: true}
+	p := Parser{Provider: &schema.Provider{ResourcesMap: map[string]*schema.Resource{
+		"x_vpc": {Schema: map[string]*schema.Schema{
+			"arn": str,
+		}},
+		"x_role": {Schema: map[string]*schema.Schema{}},
+		"x_subnet": {Schema: map[string]*schema.Schema{
+			"vpc_id":    str,
+			"vpc_arn":   str,
+			"role_arn":  str,
+			"other_id":  str,
+			"subnet_id": str,
+			"role_id":   {Type: schema.TypeInt, Optional: true},
+		}},
+	}}}
+	p.ParseProvider()
+	assert.Equal(t, tfx.DepMap{"x_subnet": {
+		{Attr: "vpc_arn", SrcType: "x_vpc", SrcAttr: "arn"},
+		{Attr: "vpc_id", SrcType: "x_vpc", SrcAttr: "id"},
+	}}, p.Suggested)
+	assert.Empty(t, p.TypeMap)
+	assert.Contains(t, b.String(), "Suggested dependency: x_subnet.vpc_id = ${x_vpc.<name>.id}")
+}
+
 func TestParserSchema(t *testing.T) {
 	s := test.Provider().(*schema.Provider)
 	r := s.ResourcesMap
@@ -133,6 +549,11 @@ func TestParserSchema(t *testing.T) {
 			Resource: r2,
 			Hier:     []*schema.Schema{r2.Schema["config"]},
 		}},
+		{attr: "test_resource_gh12183.config.*.name", str: true, schema: AttrSchema{
+			Schema:   r2.Schema["config"].Elem.(*schema.Resource).Schema["name"],
+			Resource: r2,
+			Hier:     []*schema.Schema{r2.Schema["config"]},
+		}},
 		{attr: "test_resource_gh12183.config.rules", str: true, schema: AttrSchema{
 			Schema:   r2.Schema["config"].Elem.(*schema.Resource).Schema["rules"].Elem.(*schema.Schema),
 			Resource: r2,
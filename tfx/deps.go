@@ -5,44 +5,212 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/hashicorp/terraform/config/module"
 	"github.com/hashicorp/terraform/helper/schema"
 	tf "github.com/hashicorp/terraform/terraform"
 )
 
 // DepMap is a resource dependency inference map. Keys are resource types.
 // Values are dependency specifications for attributes of that type. These maps
-// are usually generated for each provider via depgen.
+// are usually generated for each provider via depgen. Data source types, both
+// as keys and as SrcType values, have a "data." prefix (e.g. "data.aws_ami").
 type DepMap map[string][]DepSpec
 
 // DepSpec specifies that the value of attribute Attr is obtained in HCL by
 // interpolating "${SrcType.<name>.SrcAttr}". Resource dependencies are inferred
 // by comparing the value(s) of the destination attribute with those of all
-// available sources.
-type DepSpec struct{ Attr, SrcType, SrcAttr string }
+// available sources. Each source must have at most one SrcAttr value unless
+// SrcMulti is set, in which case a dependency is established if any source
+// value matches a destination value. Dependencies between resources of the same
+// type (e.g. subnets referencing other subnets) are allowed unless NoSameType
+// is set. Such dependencies may form cycles, which Infer does not detect (see
+// DependencyOrder), so NoSameType should be set for specs where same-type
+// matches are always spurious.
+type DepSpec struct {
+	Attr, SrcType, SrcAttr string
+	SrcMulti               bool
+	NoSameType             bool
+}
 
 // Deps is the global dependency inference map.
 var Deps = make(DepMap)
 
-// Add copies all entries from m to dm.
+// Add copies all entries from m to dm. If a resource type is already present in
+// dm (e.g. when two forks of the same provider are registered), the specs are
+// merged by appending those from m that are not already in dm. Add is not safe
+// for concurrent use; see RegisterProvider for updating the global map.
 func (dm DepMap) Add(m DepMap) {
 	for k, v := range m {
-		if dm[k] != nil {
-			panic("tfx: duplicate resource type: " + k)
+		have := dm[k]
+		if have == nil {
+			dm[k] = v
+			continue
+		}
+		merged := append(make([]DepSpec, 0, len(have)+len(v)), have...)
+	next:
+		for _, ds := range v {
+			for i := range have {
+				if have[i] == ds {
+					continue next
+				}
+			}
+			merged = append(merged, ds)
+		}
+		dm[k] = merged
+	}
+}
+
+// Sort sorts the specs of each resource type by Attr, SrcType, and SrcAttr.
+func (dm DepMap) Sort() {
+	for _, spec := range dm {
+		sort.Slice(spec, func(i, j int) bool {
+			return spec[i].less(&spec[j])
+		})
+	}
+}
+
+// DepChange describes one difference between two dependency maps. Old is set
+// only for changed specs, in which case DepSpec contains the new value.
+type DepChange struct {
+	Type string
+	DepSpec
+	Old *DepSpec
+}
+
+// Diff compares dm with a newer map and returns specs that were added to,
+// removed from, or changed in other. A spec is reported as changed only if it
+// is the only spec for the same type and attribute in both maps, but has a
+// different source. Any other change to the specs of an attribute is reported
+// as an addition and a removal. The comparison ignores spec order. All results
+// are sorted by type and spec.
+func (dm DepMap) Diff(other DepMap) (added, removed, changed []DepChange) {
+	type typeAttr struct{ typ, attr string }
+	group := func(m DepMap) map[typeAttr]map[DepSpec]bool {
+		g := make(map[typeAttr]map[DepSpec]bool)
+		for typ, spec := range m {
+			for _, ds := range spec {
+				k := typeAttr{typ, ds.Attr}
+				if g[k] == nil {
+					g[k] = make(map[DepSpec]bool)
+				}
+				g[k][ds] = true
+			}
+		}
+		return g
+	}
+	a, b := group(dm), group(other)
+	for k, bs := range b {
+		as := a[k]
+		if len(as) == 1 && len(bs) == 1 {
+			for old := range as {
+				for ds := range bs {
+					if ds != old {
+						old := old
+						changed = append(changed, DepChange{Type: k.typ, DepSpec: ds, Old: &old})
+					}
+				}
+			}
+			continue
+		}
+		for ds := range bs {
+			if !as[ds] {
+				added = append(added, DepChange{Type: k.typ, DepSpec: ds})
+			}
 		}
-		dm[k] = v
 	}
+	for k, as := range a {
+		bs := b[k]
+		if len(as) == 1 && len(bs) == 1 {
+			continue
+		}
+		for ds := range as {
+			if !bs[ds] {
+				removed = append(removed, DepChange{Type: k.typ, DepSpec: ds})
+			}
+		}
+	}
+	sortDepChanges(added)
+	sortDepChanges(removed)
+	sortDepChanges(changed)
+	return
 }
 
 // Infer updates dependencies for all resources in s. This is most commonly used
 // for states created via a scan.
-func (dm DepMap) Infer(s *tf.State) {
-	for _, m := range s.Modules {
+func (dm DepMap) Infer(s *tf.State) { dm.infer(s, nil, nil) }
+
+// Normalizer returns the normalized form of an attribute value for dependency
+// inference. It is called for both source and destination values with the
+// source type and attribute of the DepSpec being evaluated. It can be used to
+// compensate for providers that store the same logical value in different ways
+// (e.g. case differences or trailing slashes).
+type Normalizer func(srcType, srcAttr, value string) string
+
+// InferWith is like Infer, but it compares normalized attribute values. A nil
+// normalizer requires an exact match.
+func (dm DepMap) InferWith(s *tf.State, norm Normalizer) { dm.infer(s, norm, nil) }
+
+// UnresolvedDep describes destination attribute values that did not match any
+// source of the type specified by DepSpec. Path and Key identify the destination
+// resource.
+type UnresolvedDep struct {
+	Path []string
+	Key  string
+	DepSpec
+	Vals []string
+}
+
+// InferReport is like Infer, but it also returns all destination attribute
+// values for which no dependency could be established, either because there
+// are no resources of the source type or because none of them have a matching
+// value. This usually indicates an incomplete scan. The report is sorted by
+// module, key, and spec.
+func (dm DepMap) InferReport(s *tf.State) []UnresolvedDep {
+	var report []UnresolvedDep
+	var mod []int
+	dm.infer(s, nil, func(i int, u UnresolvedDep) {
+		report = append(report, u)
+		mod = append(mod, i)
+	})
+	sort.Sort(reportSorter{report, mod})
+	return report
+}
+
+// reportSorter sorts InferReport output by module index, key, and spec.
+type reportSorter struct {
+	v   []UnresolvedDep
+	mod []int
+}
+
+func (r reportSorter) Len() int { return len(r.v) }
+func (r reportSorter) Swap(i, j int) {
+	r.v[i], r.v[j] = r.v[j], r.v[i]
+	r.mod[i], r.mod[j] = r.mod[j], r.mod[i]
+}
+func (r reportSorter) Less(i, j int) bool {
+	if r.mod[i] != r.mod[j] {
+		return r.mod[i] < r.mod[j]
+	}
+	a, b := &r.v[i], &r.v[j]
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	return a.less(&b.DepSpec)
+}
+
+// infer implements Infer, InferWith, and InferReport. If report is not nil, it
+// is called with the module index for each spec that has unmatched destination
+// values.
+func (dm DepMap) infer(s *tf.State, norm Normalizer, report func(int, UnresolvedDep)) {
+	for mi, m := range s.Modules {
 		typeMap := make(map[string][]Resource, len(m.Resources))
 		for k, r := range m.Resources {
-			typeMap[r.Type] = append(typeMap[r.Type], Resource{
-				Key:           k,
-				ResourceState: r,
-			})
+			res := Resource{Key: k, ResourceState: r}
+			typeMap[r.Type] = append(typeMap[r.Type], res)
+			if strings.HasPrefix(k, "data.") {
+				typ := "data." + r.Type
+				typeMap[typ] = append(typeMap[typ], res)
+			}
 		}
 		for dstType, rs := range typeMap {
 			spec := dm[dstType]
@@ -53,7 +221,10 @@ func (dm DepMap) Infer(s *tf.State) {
 				r := &rs[i]
 				n := len(r.Dependencies)
 				for j := range spec {
-					spec[j].infer(r, typeMap)
+					miss := spec[j].infer(dstType, r, typeMap, norm)
+					if len(miss) > 0 && report != nil {
+						report(mi, UnresolvedDep{m.Path, r.Key, spec[j], miss})
+					}
 				}
 				if len(r.Dependencies) != n {
 					r.Dependencies = unique(r.Dependencies)
@@ -63,16 +234,115 @@ func (dm DepMap) Infer(s *tf.State) {
 	}
 }
 
-func (ds *DepSpec) infer(dst *Resource, typeMap map[string][]Resource) {
-	srcs := typeMap[ds.SrcType]
-	if len(srcs) == 0 {
-		return
+// Discrepancy describes differences between the dependencies of one resource
+// that were inferred from a DepMap and those that were derived by Terraform
+// from config references. Missing dependencies were not inferred. Extra
+// dependencies were inferred, but are not referenced by the config. Path and Key
+// identify the resource. Dependencies are specified as "type.name".
+type Discrepancy struct {
+	Path    []string
+	Key     string
+	Missing []string
+	Extra   []string
+}
+
+// Verify validates dm against module t. It creates a state from t via a
+// passthrough apply operation, which assigns unique values to all resource IDs
+// and computed string attributes, and compares the dependencies inferred from
+// that state with the ones derived by Terraform from resource references.
+// Dependencies on other modules are ignored. Discrepancies are sorted by module
+// and key.
+func (dm DepMap) Verify(t *module.Tree, ctx *Ctx) ([]Discrepancy, error) {
+	s, err := ctx.passthrough(t, nil, uniqueMode)
+	if err != nil {
+		return nil, err
+	}
+	inferred := s.DeepCopy()
+	for _, m := range inferred.Modules {
+		for _, r := range m.Resources {
+			r.Dependencies = nil
+		}
+	}
+	dm.Infer(inferred)
+	var out []Discrepancy
+	for i, m := range s.Modules {
+		inf := inferred.Modules[i]
+		keys := make([]string, 0, len(m.Resources))
+		for k := range m.Resources {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			want := verifyDeps(m, m.Resources[k].Dependencies)
+			have := verifyDeps(m, inf.Resources[k].Dependencies)
+			d := Discrepancy{Path: m.Path, Key: k}
+			for _, dep := range want {
+				if !containsString(have, dep) {
+					d.Missing = append(d.Missing, dep)
+				}
+			}
+			for _, dep := range have {
+				if !containsString(want, dep) {
+					d.Extra = append(d.Extra, dep)
+				}
+			}
+			if len(d.Missing) > 0 || len(d.Extra) > 0 {
+				out = append(out, d)
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return lessModulePath(out[i].Path, out[j].Path)
+	})
+	return out, nil
+}
+
+// verifyDeps returns a sorted list of unique resource names in deps that refer
+// to resources in module m.
+func verifyDeps(m *tf.ModuleState, deps []string) []string {
+	var out []string
+	for _, dep := range deps {
+		name := depName(dep)
+		if m.Resources[name] == nil && m.Resources[name+".0"] == nil {
+			continue
+		}
+		out = append(out, name)
+	}
+	return unique(out)
+}
+
+// containsString returns true if sorted list v contains s.
+func containsString(v []string, s string) bool {
+	i := sort.SearchStrings(v, s)
+	return i < len(v) && v[i] == s
+}
+
+// less returns true if ds should be sorted before other.
+func (ds *DepSpec) less(other *DepSpec) bool {
+	if ds.Attr != other.Attr {
+		return ds.Attr < other.Attr
+	}
+	if ds.SrcType != other.SrcType {
+		return ds.SrcType < other.SrcType
+	}
+	return ds.SrcAttr < other.SrcAttr
+}
+
+// infer adds dependencies of dst on all sources whose values match those of the
+// destination attribute. Values are normalized by norm, if not nil. It returns
+// destination values that were not matched.
+func (ds *DepSpec) infer(dstType string, dst *Resource, typeMap map[string][]Resource, norm Normalizer) []string {
+	if ds.NoSameType && ds.SrcType == dstType {
+		return nil
 	}
 	vals := getVals(dst, ds.Attr)
 	if len(vals) == 0 {
-		return
+		return nil
 	}
-	// TODO: Disallow dependencies between same types? Detect cycles?
+	nvals := ds.normalize(norm, vals, true)
+	srcs := typeMap[ds.SrcType]
+	matched := make([]bool, len(vals))
+	// TODO: Detect cycles?
 	for i := range srcs {
 		src := &srcs[i]
 		if dst.Key == src.Key {
@@ -81,28 +351,62 @@ func (ds *DepSpec) infer(dst *Resource, typeMap map[string][]Resource) {
 		// There should be just one source value, but the destination may have
 		// multiple list values matching multiple sources of the same type (e.g.
 		// aws_iam_user_group_membership.groups).
-		if sv := getVals(src, ds.SrcAttr); len(sv) == 1 {
-			for _, dv := range vals {
-				if dv == sv[0] {
-					dst.Dependencies = append(dst.Dependencies, src.Key)
-					break
-				}
-			}
-		} else if len(sv) > 1 {
+		sv := getVals(src, ds.SrcAttr)
+		if len(sv) > 1 && !ds.SrcMulti {
 			panic(fmt.Sprintf("tfx: multiple source values for %s.%s",
 				ds.SrcType, ds.SrcAttr))
 		}
+		if matchVals(ds.normalize(norm, sv, false), nvals, matched) {
+			dst.Dependencies = append(dst.Dependencies, src.Key)
+		}
+	}
+	var miss []string
+	for i, ok := range matched {
+		if !ok {
+			miss = append(miss, vals[i])
+		}
+	}
+	return miss
+}
+
+// normalize returns vals normalized by norm. If clone is false, vals may be
+// modified in place.
+func (ds *DepSpec) normalize(norm Normalizer, vals []string, clone bool) []string {
+	if norm == nil {
+		return vals
+	}
+	out := vals
+	if clone {
+		out = make([]string, len(vals))
+	}
+	for i, v := range vals {
+		out[i] = norm(ds.SrcType, ds.SrcAttr, v)
+	}
+	return out
+}
+
+// matchVals returns true if src and dst have at least one value in common.
+// Matching dst values are marked in matched.
+func matchVals(src, dst []string, matched []bool) bool {
+	any := false
+	for _, x := range src {
+		for i, y := range dst {
+			if x == y {
+				matched[i], any = true, true
+			}
+		}
 	}
+	return any
 }
 
-// getVals returns all non-empty values of the specified attribute. The
-// attribute may be nested, such as "attr1.attr2". Multiple values may be
-// returned if attr refers to any lists or sets.
+// getVals returns all non-empty, known values of the specified attribute. The
+// attribute may be nested, such as "attr1.attr2" or "attr1.*.attr2". Multiple
+// values may be returned if attr refers to any lists or sets.
 func getVals(r *Resource, attr string) (vals []string) {
 	if v, ok := r.Primary.Attributes[attr]; !ok {
 		attr, next := splitAttr(attr)
 		getValsHelper(r.Data().Get(attr), r.Type, next, &vals)
-	} else if v != "" {
+	} else if v != "" && v != Computed {
 		vals = []string{v}
 	}
 	return
@@ -115,7 +419,7 @@ func getValsHelper(v interface{}, typ, next string, vals *[]string) {
 			panic(fmt.Sprintf("tfx: unexpected next attribute for %s: %s",
 				typ, next))
 		}
-		if v != "" {
+		if v != "" && v != Computed {
 			*vals = append(*vals, v)
 		}
 	case []interface{}:
@@ -129,7 +433,11 @@ func getValsHelper(v interface{}, typ, next string, vals *[]string) {
 			}
 		} else {
 			attr, next := splitAttr(next)
-			getValsHelper(v[attr], typ, next, vals)
+			if attr == "*" {
+				getValsHelper(v, typ, next, vals) // Index wildcard
+			} else {
+				getValsHelper(v[attr], typ, next, vals)
+			}
 		}
 	case *schema.Set:
 		if v.Len() > 0 {
@@ -150,6 +458,16 @@ func splitAttr(s string) (attr, next string) {
 	return s, ""
 }
 
+// sortDepChanges sorts dependency changes by type and spec.
+func sortDepChanges(v []DepChange) {
+	sort.Slice(v, func(i, j int) bool {
+		if v[i].Type != v[j].Type {
+			return v[i].Type < v[j].Type
+		}
+		return v[i].less(&v[j].DepSpec)
+	})
+}
+
 func unique(s []string) []string {
 	if len(s) < 2 {
 		return s
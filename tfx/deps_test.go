@@ -2,10 +2,14 @@ package tfx
 
 import (
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/terraform/builtin/providers/test"
+	"github.com/hashicorp/terraform/helper/schema"
+	tf "github.com/hashicorp/terraform/terraform"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDeps(t *testing.T) {
@@ -64,6 +68,298 @@ func TestDeps(t *testing.T) {
 	}
 }
 
+func TestDepsSrcMulti(t *testing.T) {
+	Providers.Add("test", "", MakeFactory(test.Provider))
+	defer delete(Providers, "test")
+	spec := DepSpec{Attr: "required", SrcType: "test_resource", SrcAttr: "set"}
+	deps := DepMap{"test_resource_with_custom_diff": {spec}}
+
+	s := NewState()
+	m := s.RootModule()
+	src, _ := Providers.MakeResources("test_resource", AttrGen{
+		"#":  2,
+		"id": func(i int) string { return strconv.Itoa(i) },
+	})
+	dst, _ := Providers.MakeResources("test_resource_with_custom_diff", AttrGen{
+		"#":        3,
+		"id":       func(i int) string { return strconv.Itoa(i) },
+		"required": []string{"b", "c", "x"},
+	})
+	src[0].Data().Set("set", []interface{}{"a", "b"})
+	src[1].Data().Set("set", []interface{}{"c"})
+	for i := range src {
+		src[i].Primary = src[i].data.State()
+		src[i].data = nil
+	}
+	for _, r := range append(src, dst...) {
+		m.Resources[r.Key] = r.ResourceState
+	}
+
+	require.Panics(t, func() { deps.Infer(s) })
+	for _, r := range dst {
+		r.Dependencies = nil
+	}
+
+	deps["test_resource_with_custom_diff"][0].SrcMulti = true
+	deps.Infer(s)
+	assert.Equal(t, []string{"test_resource.0"}, dst[0].Dependencies)
+	assert.Equal(t, []string{"test_resource.1"}, dst[1].Dependencies)
+	assert.Empty(t, dst[2].Dependencies)
+}
+
+func TestDepsNoSameType(t *testing.T) {
+	Providers.Add("test", "", MakeFactory(test.Provider))
+	defer delete(Providers, "test")
+	newState := func() *tf.State {
+		s := NewState()
+		m := s.RootModule()
+		for id, req := range map[string]string{"a": "", "b": "a"} {
+			m.Resources["test_resource."+id] = &tf.ResourceState{
+				Type: "test_resource",
+				Primary: &tf.InstanceState{ID: id, Attributes: map[string]string{
+					"id":       id,
+					"required": req,
+				}},
+			}
+		}
+		return s
+	}
+	spec := DepSpec{Attr: "required", SrcType: "test_resource", SrcAttr: "id"}
+
+	s := newState()
+	DepMap{"test_resource": {spec}}.Infer(s)
+	assert.Equal(t, []string{"test_resource.a"},
+		s.RootModule().Resources["test_resource.b"].Dependencies)
+
+	s = newState()
+	spec.NoSameType = true
+	DepMap{"test_resource": {spec}}.Infer(s)
+	assert.Empty(t, s.RootModule().Resources["test_resource.b"].Dependencies)
+}
+
+func TestDepsDataSource(t *testing.T) {
+	deps := DepMap{"data.test_data_source": {
+		{Attr: "input", SrcType: "test_resource", SrcAttr: "required"},
+	}}
+	Providers.Add("test", "", MakeFactory(test.Provider))
+	defer delete(Providers, "test")
+	s := NewState()
+	m := s.RootModule()
+	m.Resources["test_resource.a"] = &tf.ResourceState{
+		Type: "test_resource",
+		Primary: &tf.InstanceState{ID: "a", Attributes: map[string]string{
+			"id":       "a",
+			"required": "x",
+		}},
+	}
+	m.Resources["data.test_data_source.b"] = &tf.ResourceState{
+		Type: "test_data_source",
+		Primary: &tf.InstanceState{ID: "b", Attributes: map[string]string{
+			"id":    "b",
+			"input": "x",
+		}},
+	}
+	deps.Infer(s)
+	assert.Equal(t, []string{"test_resource.a"},
+		m.Resources["data.test_data_source.b"].Dependencies)
+	assert.Empty(t, m.Resources["test_resource.a"].Dependencies)
+}
+
+func TestInferWith(t *testing.T) {
+	Providers.Add("test", "", MakeFactory(test.Provider))
+	defer delete(Providers, "test")
+	newState := func() *tf.State {
+		s := NewState()
+		m := s.RootModule()
+		m.Resources["test_resource.src"] = &tf.ResourceState{
+			Type: "test_resource",
+			Primary: &tf.InstanceState{ID: "src", Attributes: map[string]string{
+				"id":       "src",
+				"required": "Arn:Bucket/Logs",
+			}},
+		}
+		m.Resources["test_resource_with_custom_diff.dst"] = &tf.ResourceState{
+			Type: "test_resource_with_custom_diff",
+			Primary: &tf.InstanceState{ID: "dst", Attributes: map[string]string{
+				"id":       "dst",
+				"required": "arn:bucket/logs/",
+			}},
+		}
+		return s
+	}
+	dm := DepMap{"test_resource_with_custom_diff": {
+		{Attr: "required", SrcType: "test_resource", SrcAttr: "required"},
+	}}
+	dst := func(s *tf.State) []string {
+		return s.RootModule().Resources["test_resource_with_custom_diff.dst"].Dependencies
+	}
+
+	s := newState()
+	dm.Infer(s)
+	assert.Empty(t, dst(s))
+
+	s = newState()
+	var calls int
+	dm.InferWith(s, func(srcType, srcAttr, v string) string {
+		calls++
+		assert.Equal(t, "test_resource", srcType)
+		assert.Equal(t, "required", srcAttr)
+		return strings.TrimSuffix(strings.ToLower(v), "/")
+	})
+	assert.Equal(t, []string{"test_resource.src"}, dst(s))
+	assert.Equal(t, 2, calls)
+}
+
+func TestInferReport(t *testing.T) {
+	Providers.Add("test", "", MakeFactory(test.Provider))
+	defer delete(Providers, "test")
+	s := NewState()
+	m := s.RootModule()
+	for id, req := range map[string]string{"a": "x", "b": "a", "c": "z"} {
+		m.Resources["test_resource."+id] = &tf.ResourceState{
+			Type: "test_resource",
+			Primary: &tf.InstanceState{ID: id, Attributes: map[string]string{
+				"id":       id,
+				"required": req,
+			}},
+		}
+	}
+	deps := DepMap{"test_resource": {
+		{Attr: "required", SrcType: "test_resource", SrcAttr: "id"},
+		{Attr: "id", SrcType: "test_resource_with_custom_diff", SrcAttr: "required"},
+	}}
+	report := deps.InferReport(s)
+	want := []UnresolvedDep{
+		{m.Path, "test_resource.a", deps["test_resource"][1], []string{"a"}},
+		{m.Path, "test_resource.a", deps["test_resource"][0], []string{"x"}},
+		{m.Path, "test_resource.b", deps["test_resource"][1], []string{"b"}},
+		{m.Path, "test_resource.c", deps["test_resource"][1], []string{"c"}},
+		{m.Path, "test_resource.c", deps["test_resource"][0], []string{"z"}},
+	}
+	assert.Equal(t, want, report)
+	assert.Equal(t, []string{"test_resource.a"},
+		m.Resources["test_resource.b"].Dependencies)
+}
+
+func TestDepMapVerify(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", func() (tf.ResourceProvider, error) {
+		p := test.Provider().(*schema.Provider)
+		p.ResourcesMap["test_src"] = &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"name": {Type: schema.TypeString, Required: true},
+				"arn":  {Type: schema.TypeString, Computed: true},
+			},
+		}
+		p.ResourcesMap["test_dst"] = &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"src_id":   {Type: schema.TypeString, Optional: true},
+				"src_arn":  {Type: schema.TypeString, Optional: true},
+				"src_name": {Type: schema.TypeString, Optional: true},
+			},
+		}
+		return p, nil
+	})
+	cfg := loadCfg(t, `
+		resource "test_src" "a" { name = "a" }
+		resource "test_src" "b" { name = "b" }
+		resource "test_dst" "x" {
+			src_id  = "${test_src.a.id}"
+			src_arn = "${test_src.b.arn}"
+		}
+		resource "test_dst" "y" { src_name = "a" }
+	`)
+	dm := DepMap{"test_dst": {
+		{Attr: "src_id", SrcType: "test_src", SrcAttr: "id"},
+		{Attr: "src_name", SrcType: "test_src", SrcAttr: "name"},
+	}}
+	d, err := dm.Verify(cfg, &ctx)
+	require.NoError(t, err)
+	root := []string{"root"}
+	assert.Equal(t, []Discrepancy{
+		{Path: root, Key: "test_dst.x", Missing: []string{"test_src.b"}},
+		{Path: root, Key: "test_dst.y", Extra: []string{"test_src.a"}},
+	}, d)
+
+	dm["test_dst"] = append(dm["test_dst"][:1],
+		DepSpec{Attr: "src_arn", SrcType: "test_src", SrcAttr: "arn"})
+	d, err = dm.Verify(cfg, &ctx)
+	require.NoError(t, err)
+	assert.Empty(t, d)
+}
+
+func TestGetValsWildcard(t *testing.T) {
+	Providers.Add("test", "", MakeFactory(test.Provider))
+	defer delete(Providers, "test")
+	r, _ := Providers.MakeResources("test_resource", AttrGen{
+		"#":  1,
+		"id": "0",
+	})
+	r[0].Data().Set("list_of_map", []interface{}{
+		map[string]interface{}{"key": "a"},
+		map[string]interface{}{"key": "b"},
+	})
+	r[0].Primary = r[0].data.State()
+	r[0].data = nil
+	want := []string{"a", "b"}
+	assert.Equal(t, want, getVals(r[0], "list_of_map.key"))
+	assert.Equal(t, want, getVals(r[0], "list_of_map.*.key"))
+}
+
+func TestDepMapSort(t *testing.T) {
+	want := DepMap{"a": {
+		{Attr: "a", SrcType: "a", SrcAttr: "a"},
+		{Attr: "a", SrcType: "a", SrcAttr: "b"},
+		{Attr: "a", SrcType: "b", SrcAttr: "a"},
+		{Attr: "b", SrcType: "a", SrcAttr: "a"},
+	}}
+	have := DeepCopy(want).(DepMap)
+	spec := have["a"]
+	spec[0], spec[1], spec[2], spec[3] = spec[3], spec[2], spec[0], spec[1]
+	require.NotEqual(t, want, have)
+	have.Sort()
+	assert.Equal(t, want, have)
+	have.Sort()
+	assert.Equal(t, want, have)
+}
+
+func TestDepMapDiff(t *testing.T) {
+	a := DepMap{
+		"a": {
+			{Attr: "x", SrcType: "b", SrcAttr: "id"},
+			{Attr: "y", SrcType: "c", SrcAttr: "id"},
+			{Attr: "z", SrcType: "c", SrcAttr: "id"},
+		},
+		"b": {{Attr: "x", SrcType: "c", SrcAttr: "id"}},
+	}
+	b := DepMap{
+		"a": {
+			{Attr: "z", SrcType: "c", SrcAttr: "id"},
+			{Attr: "y", SrcType: "c", SrcAttr: "name"},
+			{Attr: "w", SrcType: "b", SrcAttr: "id"},
+		},
+		"c": {{Attr: "x", SrcType: "a", SrcAttr: "id"}},
+	}
+	added, removed, changed := a.Diff(b)
+	assert.Equal(t, []DepChange{
+		{Type: "a", DepSpec: DepSpec{Attr: "w", SrcType: "b", SrcAttr: "id"}},
+		{Type: "c", DepSpec: DepSpec{Attr: "x", SrcType: "a", SrcAttr: "id"}},
+	}, added)
+	assert.Equal(t, []DepChange{
+		{Type: "a", DepSpec: DepSpec{Attr: "x", SrcType: "b", SrcAttr: "id"}},
+		{Type: "b", DepSpec: DepSpec{Attr: "x", SrcType: "c", SrcAttr: "id"}},
+	}, removed)
+	assert.Equal(t, []DepChange{{
+		Type:    "a",
+		DepSpec: DepSpec{Attr: "y", SrcType: "c", SrcAttr: "name"},
+		Old:     &DepSpec{Attr: "y", SrcType: "c", SrcAttr: "id"},
+	}}, changed)
+	added, removed, changed = a.Diff(a)
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+	assert.Empty(t, changed)
+}
+
 func TestUnique(t *testing.T) {
 	tests := []*struct {
 		have []string
@@ -79,3 +375,11 @@ func TestUnique(t *testing.T) {
 		assert.Equal(t, tc.want, unique(tc.have), "%+v", tc)
 	}
 }
+
+func TestDepMapAddMerge(t *testing.T) {
+	a := DepSpec{Attr: "a", SrcType: "t_src", SrcAttr: "id"}
+	b := DepSpec{Attr: "b", SrcType: "t_src", SrcAttr: "id"}
+	dm := DepMap{"t_dst": {a}}
+	dm.Add(DepMap{"t_dst": {b, a}, "t_other": {a}})
+	assert.Equal(t, DepMap{"t_dst": {a, b}, "t_other": {a}}, dm)
+}
@@ -3,13 +3,18 @@ package tfx
 import (
 	"bufio"
 	"bytes"
+	"encoding"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"reflect"
 	"sort"
 	"strings"
+	"time"
 
 	tf "github.com/hashicorp/terraform/terraform"
 )
@@ -24,8 +29,11 @@ func ReadPlanFile(file string) (*tf.Plan, error) {
 	return tf.ReadPlan(r)
 }
 
-// WritePlanFile writes plan p to file in binary format.
+// WritePlanFile writes plan p to file in binary format ("-" means stdout).
 func WritePlanFile(file string, p *tf.Plan) error {
+	if file == "" {
+		return errNoPath
+	}
 	if isStdio(file) {
 		return tf.WritePlan(p, os.Stdout)
 	}
@@ -37,7 +45,7 @@ func WritePlanFile(file string, p *tf.Plan) error {
 }
 
 // ReadDiffFile reads Terraform diff from the specified file. It supports both
-// JSON-encoded diffs and plan files.
+// JSON-encoded diffs and plan files. The file may be an http or https URL.
 func ReadDiffFile(file string) (*tf.Diff, error) {
 	r, err := open(file)
 	if err != nil {
@@ -66,8 +74,11 @@ func ReadDiff(r io.Reader) (*tf.Diff, error) {
 	return d, nil
 }
 
-// WriteDiffFile writes diff d to file in JSON format.
+// WriteDiffFile writes diff d to file in JSON format ("-" means stdout).
 func WriteDiffFile(file string, d *tf.Diff) error {
+	if file == "" {
+		return errNoPath
+	}
 	if isStdio(file) {
 		return WriteDiff(os.Stdout, d)
 	}
@@ -78,67 +89,382 @@ func WriteDiffFile(file string, d *tf.Diff) error {
 	return ioutil.WriteFile(file, b.Bytes(), 0666)
 }
 
-// WriteDiff writes diff d to w in JSON format.
+// WriteDiff writes diff d to w in minified JSON format. Empty strings, false
+// values, and any objects that become empty as a result are removed.
 func WriteDiff(w io.Writer, d *tf.Diff) error {
-	var b bytes.Buffer
-	enc := json.NewEncoder(&b)
-	enc.SetEscapeHTML(false)
-	if err := enc.Encode(d); err != nil {
-		return err
+	return (&WriteDiffOpts{}).Write(w, d)
+}
+
+// WriteDiffOpts controls the JSON encoding of diffs. If KeepEmpty is true,
+// minification is disabled and all values are written as-is. This retains
+// attribute diffs where both the old and new values are empty, which would
+// otherwise be lost in a WriteDiff/ReadDiff round trip. If NDJSON is true, the
+// diff is written as newline-delimited JSON with one compact object per changed
+// resource. Each object has an "Address" key, formatted the same way as in
+// ExplainDiff, and a "Diff" key containing the resource diff. Resources that
+// would be replaced also have a "Replace" key listing the attributes that force
+// a new resource (see RequiresReplacement). Resources are written in module
+// order and sorted by key within each module.
+type WriteDiffOpts struct {
+	KeepEmpty bool
+	NDJSON    bool
+}
+
+// Write writes diff d to w in JSON format.
+func (o *WriteDiffOpts) Write(w io.Writer, d *tf.Diff) error {
+	if o.NDJSON {
+		return o.writeNDJSON(w, d)
 	}
+	if !o.KeepEmpty {
+		return writeMinJSON(w, d, true)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	return enc.Encode(d)
+}
 
-	// TODO: Try to avoid this encode/decode/encode logic
-	var v interface{}
-	if err := json.Unmarshal(b.Bytes(), &v); err != nil {
-		return err
+// writeNDJSON writes each non-empty resource diff in d to w as a separate line.
+func (o *WriteDiffOpts) writeNDJSON(w io.Writer, d *tf.Diff) error {
+	type line struct {
+		Address string
+		Diff    interface{}
+		Replace []string `json:",omitempty"`
 	}
-	var minify func(interface{}) interface{}
-	minify = func(v interface{}) interface{} {
-		switch v := v.(type) {
-		case bool:
-			if !v {
-				return nil
-			}
-		case float64:
-			if v == 0 {
-				return nil
-			}
-		case string:
-			if v == "" {
-				return nil
-			}
-		case []interface{}:
-			keep := v[:0]
-			for _, e := range v {
-				if e = minify(e); e != nil {
-					keep = append(keep, e)
-				}
-			}
-			if v = keep; len(keep) == 0 {
-				return nil
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	var keys []string
+	for _, m := range d.Modules {
+		keys = keys[:0]
+		for k, r := range m.Resources {
+			if !r.Empty() {
+				keys = append(keys, k)
 			}
-		case map[string]interface{}:
-			for k, e := range v {
-				if e = minify(e); e != nil {
-					v[k] = e
-				} else {
-					// TODO: This may cause problems for Meta and NewExtra
-					delete(v, k)
-				}
+		}
+		sort.Strings(keys)
+		prefix := modulePrefix(m.Path)
+		for _, k := range keys {
+			r := m.Resources[k]
+			v, err := o.value(r)
+			if err != nil {
+				return err
 			}
-			if len(v) == 0 {
-				return nil
+			_, replace := RequiresReplacement(r)
+			if err = enc.Encode(line{prefix + k, v, replace}); err != nil {
+				return err
 			}
-		case nil:
-		default:
-			panic(fmt.Sprintf("tfx: unsupported type %T", v))
 		}
-		return v
 	}
-	enc = json.NewEncoder(w)
-	enc.SetEscapeHTML(false)
-	enc.SetIndent("", "\t")
-	return enc.Encode(minify(v))
+	return nil
+}
+
+// value returns the value of v that should be encoded. Unless o.KeepEmpty is
+// set, v is minified and returned as raw JSON.
+func (o *WriteDiffOpts) value(v interface{}) (interface{}, error) {
+	if o.KeepEmpty {
+		return v, nil
+	}
+	var b bytes.Buffer
+	if err := writeMinJSON(&b, v, false); err != nil {
+		return nil, err
+	}
+	return json.RawMessage(bytes.TrimSuffix(b.Bytes(), []byte("\n"))), nil
+}
+
+// minJSON is a single-pass JSON encoder that produces the same output as
+// encoding v with encoding/json, decoding it into a generic value, removing
+// empty strings, false and zero values, nulls, and any arrays or objects that
+// become empty as a result, and encoding the generic value again. Object keys,
+// including struct field names, are sorted. Output that depends on an empty
+// value is buffered in pend until the first non-empty value is written, so
+// nothing is written for values that turn out to be empty. Values that cannot
+// be encoded directly, such as those implementing json.Marshaler, are
+// minified by the round trip described above.
+type minJSON struct {
+	w      *bufio.Writer
+	indent bool
+	depth  int
+	pend   []byte
+	tmp    bytes.Buffer
+	enc    *json.Encoder
+	err    error
+}
+
+// writeMinJSON writes minified v to w, followed by a newline. If indent is
+// true, the output is indented with tabs.
+func writeMinJSON(w io.Writer, v interface{}, indent bool) error {
+	e := newMinJSON(w, indent)
+	e.top(reflect.ValueOf(v))
+	e.w.WriteByte('\n')
+	return e.flush()
+}
+
+// newMinJSON returns a new encoder that writes to w.
+func newMinJSON(w io.Writer, indent bool) *minJSON {
+	e := &minJSON{w: bufio.NewWriter(w), indent: indent}
+	e.enc = json.NewEncoder(&e.tmp)
+	e.enc.SetEscapeHTML(false)
+	return e
+}
+
+// top writes minified v, or null if v is empty.
+func (e *minJSON) top(v reflect.Value) {
+	if !e.value(v) {
+		e.w.WriteString("null")
+	}
+}
+
+// flush writes any buffered data and returns the first error, if any.
+func (e *minJSON) flush() error {
+	if err := e.w.Flush(); e.err == nil {
+		e.err = err
+	}
+	return e.err
+}
+
+var (
+	jsonMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// value writes v and returns true if v is not empty.
+func (e *minJSON) value(v reflect.Value) bool {
+	if !v.IsValid() {
+		return false
+	}
+	if t := v.Type(); t.Implements(jsonMarshaler) ||
+		t.Implements(textMarshaler) ||
+		reflect.PtrTo(t).Implements(jsonMarshaler) ||
+		reflect.PtrTo(t).Implements(textMarshaler) {
+		return e.roundTrip(v)
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.raw("true")
+			return true
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return e.number(float64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return e.number(float64(v.Uint()))
+	case reflect.Float64:
+		return e.number(v.Float())
+	case reflect.String:
+		return e.string(v.String())
+	case reflect.Ptr:
+		return !v.IsNil() && e.value(v.Elem())
+	case reflect.Interface:
+		return !v.IsNil() && e.roundTrip(v)
+	case reflect.Struct:
+		return e.structValue(v)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return e.roundTrip(v)
+		}
+		keys := v.MapKeys()
+		names := make([]string, len(keys))
+		for i, k := range keys {
+			names[i] = k.String()
+		}
+		sort.Sort(keySorter{names, keys})
+		return e.object(names, func(i int) bool {
+			return e.value(v.MapIndex(keys[i]))
+		})
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return e.roundTrip(v)
+		}
+		fallthrough
+	case reflect.Array:
+		return e.array(v.Len(), func(i int) bool { return e.value(v.Index(i)) })
+	default:
+		return e.roundTrip(v)
+	}
+	return false
+}
+
+// structValue writes struct v as an object with sorted field names.
+func (e *minJSON) structValue(v reflect.Value) bool {
+	t := v.Type()
+	var fields []int
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous || f.Tag.Get("json") != "" {
+			return e.roundTrip(v)
+		}
+		if f.PkgPath == "" {
+			fields = append(fields, i)
+			names = append(names, f.Name)
+		}
+	}
+	sort.Sort(fieldSorter{names, fields})
+	return e.object(names, func(i int) bool {
+		return e.value(v.Field(fields[i]))
+	})
+}
+
+// generic writes a value produced by decoding JSON into an interface{}.
+func (e *minJSON) generic(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			e.raw("true")
+			return true
+		}
+	case float64:
+		return e.number(v)
+	case string:
+		return e.string(v)
+	case []interface{}:
+		return e.array(len(v), func(i int) bool { return e.generic(v[i]) })
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return e.object(keys, func(i int) bool { return e.generic(v[keys[i]]) })
+	}
+	return false
+}
+
+// roundTrip writes v by encoding it with encoding/json and writing the decoded
+// generic value.
+func (e *minJSON) roundTrip(v reflect.Value) bool {
+	b, err := json.Marshal(v.Interface())
+	if err == nil {
+		var g interface{}
+		if err = json.Unmarshal(b, &g); err == nil {
+			return e.generic(g)
+		}
+	}
+	if e.err == nil {
+		e.err = err
+	}
+	return false
+}
+
+// object writes an object with the specified keys. Function val writes the
+// value of key i and returns false if it was empty, in which case the key is
+// omitted.
+func (e *minJSON) object(keys []string, val func(i int) bool) bool {
+	return e.container('{', '}', len(keys), func(i int) bool {
+		e.pend = append(e.pend, e.encode(keys[i])...)
+		if e.pend = append(e.pend, ':'); e.indent {
+			e.pend = append(e.pend, ' ')
+		}
+		return val(i)
+	})
+}
+
+// array writes an array of n elements, omitting any that are empty.
+func (e *minJSON) array(n int, val func(i int) bool) bool {
+	return e.container('[', ']', n, val)
+}
+
+// container writes an array or object with n potential elements.
+func (e *minJSON) container(open, close byte, n int, val func(i int) bool) bool {
+	start := len(e.pend)
+	e.pend = append(e.pend, open)
+	e.depth++
+	empty := true
+	for i := 0; i < n; i++ {
+		mark := len(e.pend)
+		if !empty {
+			e.pend = append(e.pend, ',')
+		}
+		e.newline()
+		if val(i) {
+			empty = false
+		} else {
+			e.pend = e.pend[:mark]
+		}
+	}
+	e.depth--
+	if empty {
+		e.pend = e.pend[:start]
+		return false
+	}
+	e.newline()
+	e.pend = append(e.pend, close)
+	e.writePend()
+	return true
+}
+
+// newline appends a newline and indentation to pend if indentation is enabled.
+func (e *minJSON) newline() {
+	if e.indent {
+		e.pend = append(e.pend, '\n')
+		for i := 0; i < e.depth; i++ {
+			e.pend = append(e.pend, '\t')
+		}
+	}
+}
+
+// number writes a non-zero number.
+func (e *minJSON) number(f float64) bool {
+	if f == 0 {
+		return false
+	}
+	e.raw(string(e.encode(f)))
+	return true
+}
+
+// string writes a non-empty string.
+func (e *minJSON) string(s string) bool {
+	if s == "" {
+		return false
+	}
+	e.raw(string(e.encode(s)))
+	return true
+}
+
+// raw writes all pending output followed by s.
+func (e *minJSON) raw(s string) {
+	e.writePend()
+	e.w.WriteString(s)
+}
+
+// writePend writes all pending output.
+func (e *minJSON) writePend() {
+	e.w.Write(e.pend)
+	e.pend = e.pend[:0]
+}
+
+// encode returns the JSON encoding of a string or a number.
+func (e *minJSON) encode(v interface{}) []byte {
+	e.tmp.Reset()
+	e.enc.Encode(v)
+	return bytes.TrimSuffix(e.tmp.Bytes(), []byte("\n"))
+}
+
+// keySorter sorts map keys by name.
+type keySorter struct {
+	names []string
+	keys  []reflect.Value
+}
+
+func (s keySorter) Len() int           { return len(s.names) }
+func (s keySorter) Less(i, j int) bool { return s.names[i] < s.names[j] }
+func (s keySorter) Swap(i, j int) {
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// fieldSorter sorts struct fields by name.
+type fieldSorter struct {
+	names  []string
+	fields []int
+}
+
+func (s fieldSorter) Len() int           { return len(s.names) }
+func (s fieldSorter) Less(i, j int) bool { return s.names[i] < s.names[j] }
+func (s fieldSorter) Swap(i, j int) {
+	s.names[i], s.names[j] = s.names[j], s.names[i]
+	s.fields[i], s.fields[j] = s.fields[j], s.fields[i]
 }
 
 // diffType defines sort order and labels for diff explanation.
@@ -151,9 +477,176 @@ var diffType = map[tf.DiffChangeType]struct {
 	tf.DiffUpdate:  {3, "ATTRIBUTE MISMATCH"},
 }
 
+// DiffCounts contains the number of resources for each type of change in a
+// diff. Replace counts resources that must be destroyed and re-created.
+type DiffCounts struct {
+	Create, Update, Destroy, Replace int
+}
+
+// DiffStats returns the number of resource changes in d by change type.
+func DiffStats(d *tf.Diff) (c DiffCounts) {
+	for _, m := range d.Modules {
+		for _, r := range m.Resources {
+			switch r.ChangeType() {
+			case tf.DiffCreate:
+				c.Create++
+			case tf.DiffUpdate:
+				c.Update++
+			case tf.DiffDestroy:
+				c.Destroy++
+			case tf.DiffDestroyCreate:
+				c.Replace++
+			}
+		}
+	}
+	return
+}
+
+// String returns the summary in the same format as 'terraform plan', where each
+// replaced resource is counted as both added and destroyed.
+func (c DiffCounts) String() string {
+	return fmt.Sprintf("%d to add, %d to change, %d to destroy",
+		c.Create+c.Replace, c.Update, c.Destroy+c.Replace)
+}
+
+// ResourceAction is a flattened representation of one resource diff. Addr is
+// the module-qualified resource address, formatted the same way as in
+// ExplainDiff (e.g. "module.a.type.name"). Attrs contains copies of attribute
+// diffs indexed by flatmap key.
+type ResourceAction struct {
+	Addr   string
+	Change tf.DiffChangeType
+	Attrs  map[string]*tf.ResourceAttrDiff
+}
+
+// DiffActions returns all non-empty resource diffs in d as a list of actions.
+// Actions are returned in module order and sorted by key within each module.
+func DiffActions(d *tf.Diff) []ResourceAction {
+	return diffActions(d, false)
+}
+
+// diffActions implements DiffActions. If empty is true, empty resource diffs
+// are included with tf.DiffNone change type.
+func diffActions(d *tf.Diff, empty bool) []ResourceAction {
+	var all []ResourceAction
+	var keys []string
+	for _, m := range d.Modules {
+		keys = keys[:0]
+		for k, r := range m.Resources {
+			if empty || !r.Empty() {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		prefix := modulePrefix(m.Path)
+		for _, k := range keys {
+			r := m.Resources[k]
+			a := ResourceAction{Addr: prefix + k, Change: r.ChangeType()}
+			if len(r.Attributes) > 0 {
+				a.Attrs = make(map[string]*tf.ResourceAttrDiff, len(r.Attributes))
+				for ak, av := range r.Attributes {
+					cp := *av
+					a.Attrs[ak] = &cp
+				}
+			}
+			all = append(all, a)
+		}
+	}
+	return all
+}
+
+// ActionsToDiff is the inverse of DiffActions. Resources are destroyed for
+// DiffDestroy and DiffDestroyCreate actions. Attribute diffs of DiffCreate and
+// DiffDestroyCreate actions must include at least one RequiresNew attribute
+// (usually "id"). An error is returned if any resulting resource diff has a
+// different change type than its action.
+func ActionsToDiff(actions []ResourceAction) (*tf.Diff, error) {
+	d := new(tf.Diff)
+	for _, a := range actions {
+		path, key, err := splitAddr(a.Addr)
+		if err != nil {
+			return nil, err
+		}
+		m := d.ModuleByPath(path)
+		if m == nil {
+			m = d.AddModule(path)
+		}
+		if m.Resources[key] != nil {
+			return nil, fmt.Errorf("tfx: duplicate resource address %q", a.Addr)
+		}
+		r := &tf.InstanceDiff{
+			Destroy: a.Change == tf.DiffDestroy ||
+				a.Change == tf.DiffDestroyCreate,
+		}
+		if len(a.Attrs) > 0 {
+			r.Attributes = make(map[string]*tf.ResourceAttrDiff, len(a.Attrs))
+			for k, v := range a.Attrs {
+				cp := *v
+				r.Attributes[k] = &cp
+			}
+		}
+		if typ := r.ChangeType(); typ != a.Change {
+			return nil, fmt.Errorf("tfx: %s action for %q results in %s diff",
+				changeName[a.Change], a.Addr, changeName[typ])
+		}
+		m.Resources[key] = r
+	}
+	return d, nil
+}
+
+// splitAddr converts a module-qualified resource address, formatted as in
+// ExplainDiff, into a module path and state key.
+func splitAddr(addr string) (path []string, key string, err error) {
+	path, key = tf.RootModulePath, addr
+	for strings.HasPrefix(key, "module.") {
+		i := strings.IndexByte(key[7:], '.')
+		if i < 0 {
+			return nil, "", fmt.Errorf("tfx: invalid resource address %q", addr)
+		}
+		path = append(path[:len(path):len(path)], key[7:7+i])
+		key = key[8+i:]
+	}
+	if _, err = tf.ParseResourceStateKey(key); err != nil {
+		return nil, "", err
+	}
+	return path, key, nil
+}
+
 // ExplainDiff returns a description of inconsistencies between actual state and
-// desired config.
+// desired config. Resources in child modules are identified by module-qualified
+// addresses (e.g. "module.network.aws_subnet.a"). Root module resources are
+// identified by their state keys. Attribute mismatches that would force the
+// resource to be re-created are marked with "(forces new resource)".
 func ExplainDiff(d *tf.Diff) string {
+	return ExplainDiffWith(d, nil)
+}
+
+// ExplainOpts controls diff explanation. MaskAttrs specifies attribute keys
+// whose values are masked as if they were marked sensitive by the provider. A
+// key ending with '*' matches all keys with that prefix (e.g. "tags.*").
+type ExplainOpts struct {
+	MaskAttrs []string
+}
+
+// masked returns true if the value of attribute key should be masked.
+func (o *ExplainOpts) masked(key string) bool {
+	if o == nil {
+		return false
+	}
+	for _, m := range o.MaskAttrs {
+		if strings.HasSuffix(m, "*") {
+			if strings.HasPrefix(key, m[:len(m)-1]) {
+				return true
+			}
+		} else if key == m {
+			return true
+		}
+	}
+	return false
+}
+
+// ExplainDiffWith is like ExplainDiff, but with additional options.
+func ExplainDiffWith(d *tf.Diff, opts *ExplainOpts) string {
 	type resDiff struct {
 		*tf.InstanceDiff
 		name string
@@ -164,7 +657,9 @@ func ExplainDiff(d *tf.Diff) string {
 		if len(diffs) == 0 && len(m.Resources) > 0 {
 			diffs = make([]resDiff, 0, len(m.Resources))
 		}
+		prefix := modulePrefix(m.Path)
 		for name, d := range m.Resources {
+			name = prefix + name
 			switch typ := d.ChangeType(); typ {
 			case tf.DiffDestroyCreate:
 				typ = tf.DiffUpdate
@@ -217,22 +712,185 @@ func ExplainDiff(d *tf.Diff) string {
 			if attr.NewComputed {
 				want = "<computed>"
 			}
-			if attr.Sensitive {
+			if attr.Sensitive || opts.masked(key) {
 				have = "<sensitive>"
 				want = "<sensitive>, value mismatch"
 			}
-			fmt.Fprintf(&b, "  %-*s = %q (expected: %q)\n",
-				keyLen, key, have, want)
+			fmt.Fprintf(&b, "  %-*s = %q (expected: %q)", keyLen, key, have, want)
+			if attr.RequiresNew {
+				b.WriteString(" (forces new resource)")
+			}
+			b.WriteByte('\n')
 		}
 	}
 	return strings.TrimSuffix(b.String(), "\n")
 }
 
-// diffScore compares a resource state with a new resource diff and returns a
+// PlanChange describes a resource that is planned differently by two plans. A
+// and B are the planned change types in each plan (tf.DiffNone if the resource
+// has no planned changes). Attrs maps attribute keys to the values planned by
+// each plan.
+type PlanChange struct {
+	Addr  string
+	A, B  tf.DiffChangeType
+	Attrs map[string][2]string
+}
+
+// DiffPlans compares the resource diffs of two plans and returns all resources
+// that are planned differently, sorted by address. Resources are identified the
+// same way as in ExplainDiff. Only planned attribute values are compared;
+// differences in prior state are ignored.
+func DiffPlans(a, b *tf.Plan) []PlanChange {
+	ma, mb := planResources(a), planResources(b)
+	var changes []PlanChange
+	for addr, da := range ma {
+		if c := planChange(addr, da, mb[addr]); c != nil {
+			changes = append(changes, *c)
+		}
+	}
+	for addr, db := range mb {
+		if ma[addr] == nil {
+			changes = append(changes, *planChange(addr, nil, db))
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Addr < changes[j].Addr
+	})
+	return changes
+}
+
+// ExplainPlanChanges returns a description of changes returned by DiffPlans.
+func ExplainPlanChanges(changes []PlanChange) string {
+	var b strings.Builder
+	var keys []string
+	for i := range changes {
+		c := &changes[i]
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		fmt.Fprintf(&b, "- %s (%s -> %s)\n", c.Addr,
+			changeName[c.A], changeName[c.B])
+		var keyLen int
+		keys = keys[:0]
+		for key := range c.Attrs {
+			if keys = append(keys, key); keyLen < len(key) {
+				keyLen = len(key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			v := c.Attrs[key]
+			fmt.Fprintf(&b, "  %-*s = %q (was: %q)\n", keyLen, key, v[1], v[0])
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// changeName defines change type names for plan change explanation.
+var changeName = map[tf.DiffChangeType]string{
+	tf.DiffNone:          "none",
+	tf.DiffCreate:        "create",
+	tf.DiffUpdate:        "update",
+	tf.DiffDestroy:       "destroy",
+	tf.DiffDestroyCreate: "replace",
+}
+
+// planResources returns all non-empty resource diffs in plan p indexed by
+// module-qualified address.
+func planResources(p *tf.Plan) map[string]*tf.InstanceDiff {
+	if p == nil || p.Diff == nil {
+		return nil
+	}
+	m := make(map[string]*tf.InstanceDiff)
+	for _, md := range p.Diff.Modules {
+		prefix := modulePrefix(md.Path)
+		for name, d := range md.Resources {
+			if d.ChangeType() != tf.DiffNone {
+				m[prefix+name] = d
+			}
+		}
+	}
+	return m
+}
+
+// planChange compares two resource diffs and returns nil if they are planned
+// identically. Either diff may be nil.
+func planChange(addr string, a, b *tf.InstanceDiff) *PlanChange {
+	c := &PlanChange{Addr: addr, A: tf.DiffNone, B: tf.DiffNone}
+	var attrs [2]map[string]*tf.ResourceAttrDiff
+	for i, d := range [2]*tf.InstanceDiff{a, b} {
+		if d != nil {
+			attrs[i] = d.Attributes
+		}
+	}
+	if a != nil {
+		c.A = a.ChangeType()
+	}
+	if b != nil {
+		c.B = b.ChangeType()
+	}
+	for i := range attrs {
+		for k := range attrs[i] {
+			if _, ok := c.Attrs[k]; ok {
+				continue
+			}
+			x, y := attrs[0][k], attrs[1][k]
+			va, vb := plannedValue(x), plannedValue(y)
+			if va == vb && x != nil && y != nil && x.New != y.New {
+				vb += ", value mismatch" // Sensitive
+			}
+			if va != vb {
+				if c.Attrs == nil {
+					c.Attrs = make(map[string][2]string)
+				}
+				c.Attrs[k] = [2]string{va, vb}
+			}
+		}
+	}
+	if c.A == c.B && len(c.Attrs) == 0 {
+		return nil
+	}
+	return c
+}
+
+// plannedValue returns a description of the planned value of an attribute.
+func plannedValue(d *tf.ResourceAttrDiff) string {
+	var v string
+	switch {
+	case d == nil:
+		return ""
+	case d.Sensitive:
+		v = "<sensitive>"
+	case d.NewComputed:
+		v = "<computed>"
+	case d.NewRemoved:
+		v = "<removed>"
+	default:
+		v = d.New
+	}
+	if d.RequiresNew {
+		v += " (forces new resource)"
+	}
+	return v
+}
+
+// modulePrefix returns the address prefix for resources in the specified
+// module. It returns an empty string for the root module.
+func modulePrefix(path []string) string {
+	if len(path) <= 1 {
+		return ""
+	}
+	return "module." + strings.Join(path[1:], ".module.") + "."
+}
+
+// DiffScore compares a resource state with a new resource diff and returns a
 // match quality score. A non-negative score is the total number of attribute
 // matches. A negative score is the number of immutable attribute mismatches,
 // indicating that the resource would need to be re-created in order to match.
-func diffScore(s *tf.InstanceState, d *tf.InstanceDiff) int {
+// Ctx.Conform uses this score to match existing resources with the create diffs
+// of a config planned against an empty state. Attribute values are compared
+// case-insensitively and computed attributes always match.
+func DiffScore(s *tf.InstanceState, d *tf.InstanceDiff) int {
 	var neg, pos int
 	for at, ad := range d.Attributes {
 		// at may be missing from s.Attributes if it's an optional attribute.
@@ -249,6 +907,23 @@ func diffScore(s *tf.InstanceState, d *tf.InstanceDiff) int {
 	return pos
 }
 
+// RequiresReplacement returns whether resource diff d would force the resource
+// to be destroyed and re-created, and the sorted keys of all attributes that
+// require a new resource.
+func RequiresReplacement(d *tf.InstanceDiff) (bool, []string) {
+	if d == nil {
+		return false, nil
+	}
+	var keys []string
+	for k, ad := range d.Attributes {
+		if ad.RequiresNew {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return len(keys) > 0, keys
+}
+
 // normDiff normalizes a diff by removing empty modules and sorting those that
 // remain by path.
 func normDiff(d *tf.Diff) {
@@ -264,6 +939,62 @@ func normDiff(d *tf.Diff) {
 	d.Modules = keep
 }
 
+// ignoreAttrs removes changes to ignored attributes from update and replace
+// diffs in d (see PlanOpts). Replace diffs become updates if none of the
+// remaining attributes require a new resource. Computed-only attributes that
+// were added for the new instance, such as the ID, are removed from such
+// updates. Schemas are obtained from pm. For resources of unknown types, all
+// computed attributes without an old value are considered computed-only.
+func ignoreAttrs(d *tf.Diff, ignore map[string][]string, pm ProviderMap) {
+	ignored := func(typ, k string) bool {
+		for _, list := range [][]string{ignore[typ], ignore["*"]} {
+			for _, a := range list {
+				if k == a || (strings.HasPrefix(k, a) && k[len(a)] == '.') {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	for _, m := range d.Modules {
+		for key, r := range m.Resources {
+			ct := r.ChangeType()
+			if ct != tf.DiffUpdate && ct != tf.DiffDestroyCreate {
+				continue
+			}
+			k, err := tf.ParseResourceStateKey(key)
+			if err != nil {
+				continue
+			}
+			for a := range r.Attributes {
+				if ignored(k.Type, a) {
+					delete(r.Attributes, a)
+				}
+			}
+			if ct == tf.DiffDestroyCreate && !r.RequiresNew() {
+				// Remove no-op and computed-only attributes added for the new
+				// instance
+				_, rs := pm.ResourceSchema(k.Type)
+				for a, ad := range r.Attributes {
+					if ad.NewComputed {
+						if a == "id" || (rs == nil && ad.Old == "") ||
+							(rs != nil && isComputedOnly(rs.Schema, a)) {
+							delete(r.Attributes, a)
+						}
+					} else if !ad.NewRemoved && ad.Old == ad.New {
+						delete(r.Attributes, a)
+					}
+				}
+				r.Destroy = false
+			}
+			if r.Empty() {
+				delete(m.Resources, key)
+			}
+		}
+	}
+	normDiff(d)
+}
+
 // lessModulePath returns true if module path a should be sorted before path b.
 func lessModulePath(a, b []string) bool {
 	if ar, br := isRootModule(a), isRootModule(b); ar || br {
@@ -284,17 +1015,82 @@ func isRootModule(path []string) bool {
 	return len(path) == 1 && path[0] == "root"
 }
 
-const stdinLimit = 64 * 1024 * 1024
+// StdinLimit is the maximum number of bytes that may be read from stdin or from
+// an http(s) URL. Reads that exceed the limit fail with an error rather than
+// returning truncated input. Zero or a negative value removes the limit.
+var StdinLimit int64 = 64 * 1024 * 1024
 
-// open opens the specified file for reading ("" or "-" mean stdin).
+// httpClient is used to read files specified by http and https URLs.
+var httpClient = &http.Client{Timeout: 5 * time.Minute}
+
+// open opens the specified file for reading ("-" means stdin). Files specified
+// by http and https URLs are fetched with a GET request.
 func open(file string) (io.ReadCloser, error) {
+	if file == "" {
+		return nil, errNoPath
+	}
 	if isStdio(file) {
-		return ioutil.NopCloser(io.LimitReader(os.Stdin, stdinLimit)), nil
+		return ioutil.NopCloser(limitReader(os.Stdin)), nil
+	}
+	if isURL(file) {
+		return openURL(file)
 	}
 	return os.Open(file)
 }
 
+// openURL returns the response body for an http GET request.
+func openURL(url string) (io.ReadCloser, error) {
+	rsp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		rsp.Body.Close()
+		return nil, fmt.Errorf("tfx: GET %s: %s", url, rsp.Status)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{limitReader(rsp.Body), rsp.Body}, nil
+}
+
+// limitReader returns a reader that fails once more than StdinLimit bytes are
+// read from r.
+func limitReader(r io.Reader) io.Reader {
+	if StdinLimit <= 0 {
+		return r
+	}
+	return &limitedReader{io.LimitReader(r, StdinLimit+1), StdinLimit, StdinLimit}
+}
+
+// limitedReader returns an error when the number of remaining bytes, n, is
+// exceeded.
+type limitedReader struct {
+	r        io.Reader
+	n, limit int64
+}
+
+// Read implements io.Reader.
+func (l *limitedReader) Read(p []byte) (n int, err error) {
+	if n, err = l.r.Read(p); int64(n) > l.n {
+		n, err = int(l.n), fmt.Errorf("tfx: input exceeds %d byte limit",
+			l.limit)
+	}
+	l.n -= int64(n)
+	return
+}
+
+// isURL returns true if file is an http or https URL.
+func isURL(file string) bool {
+	return strings.HasPrefix(file, "http://") ||
+		strings.HasPrefix(file, "https://")
+}
+
+// errNoPath is returned when a file path is empty. Empty paths are usually
+// unset variables, so they are not treated as stdin or stdout.
+var errNoPath = errors.New("tfx: no path specified")
+
 // isStdio returns true if file represents stdin or stdout.
 func isStdio(file string) bool {
-	return file == "" || file == "-"
+	return file == "-"
 }
@@ -1,11 +1,17 @@
 package tfx
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
 
+	tf "github.com/hashicorp/terraform/terraform"
 	"github.com/mxk/go-cli"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -15,8 +21,11 @@ import (
 // TODO: Switch to test provider
 
 func TestDiff(t *testing.T) {
-	tests := []*struct{ state, diff string }{
-		{"good.tfstate", ""},
+	tests := []*struct {
+		state, diff string
+		stats       DiffCounts
+	}{
+		{"good.tfstate", "", DiffCounts{}},
 		{"bad.tfstate", `
 			MISSING RESOURCE:
 			- azurerm_resource_group.rg2
@@ -26,13 +35,13 @@ func TestDiff(t *testing.T) {
 
 			ATTRIBUTE MISMATCH:
 			- azurerm_resource_group.rg1
-			  location = "eastus2" (expected: "eastus")
+			  location = "eastus2" (expected: "eastus") (forces new resource)
 
 			- azurerm_virtual_network.vnet
 			  address_space.0     = "10.0.0.0/16" (expected: "10.0.0.0/8")
-			  location            = "eastus2" (expected: "eastus")
-			  resource_group_name = "rg3" (expected: "rg1")
-		`},
+			  location            = "eastus2" (expected: "eastus") (forces new resource)
+			  resource_group_name = "rg3" (expected: "rg1") (forces new resource)
+		`, DiffCounts{Create: 1, Destroy: 1, Replace: 2}},
 	}
 	var ctx Ctx
 	ctx.Providers.Add("azurerm", "", MakeFactory(azurerm.Provider))
@@ -45,7 +54,52 @@ func TestDiff(t *testing.T) {
 		d, err := ctx.Diff(m, s)
 		require.NoError(t, err)
 		assert.Equal(t, strings.TrimSpace(cli.Dedent(tc.diff)), ExplainDiff(d))
+		assert.Equal(t, tc.stats, DiffStats(d))
 	}
+	assert.Equal(t, "3 to add, 1 to change, 4 to destroy",
+		DiffCounts{Create: 1, Update: 1, Destroy: 2, Replace: 2}.String())
+}
+
+func TestExplainDiffModules(t *testing.T) {
+	d := &tf.Diff{Modules: []*tf.ModuleDiff{{
+		Path: tf.RootModulePath,
+		Resources: map[string]*tf.InstanceDiff{
+			"a.a": {Destroy: true},
+		},
+	}, {
+		Path: []string{"root", "net", "inner"},
+		Resources: map[string]*tf.InstanceDiff{
+			"a.a": {Destroy: true},
+		},
+	}}}
+	want := `
+		EXTRA RESOURCE:
+		- a.a
+		- module.net.module.inner.a.a
+	`
+	assert.Equal(t, strings.TrimSpace(cli.Dedent(want)), ExplainDiff(d))
+}
+
+func TestWriteDiffKeepEmpty(t *testing.T) {
+	d := &tf.Diff{Modules: []*tf.ModuleDiff{{
+		Path: tf.RootModulePath,
+		Resources: map[string]*tf.InstanceDiff{
+			"test_resource.r": {Attributes: map[string]*tf.ResourceAttrDiff{
+				"optional": {Old: "", New: ""},
+			}},
+		},
+	}}}
+	var b bytes.Buffer
+	require.NoError(t, WriteDiff(&b, d))
+	have, err := ReadDiff(&b)
+	require.NoError(t, err)
+	assert.NotEqual(t, d, have)
+
+	b.Reset()
+	require.NoError(t, (&WriteDiffOpts{KeepEmpty: true}).Write(&b, d))
+	have, err = ReadDiff(&b)
+	require.NoError(t, err)
+	assert.Equal(t, d, have)
 }
 
 func testDataDir(elem ...string) string {
@@ -56,3 +110,401 @@ func testDataDir(elem ...string) string {
 	}
 	panic("testdata directory not found")
 }
+
+func TestOpenURL(t *testing.T) {
+	var b bytes.Buffer
+	s := NewState()
+	s.RootModule().Resources["test_resource.a"] = &tf.ResourceState{
+		Type:    "test_resource",
+		Primary: &tf.InstanceState{ID: "a"},
+	}
+	require.NoError(t, tf.WriteState(s, &b))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/state" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b.Bytes())
+	}))
+	defer srv.Close()
+
+	out, err := ReadStateFile(srv.URL + "/state")
+	require.NoError(t, err)
+	assert.True(t, s.Equal(out))
+	_, err = ReadStateFile(srv.URL + "/missing")
+	assert.Error(t, err)
+}
+
+func TestStdinLimit(t *testing.T) {
+	defer func(limit int64) { StdinLimit = limit }(StdinLimit)
+	StdinLimit = 4
+	b, err := ioutil.ReadAll(limitReader(strings.NewReader("1234")))
+	require.NoError(t, err)
+	assert.Equal(t, "1234", string(b))
+	b, err = ioutil.ReadAll(limitReader(strings.NewReader("12345")))
+	assert.EqualError(t, err, "tfx: input exceeds 4 byte limit")
+	assert.Equal(t, "1234", string(b))
+
+	StdinLimit = 0
+	b, err = ioutil.ReadAll(limitReader(strings.NewReader("12345")))
+	require.NoError(t, err)
+	assert.Equal(t, "12345", string(b))
+}
+
+func TestNoPath(t *testing.T) {
+	assert.True(t, isStdio("-"))
+	assert.False(t, isStdio(""))
+	_, err := open("")
+	assert.Equal(t, errNoPath, err)
+	_, err = ReadStateFile("")
+	assert.Equal(t, errNoPath, err)
+	_, err = ReadDiffFile("")
+	assert.Equal(t, errNoPath, err)
+	_, err = LoadModule("")
+	assert.Equal(t, errNoPath, err)
+	assert.Equal(t, errNoPath, WriteStateFile("", NewState()))
+	assert.Equal(t, errNoPath, WriteDiffFile("", new(tf.Diff)))
+	assert.Equal(t, errNoPath, WritePlanFile("", new(tf.Plan)))
+}
+
+func TestDiffPlans(t *testing.T) {
+	a := &tf.Plan{Diff: &tf.Diff{Modules: []*tf.ModuleDiff{{
+		Path: tf.RootModulePath,
+		Resources: map[string]*tf.InstanceDiff{
+			"a.same": {Attributes: map[string]*tf.ResourceAttrDiff{
+				"x": {Old: "1", New: "2"},
+			}},
+			"a.attr": {Attributes: map[string]*tf.ResourceAttrDiff{
+				"x": {Old: "1", New: "2"},
+				"y": {Old: "1", New: "2"},
+				"s": {Old: "1", New: "2", Sensitive: true},
+			}},
+			"a.only": {Destroy: true},
+		},
+	}}}}
+	b := &tf.Plan{Diff: &tf.Diff{Modules: []*tf.ModuleDiff{{
+		Path: tf.RootModulePath,
+		Resources: map[string]*tf.InstanceDiff{
+			"a.same": {Attributes: map[string]*tf.ResourceAttrDiff{
+				"x": {Old: "0", New: "2"},
+			}},
+			"a.attr": {Attributes: map[string]*tf.ResourceAttrDiff{
+				"x": {Old: "1", New: "3", RequiresNew: true},
+				"y": {Old: "1", NewComputed: true},
+				"s": {Old: "1", New: "3", Sensitive: true},
+			}},
+		},
+	}, {
+		Path: []string{"root", "m"},
+		Resources: map[string]*tf.InstanceDiff{
+			"a.only": {Attributes: map[string]*tf.ResourceAttrDiff{
+				"x": {New: "1", RequiresNew: true},
+			}},
+		},
+	}}}}
+	have := DiffPlans(a, b)
+	assert.Equal(t, []PlanChange{{
+		Addr: "a.attr",
+		A:    tf.DiffUpdate,
+		B:    tf.DiffCreate,
+		Attrs: map[string][2]string{
+			"s": {"<sensitive>", "<sensitive>, value mismatch"},
+			"x": {"2", "3 (forces new resource)"},
+			"y": {"2", "<computed>"},
+		},
+	}, {
+		Addr: "a.only",
+		A:    tf.DiffDestroy,
+		B:    tf.DiffNone,
+	}, {
+		Addr:  "module.m.a.only",
+		A:     tf.DiffNone,
+		B:     tf.DiffCreate,
+		Attrs: map[string][2]string{"x": {"", "1 (forces new resource)"}},
+	}}, have)
+	assert.Empty(t, DiffPlans(a, a))
+
+	want := `
+		- a.attr (update -> create)
+		  s = "<sensitive>, value mismatch" (was: "<sensitive>")
+		  x = "3 (forces new resource)" (was: "2")
+		  y = "<computed>" (was: "2")
+
+		- a.only (destroy -> none)
+
+		- module.m.a.only (none -> create)
+		  x = "1 (forces new resource)" (was: "")
+	`
+	assert.Equal(t, strings.TrimSpace(cli.Dedent(want)), ExplainPlanChanges(have))
+}
+
+func TestDiffScore(t *testing.T) {
+	s := &tf.InstanceState{Attributes: map[string]string{
+		"a": "x",
+		"b": "Y",
+		"c": "z",
+	}}
+	d := &tf.InstanceDiff{Attributes: map[string]*tf.ResourceAttrDiff{
+		"a": {New: "x"},
+		"b": {New: "y"},
+		"c": {New: "other"},
+		"d": {NewComputed: true},
+	}}
+	assert.Equal(t, 3, DiffScore(s, d))
+	d.Attributes["c"].RequiresNew = true
+	d.Attributes["e"] = &tf.ResourceAttrDiff{New: "e", RequiresNew: true}
+	assert.Equal(t, -2, DiffScore(s, d))
+}
+
+func TestWriteDiffNDJSON(t *testing.T) {
+	d := &tf.Diff{Modules: []*tf.ModuleDiff{{
+		Path: tf.RootModulePath,
+		Resources: map[string]*tf.InstanceDiff{
+			"a.b": {Attributes: map[string]*tf.ResourceAttrDiff{
+				"x": {Old: "", New: "<b>"},
+			}},
+			"a.a": {Destroy: true},
+			"a.c": {Destroy: true, Attributes: map[string]*tf.ResourceAttrDiff{
+				"y": {Old: "1", New: "2", RequiresNew: true},
+			}},
+			"a.empty": {},
+		},
+	}, {
+		Path: []string{"root", "m"},
+		Resources: map[string]*tf.InstanceDiff{
+			"a.a": {Destroy: true},
+		},
+	}}}
+	var b bytes.Buffer
+	require.NoError(t, (&WriteDiffOpts{NDJSON: true}).Write(&b, d))
+	want := `{"Address":"a.a","Diff":{"Destroy":true}}` + "\n" +
+		`{"Address":"a.b","Diff":{"Attributes":{"x":{"New":"<b>"}}}}` + "\n" +
+		`{"Address":"a.c","Diff":{"Attributes":{"y":{"New":"2","Old":"1","RequiresNew":true}},"Destroy":true},"Replace":["y"]}` + "\n" +
+		`{"Address":"module.m.a.a","Diff":{"Destroy":true}}` + "\n"
+	assert.Equal(t, want, b.String())
+
+	b.Reset()
+	require.NoError(t, (&WriteDiffOpts{NDJSON: true, KeepEmpty: true}).Write(&b, d))
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	require.Len(t, lines, 4)
+	assert.Contains(t, lines[1], `"Old":""`)
+}
+
+func TestExplainDiffMask(t *testing.T) {
+	d := &tf.Diff{Modules: []*tf.ModuleDiff{{
+		Path: tf.RootModulePath,
+		Resources: map[string]*tf.InstanceDiff{
+			"a.a": {Attributes: map[string]*tf.ResourceAttrDiff{
+				"key":      {Old: "1", New: "2"},
+				"name":     {Old: "a", New: "b"},
+				"tags.key": {Old: "x", New: "y"},
+				"tags.%":   {Old: "1", New: "1"},
+				"password": {Old: "p", New: "q", Sensitive: true},
+			}},
+		},
+	}}}
+	want := `
+		ATTRIBUTE MISMATCH:
+		- a.a
+		  key      = "<sensitive>" (expected: "<sensitive>, value mismatch")
+		  name     = "a" (expected: "b")
+		  password = "<sensitive>" (expected: "<sensitive>, value mismatch")
+		  tags.key = "<sensitive>" (expected: "<sensitive>, value mismatch")
+	`
+	opts := &ExplainOpts{MaskAttrs: []string{"key", "tags.*"}}
+	assert.Equal(t, strings.TrimSpace(cli.Dedent(want)), ExplainDiffWith(d, opts))
+	assert.Contains(t, ExplainDiff(d), `key      = "1" (expected: "2")`)
+}
+
+func TestDiffActions(t *testing.T) {
+	attr := func(old, new string, forceNew bool) *tf.ResourceAttrDiff {
+		return &tf.ResourceAttrDiff{Old: old, New: new, RequiresNew: forceNew}
+	}
+	d := &tf.Diff{Modules: []*tf.ModuleDiff{{
+		Path: tf.RootModulePath,
+		Resources: map[string]*tf.InstanceDiff{
+			"a.b": {Destroy: true},
+			"a.a": {Attributes: map[string]*tf.ResourceAttrDiff{
+				"id": {NewComputed: true, RequiresNew: true},
+				"x":  attr("", "1", false),
+			}},
+			"a.e": {},
+		},
+	}, {
+		Path: []string{"root", "m", "n"},
+		Resources: map[string]*tf.InstanceDiff{
+			"a.c.0": {Attributes: map[string]*tf.ResourceAttrDiff{
+				"x": attr("1", "2", false),
+			}},
+			"a.d": {Destroy: true, Attributes: map[string]*tf.ResourceAttrDiff{
+				"x": attr("1", "2", true),
+			}},
+		},
+	}}}
+	actions := DiffActions(d)
+	want := []ResourceAction{{
+		Addr:   "a.a",
+		Change: tf.DiffCreate,
+		Attrs: map[string]*tf.ResourceAttrDiff{
+			"id": {NewComputed: true, RequiresNew: true},
+			"x":  attr("", "1", false),
+		},
+	}, {
+		Addr:   "a.b",
+		Change: tf.DiffDestroy,
+	}, {
+		Addr:   "module.m.module.n.a.c.0",
+		Change: tf.DiffUpdate,
+		Attrs:  map[string]*tf.ResourceAttrDiff{"x": attr("1", "2", false)},
+	}, {
+		Addr:   "module.m.module.n.a.d",
+		Change: tf.DiffDestroyCreate,
+		Attrs:  map[string]*tf.ResourceAttrDiff{"x": attr("1", "2", true)},
+	}}
+	assert.Equal(t, want, actions)
+	actions[0].Attrs["x"].New = "changed"
+	assert.Equal(t, "1", d.Modules[0].Resources["a.a"].Attributes["x"].New)
+
+	all := diffActions(d, true)
+	require.Len(t, all, len(want)+1)
+	assert.Equal(t, ResourceAction{Addr: "a.e", Change: tf.DiffNone}, all[2])
+
+	out, err := ActionsToDiff(want)
+	require.NoError(t, err)
+	delete(d.Modules[0].Resources, "a.e")
+	assert.True(t, d.Equal(out))
+
+	_, err = ActionsToDiff([]ResourceAction{{
+		Addr:   "a.a",
+		Change: tf.DiffCreate,
+		Attrs:  map[string]*tf.ResourceAttrDiff{"x": attr("", "1", false)},
+	}})
+	assert.EqualError(t, err, `tfx: create action for "a.a" results in update diff`)
+	_, err = ActionsToDiff([]ResourceAction{{Addr: "module.a", Change: tf.DiffDestroy}})
+	assert.Error(t, err)
+}
+
+func TestRequiresReplacement(t *testing.T) {
+	ok, keys := RequiresReplacement(nil)
+	assert.False(t, ok)
+	assert.Nil(t, keys)
+
+	d := &tf.InstanceDiff{Attributes: map[string]*tf.ResourceAttrDiff{
+		"a": {Old: "1", New: "2"},
+	}}
+	ok, keys = RequiresReplacement(d)
+	assert.False(t, ok)
+	assert.Nil(t, keys)
+
+	d.Destroy = true
+	d.Attributes["c"] = &tf.ResourceAttrDiff{Old: "1", New: "2", RequiresNew: true}
+	d.Attributes["b"] = &tf.ResourceAttrDiff{Old: "x", New: "y", RequiresNew: true}
+	ok, keys = RequiresReplacement(d)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"b", "c"}, keys)
+
+	diff := &tf.Diff{Modules: []*tf.ModuleDiff{{
+		Path:      tf.RootModulePath,
+		Resources: map[string]*tf.InstanceDiff{"t.r": d},
+	}}}
+	want := `
+		ATTRIBUTE MISMATCH:
+		- t.r
+		  a = "1" (expected: "2")
+		  b = "x" (expected: "y") (forces new resource)
+		  c = "1" (expected: "2") (forces new resource)
+	`
+	assert.Equal(t, strings.TrimSpace(cli.Dedent(want)), ExplainDiff(diff))
+}
+
+func TestWriteDiffMinify(t *testing.T) {
+	// legacy is the original encode/decode/minify/encode implementation, with
+	// minify fixed to return the filtered slice instead of the original one.
+	legacy := func(v interface{}, indent bool) string {
+		var minify func(v interface{}) interface{}
+		minify = func(v interface{}) interface{} {
+			switch v := v.(type) {
+			case bool:
+				if !v {
+					return nil
+				}
+			case float64:
+				if v == 0 {
+					return nil
+				}
+			case string:
+				if v == "" {
+					return nil
+				}
+			case []interface{}:
+				keep := v[:0]
+				for _, e := range v {
+					if e = minify(e); e != nil {
+						keep = append(keep, e)
+					}
+				}
+				if len(keep) == 0 {
+					return nil
+				}
+				return keep
+			case map[string]interface{}:
+				for k, e := range v {
+					if e = minify(e); e != nil {
+						v[k] = e
+					} else {
+						delete(v, k)
+					}
+				}
+				if len(v) == 0 {
+					return nil
+				}
+			}
+			return v
+		}
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		require.NoError(t, enc.Encode(v))
+		var g interface{}
+		require.NoError(t, json.Unmarshal(b.Bytes(), &g))
+		b.Reset()
+		if indent {
+			enc.SetIndent("", "\t")
+		}
+		require.NoError(t, enc.Encode(minify(g)))
+		return b.String()
+	}
+	diffs := []*tf.Diff{nil, {}, {Modules: []*tf.ModuleDiff{nil, {
+		Path:      tf.RootModulePath,
+		Resources: map[string]*tf.InstanceDiff{"a.empty": {}, "a.nil": nil},
+	}}}, {Modules: []*tf.ModuleDiff{{
+		Path: tf.RootModulePath,
+		Resources: map[string]*tf.InstanceDiff{
+			"a.b": {Attributes: map[string]*tf.ResourceAttrDiff{
+				"x":     {Old: "", New: "<b>& "},
+				"y":     {Old: "1", NewComputed: true, RequiresNew: true},
+				"empty": {},
+				"extra": {NewExtra: []interface{}{"", 0, 1.5e22, map[string]interface{}{
+					"a": []interface{}{false, nil},
+					"b": []byte("xy"),
+				}}},
+				"type": {Old: "é", NewRemoved: true, Type: tf.DiffAttrInput},
+			}, Meta: map[string]interface{}{"schema_version": "1", "z": 0}},
+			"a.a": {Destroy: true, DestroyTainted: true},
+		},
+	}, {
+		Path: []string{"root", "m"},
+		Resources: map[string]*tf.InstanceDiff{
+			"a.a": {Destroy: true},
+		},
+		Destroy: true,
+	}}}}
+	for i, d := range diffs {
+		var b bytes.Buffer
+		require.NoError(t, WriteDiff(&b, d))
+		assert.Equal(t, legacy(d, true), b.String(), "%d", i)
+		b.Reset()
+		require.NoError(t, writeMinJSON(&b, d, false))
+		assert.Equal(t, legacy(d, false), b.String(), "%d", i)
+	}
+}
@@ -6,26 +6,38 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/hashicorp/logutils"
 	"github.com/hashicorp/terraform/helper/logging"
 )
 
 // DisableLogging disables all Terraform logging, while allowing other messages
-// through.
-func DisableLogging() {
-	SetLogFilter(os.Stderr, "", false)
+// through. It returns a function that restores the previous configuration.
+func DisableLogging() func() {
+	restore, _ := SetLogFilter(os.Stderr, "", false)
+	return restore
 }
 
 // validLevels is updated to contain an empty level to filter out messages
 // without a level prefix.
 var validLevels = logging.ValidLevels
 
+// logMu guards validLevels, logOutput, and changes to the default logger.
+var logMu sync.Mutex
+
+// logOutput is the current output of the default logger, as far as this
+// package knows.
+var logOutput io.Writer = os.Stderr
+
 // SetLogFilter configures Terraform log filter. Since all Terraform components
 // use the default logger (ugh... why?!?), this may affect other code as well.
 // If requireLevel is true, any log message that does not have a level prefix is
-// filtered out.
-func SetLogFilter(w io.Writer, level string, requireLevel bool) error {
+// filtered out. The returned function restores the previous logger output and
+// TF_LOG environment variable.
+func SetLogFilter(w io.Writer, level string, requireLevel bool) (func(), error) {
+	logMu.Lock()
+	defer logMu.Unlock()
 	if w == nil {
 		w = os.Stderr
 	}
@@ -51,11 +63,24 @@ func SetLogFilter(w io.Writer, level string, requireLevel bool) error {
 			}
 		}
 		if filter.MinLevel == invalid {
-			return fmt.Errorf("tfx: invalid log level %q (must be one of: %v)",
+			return nil, fmt.Errorf("tfx: invalid log level %q (must be one of: %v)",
 				level, logging.ValidLevels)
 		}
 	}
+	prevOut := logOutput
+	prevLevel, prevSet := os.LookupEnv(logging.EnvLog)
 	log.SetOutput(filter)
+	logOutput = filter
 	os.Setenv(logging.EnvLog, level) // For logging.LogLevel()
-	return nil
+	return func() {
+		logMu.Lock()
+		defer logMu.Unlock()
+		log.SetOutput(prevOut)
+		logOutput = prevOut
+		if prevSet {
+			os.Setenv(logging.EnvLog, prevLevel)
+		} else {
+			os.Unsetenv(logging.EnvLog)
+		}
+	}, nil
 }
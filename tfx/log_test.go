@@ -19,45 +19,72 @@ func TestMain(m *testing.M) {
 }
 
 func TestLog(t *testing.T) {
-	defer func() {
-		DisableLogging()
-		log.SetFlags(log.LstdFlags)
-	}()
+	defer DisableLogging()()
+	defer log.SetFlags(log.LstdFlags)
 	var b strings.Builder
 	log.SetFlags(0)
 
-	assert.Error(t, SetLogFilter(&b, "INVALID", false))
+	_, err := SetLogFilter(&b, "INVALID", false)
+	assert.Error(t, err)
 
-	require.NoError(t, SetLogFilter(&b, "", false))
+	_, err = SetLogFilter(&b, "", false)
+	require.NoError(t, err)
 	assert.False(t, logging.IsDebugOrHigher())
 	tf.NewState()
 	log.Print("passthrough")
 	require.Equal(t, "passthrough\n", b.String())
 	b.Reset()
 
-	require.NoError(t, SetLogFilter(&b, "", true))
+	_, err = SetLogFilter(&b, "", true)
+	require.NoError(t, err)
 	tf.NewState()
 	log.Print("passthrough")
 	require.Empty(t, b.String())
 	b.Reset()
 
-	require.NoError(t, SetLogFilter(&b, "DEBUG", false))
+	_, err = SetLogFilter(&b, "DEBUG", false)
+	require.NoError(t, err)
 	assert.True(t, logging.IsDebugOrHigher())
 	s := tf.NewState()
 	want := fmt.Sprintf("[DEBUG] New state was assigned lineage %q\n", s.Lineage)
 	require.Equal(t, want, b.String())
 	b.Reset()
 
-	require.NoError(t, SetLogFilter(&b, "info", false))
+	_, err = SetLogFilter(&b, "info", false)
+	require.NoError(t, err)
 	assert.False(t, logging.IsDebugOrHigher())
 	tf.NewState()
 	log.Print("passthrough")
 	require.Equal(t, "passthrough\n", b.String())
 	b.Reset()
 
-	require.NoError(t, SetLogFilter(&b, "INFO", true))
+	_, err = SetLogFilter(&b, "INFO", true)
+	require.NoError(t, err)
 	tf.NewState()
 	log.Print("passthrough")
 	require.Empty(t, b.String())
 	b.Reset()
 }
+
+func TestLogRestore(t *testing.T) {
+	defer log.SetFlags(log.LstdFlags)
+	var a, b strings.Builder
+	log.SetFlags(0)
+
+	defer DisableLogging()()
+	restoreA, err := SetLogFilter(&a, "DEBUG", false)
+	require.NoError(t, err)
+	defer restoreA()
+	restoreB, err := SetLogFilter(&b, "", false)
+	require.NoError(t, err)
+	assert.False(t, logging.IsDebugOrHigher())
+	log.Print("[DEBUG] b")
+	assert.Empty(t, b.String())
+
+	restoreB()
+	assert.Equal(t, "DEBUG", os.Getenv(logging.EnvLog))
+	assert.True(t, logging.IsDebugOrHigher())
+	log.Print("[DEBUG] a")
+	assert.Equal(t, "[DEBUG] a\n", a.String())
+	assert.Empty(t, b.String())
+}
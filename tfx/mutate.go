@@ -1,6 +1,7 @@
 package tfx
 
 import (
+	"fmt"
 	"math/rand"
 	"sort"
 	"strings"
@@ -13,11 +14,20 @@ import (
 // MutateFunc is a function that can modify resources.
 type MutateFunc func(*MutateState)
 
-// MutateCfg determines the behavior of the Mutate operation.
+// MutateCfg determines the behavior of the Mutate operation. If Strict is true,
+// Mutate returns ErrUnknownType for any resource of an unknown type instead of
+// skipping it. Types and Keys restrict mutation to resources of the specified
+// types and/or with the specified state keys. A resource must match all
+// non-empty filters. Filter entries that do not match any resources, including
+// unknown types, are ignored. Filtering is done before the random shuffle, so
+// Limit applies to the filtered resources.
 type MutateCfg struct {
-	Seed  int64
-	Limit int
-	Funcs []MutateFunc
+	Seed   int64
+	Limit  int
+	Funcs  []MutateFunc
+	Strict bool
+	Types  []string
+	Keys   []string
 }
 
 // MutateState contains the state of the current resource as well as the rest
@@ -30,27 +40,176 @@ type MutateState struct {
 	Type   string
 	Key    string
 	Schema map[string]*schema.Schema
+
+	providers ProviderMap
+	computed  map[string]string
 }
 
+// Mutate calls cfg.Funcs for root module resources of s in random order and
+// returns a diff containing the first non-empty change for each resource, up to
+// cfg.Limit changes. Resources of unknown types are skipped unless cfg.Strict is
+// set.
 func (c *Ctx) Mutate(s *tf.State, cfg *MutateCfg) (*tf.Diff, error) {
+	var ms *MutateState
+	err := c.mutate(s, cfg, func(m *MutateState, p *schema.Provider, cur *tf.InstanceState) (bool, error) {
+		ms = m
+		return mutateDiff(m, p, cur)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ms.diff(), nil
+}
+
+// ApplyMutations is a deterministic version of Mutate. It calls each func in
+// changes for the root module resource with the same state key, in key order,
+// and returns a diff in the same format as Mutate. There is no shuffling or
+// limit, and MutateState.Rand is always seeded with 0. An error is returned if
+// any key does not exist or refers to a resource of an unknown type.
+func (c *Ctx) ApplyMutations(s *tf.State, changes map[string]MutateFunc) (*tf.Diff, error) {
+	root := s.RootModule()
+	keys := make([]string, 0, len(changes))
+	for k := range changes {
+		if root.Resources[k] == nil {
+			return nil, fmt.Errorf("tfx: resource %q not found", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var ms *MutateState
+	funcs := func(k string) []MutateFunc { return []MutateFunc{changes[k]} }
+	err := c.mutateKeys(root, keys, rand.New(rand.NewSource(0)),
+		&MutateCfg{Strict: true}, funcs,
+		func(m *MutateState, p *schema.Provider, cur *tf.InstanceState) (bool, error) {
+			ms = m
+			return mutateDiff(m, p, cur)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return ms.diff(), nil
+}
+
+// mutateDiff is a mutateCheck that adds the resource diff to ms.Diff.
+func mutateDiff(ms *MutateState, p *schema.Provider, cur *tf.InstanceState) (bool, error) {
+	if ms.Id() == "" {
+		ms.Diff.Resources[ms.Key] = &tf.InstanceDiff{Destroy: true}
+		return true, nil
+	}
+	info := tf.InstanceInfo{Id: ms.Key, ModulePath: ms.Module.Path, Type: ms.Type}
+	r := p.ResourcesMap[ms.Type]
+	diff, err := p.Diff(&info, cur,
+		tf.NewResourceConfig(configFromResourceState(r, ms.State())))
+	if err != nil {
+		return false, err
+	}
+	if diff = ms.computedDiff(diff, cur); diff.Empty() {
+		return false, nil
+	}
+	ms.Diff.Resources[ms.Key] = diff
+	return true, nil
+}
+
+// diff returns the diff accumulated by mutateDiff. It returns an empty diff if
+// ms is nil.
+func (ms *MutateState) diff() *tf.Diff {
+	d := new(tf.Diff)
+	if ms != nil && !ms.Diff.Empty() {
+		d.Modules = append(d.Modules, ms.Diff)
+	}
+	return d
+}
+
+// MutatePreview is a dry-run version of Mutate that does not call the provider
+// Diff method, so it can be used without a configured provider. It returns the
+// flatmap attribute keys that were changed by the first func that changed any,
+// indexed by resource state key. A removed resource is reported as a change to
+// "id". Resource selection is identical to Mutate. Changes are determined by
+// comparing against the unmutated state as normalized by the resource schema,
+// so attributes that are not part of the schema are not reported.
+func (c *Ctx) MutatePreview(s *tf.State, cfg *MutateCfg) (map[string][]string, error) {
+	changed := make(map[string][]string)
+	err := c.mutate(s, cfg, func(m *MutateState, p *schema.Provider, cur *tf.InstanceState) (bool, error) {
+		if m.Id() == "" {
+			changed[m.Key] = []string{"id"}
+			return true, nil
+		}
+		var keys []string
+		want := p.ResourcesMap[m.Type].Data(cur).State().Attributes
+		for k, v := range m.computed {
+			if _, ok := want[k]; !ok {
+				if v, ok := cur.Attributes[k]; ok {
+					want[k] = v
+				}
+			}
+		}
+		attrs := m.State().Attributes
+		have := make(map[string]string, len(attrs)+len(m.computed))
+		for k, v := range attrs {
+			have[k] = v
+		}
+		for k, v := range m.computed {
+			have[k] = v
+		}
+		for k, v := range have {
+			if w, ok := want[k]; !ok || v != w {
+				keys = append(keys, k)
+			}
+		}
+		for k := range want {
+			if _, ok := have[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			return false, nil
+		}
+		sort.Strings(keys)
+		changed[m.Key] = keys
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// mutateCheck is called after each MutateFunc to determine whether the current
+// resource was changed. Original resource state is passed in cur.
+type mutateCheck func(ms *MutateState, p *schema.Provider, cur *tf.InstanceState) (bool, error)
+
+// mutate implements resource selection for Mutate and MutatePreview. It calls
+// cfg.Funcs for each resource until check reports a change.
+func (c *Ctx) mutate(s *tf.State, cfg *MutateCfg, check mutateCheck) error {
 	root := s.RootModule()
+	rnd := rand.New(rand.NewSource(cfg.Seed))
+	types, keyFilter := strSet(cfg.Types), strSet(cfg.Keys)
+	keys := make([]string, 0, len(root.Resources))
+	for k, r := range root.Resources {
+		if (types == nil || types[r.Type]) && (keyFilter == nil || keyFilter[k]) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	rnd.Shuffle(len(keys), func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+	funcs := func(string) []MutateFunc { return cfg.Funcs }
+	return c.mutateKeys(root, keys, rnd, cfg, funcs, check)
+}
+
+// mutateKeys calls the funcs for each resource in root, in the order specified
+// by keys, until check reports a change. Only cfg.Limit and cfg.Strict are used.
+func (c *Ctx) mutateKeys(root *tf.ModuleState, keys []string, rnd *rand.Rand, cfg *MutateCfg, funcs func(key string) []MutateFunc, check mutateCheck) error {
 	ms := MutateState{
-		Rand: rand.New(rand.NewSource(cfg.Seed)),
+		Rand: rnd,
 		Diff: &tf.ModuleDiff{
 			Path:      root.Path,
 			Resources: make(map[string]*tf.InstanceDiff),
 		},
-		Module: root,
+		Module:    root,
+		providers: c.Providers,
 	}
-	keys := make([]string, 0, len(ms.Module.Resources))
-	for k := range root.Resources {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-	ms.Rand.Shuffle(len(keys), func(i, j int) {
-		keys[i], keys[j] = keys[j], keys[i]
-	})
-	info := tf.InstanceInfo{ModulePath: root.Path}
 	var changes int
 	for _, k := range keys {
 		if cfg.Limit > 0 && changes >= cfg.Limit {
@@ -59,37 +218,29 @@ func (c *Ctx) Mutate(s *tf.State, cfg *MutateCfg) (*tf.Diff, error) {
 		curState := root.Resources[k]
 		p, r := c.Providers.ResourceSchema(curState.Type)
 		if r == nil {
+			if cfg.Strict {
+				return ErrUnknownType(curState.Type)
+			}
 			continue
 		}
 		ms.ResourceData = r.Data(curState.Primary)
 		ms.Type = curState.Type
 		ms.Key = k
 		ms.Schema = r.Schema
-		info.Id = k
-		info.Type = ms.Type
-		for _, fn := range cfg.Funcs {
-			if fn(&ms); ms.Id() == "" {
-				ms.Diff.Resources[k] = &tf.InstanceDiff{Destroy: true}
-				changes++
-				break
-			}
-			diff, err := p.Diff(&info, curState.Primary,
-				tf.NewResourceConfig(configFromResourceState(r, ms.State())))
+		ms.computed = nil
+		for _, fn := range funcs(k) {
+			fn(&ms)
+			ok, err := check(&ms, p, curState.Primary)
 			if err != nil {
-				return nil, err
+				return err
 			}
-			if !diff.Empty() {
-				ms.Diff.Resources[k] = diff
+			if ok {
 				changes++
 				break
 			}
 		}
 	}
-	d := new(tf.Diff)
-	if !ms.Diff.Empty() {
-		d.Modules = append(d.Modules, ms.Diff)
-	}
-	return d, nil
+	return nil
 }
 
 // RandID returns a random alphanumeric (base62) string of length n with the
@@ -105,6 +256,84 @@ func (ms *MutateState) RandID(n int) string {
 	return b.String()
 }
 
+// SetComputed sets the value of a flatmap attribute key without going through
+// the resource config. This allows computed-only attributes, which are not part
+// of the config, to be changed to simulate provider-side drift. Mutate adds
+// these changes to the resource diff as-is.
+func (ms *MutateState) SetComputed(key, value string) {
+	if ms.computed == nil {
+		ms.computed = make(map[string]string)
+	}
+	ms.computed[key] = value
+}
+
+// computedDiff adds attribute changes made by SetComputed to diff d. Original
+// resource state is passed in cur.
+func (ms *MutateState) computedDiff(d *tf.InstanceDiff, cur *tf.InstanceState) *tf.InstanceDiff {
+	for k, v := range ms.computed {
+		old, ok := cur.Attributes[k]
+		if ok && old == v {
+			continue
+		}
+		if d == nil {
+			d = new(tf.InstanceDiff)
+		}
+		if d.Attributes == nil {
+			d.Attributes = make(map[string]*tf.ResourceAttrDiff)
+		}
+		if d.Attributes[k] == nil {
+			d.Attributes[k] = &tf.ResourceAttrDiff{Old: old, New: v}
+		}
+	}
+	return d
+}
+
+// Sibling returns resource data for another resource in the same module. It
+// returns nil if the key does not exist or the resource type is unknown. The
+// data is created from a copy of the resource state.
+func (ms *MutateState) Sibling(key string) *schema.ResourceData {
+	if r := ms.Module.Resources[key]; r != nil && r.Primary != nil {
+		if _, s := ms.providers.ResourceSchema(r.Type); s != nil {
+			return s.Data(r.Primary.DeepCopy())
+		}
+	}
+	return nil
+}
+
+// SiblingsOfType returns resource data for all other resources of the
+// specified type in the same module, sorted by state key. The current resource
+// is excluded. See Sibling for more info.
+func (ms *MutateState) SiblingsOfType(typ string) []*schema.ResourceData {
+	_, s := ms.providers.ResourceSchema(typ)
+	if s == nil {
+		return nil
+	}
+	var keys []string
+	for k, r := range ms.Module.Resources {
+		if r.Type == typ && r.Primary != nil && k != ms.Key {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var data []*schema.ResourceData
+	for _, k := range keys {
+		data = append(data, s.Data(ms.Module.Resources[k].Primary.DeepCopy()))
+	}
+	return data
+}
+
+// strSet converts a slice of strings into a set. It returns nil if v is empty.
+func strSet(v []string) map[string]bool {
+	if len(v) == 0 {
+		return nil
+	}
+	m := make(map[string]bool, len(v))
+	for _, s := range v {
+		m[s] = true
+	}
+	return m
+}
+
 // configFromResourceState creates a raw config from an existing state.
 func configFromResourceState(r *schema.Resource, s *tf.InstanceState) *config.RawConfig {
 	d := r.Data(s)
@@ -0,0 +1,189 @@
+package tfx
+
+import (
+	"testing"
+
+	"github.com/hashicorp/terraform/builtin/providers/test"
+	tf "github.com/hashicorp/terraform/terraform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMutateFilter(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", MakeFactory(test.Provider))
+	rs, err := ctx.Providers.MakeResources("test_resource", AttrGen{
+		"id": []string{"a", "b"},
+	})
+	require.NoError(t, err)
+	s := NewState()
+	m := s.RootModule()
+	for _, r := range rs {
+		m.Resources[r.Key] = r.ResourceState
+	}
+	m.Resources["test_unknown.c"] = &tf.ResourceState{
+		Type:    "test_unknown",
+		Primary: &tf.InstanceState{ID: "c"},
+	}
+	destroy := func(ms *MutateState) { ms.SetId("") }
+	keys := func(d *tf.Diff) (keys []string) {
+		for _, m := range d.Modules {
+			for k := range m.Resources {
+				keys = append(keys, k)
+			}
+		}
+		return unique(keys)
+	}
+
+	d, err := ctx.Mutate(s, &MutateCfg{
+		Funcs:  []MutateFunc{destroy},
+		Strict: true,
+		Types:  []string{"test_resource", "test_other"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test_resource.a", "test_resource.b"}, keys(d))
+
+	d, err = ctx.Mutate(s, &MutateCfg{
+		Funcs:  []MutateFunc{destroy},
+		Strict: true,
+		Types:  []string{"test_resource"},
+		Keys:   []string{"test_resource.b", "test_unknown.c"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test_resource.b"}, keys(d))
+}
+
+func TestMutateSiblings(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", MakeFactory(test.Provider))
+	rs, err := ctx.Providers.MakeResources("test_resource", AttrGen{
+		"id":       []string{"a", "b", "c"},
+		"required": []string{"a", "b", "c"},
+	})
+	require.NoError(t, err)
+	s := NewState()
+	m := s.RootModule()
+	for _, r := range rs {
+		m.Resources[r.Key] = r.ResourceState
+	}
+	var ids, req []string
+	_, err = ctx.Mutate(s, &MutateCfg{
+		Keys: []string{"test_resource.b"},
+		Funcs: []MutateFunc{func(ms *MutateState) {
+			for _, d := range ms.SiblingsOfType("test_resource") {
+				ids = append(ids, d.Id())
+			}
+			req = append(req, ms.Sibling("test_resource.a").Get("required").(string))
+			assert.Nil(t, ms.Sibling("test_resource.x"))
+			assert.Nil(t, ms.SiblingsOfType("test_unknown"))
+		}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, ids)
+	assert.Equal(t, []string{"a"}, req)
+}
+
+func TestMutatePreview(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", MakeFactory(test.Provider))
+	rs, err := ctx.Providers.MakeResources("test_resource", AttrGen{
+		"id":       []string{"a", "b", "c"},
+		"required": "x",
+	})
+	require.NoError(t, err)
+	s := NewState()
+	m := s.RootModule()
+	for _, r := range rs {
+		r.Primary.Attributes["unknown"] = "1" // Not in schema
+		m.Resources[r.Key] = r.ResourceState
+	}
+	cfg := &MutateCfg{
+		Limit: 2,
+		Funcs: []MutateFunc{
+			func(ms *MutateState) {
+				if ms.Key == "test_resource.a" {
+					ms.SetId("")
+				}
+			},
+			func(ms *MutateState) { ms.Set("required", "x") },
+			func(ms *MutateState) { ms.Set("required", "y") },
+		},
+	}
+	changed, err := ctx.MutatePreview(s, cfg)
+	require.NoError(t, err)
+	require.Len(t, changed, 2)
+	for k, v := range changed {
+		if k == "test_resource.a" {
+			assert.Equal(t, []string{"id"}, v)
+		} else {
+			assert.Equal(t, []string{"required"}, v)
+		}
+	}
+}
+
+func TestMutateComputed(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", MakeFactory(test.Provider))
+	rs, err := ctx.Providers.MakeResources("test_resource", AttrGen{
+		"id":       []string{"a"},
+		"required": "x",
+	})
+	require.NoError(t, err)
+	s := NewState()
+	s.RootModule().Resources[rs[0].Key] = rs[0].ResourceState
+	cfg := &MutateCfg{Funcs: []MutateFunc{func(ms *MutateState) {
+		ms.SetComputed("computed_read_only", "drift")
+	}}}
+
+	d, err := ctx.Mutate(s, cfg)
+	require.NoError(t, err)
+	require.Len(t, d.Modules, 1)
+	want := &tf.ResourceAttrDiff{New: "drift"}
+	assert.Equal(t, want, d.Modules[0].Resources[rs[0].Key].Attributes["computed_read_only"])
+	_, ok := rs[0].Primary.Attributes["computed_read_only"]
+	assert.False(t, ok)
+
+	changed, err := ctx.MutatePreview(s, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		rs[0].Key: {"computed_read_only"},
+	}, changed)
+}
+
+func TestApplyMutations(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", MakeFactory(test.Provider))
+	rs, err := ctx.Providers.MakeResources("test_resource", AttrGen{
+		"id":       []string{"a", "b", "c"},
+		"required": "x",
+	})
+	require.NoError(t, err)
+	s := NewState()
+	m := s.RootModule()
+	for _, r := range rs {
+		m.Resources[r.Key] = r.ResourceState
+	}
+	var order []string
+	set := func(v string) MutateFunc {
+		return func(ms *MutateState) {
+			order = append(order, ms.Key)
+			ms.Set("required", v)
+		}
+	}
+	changes := map[string]MutateFunc{
+		"test_resource.c": set("z"),
+		"test_resource.a": set("y"),
+	}
+	d, err := ctx.ApplyMutations(s, changes)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"test_resource.a", "test_resource.c"}, order)
+	require.Len(t, d.Modules, 1)
+	r := d.Modules[0].Resources
+	require.Len(t, r, 2)
+	assert.Equal(t, "y", r["test_resource.a"].Attributes["required"].New)
+	assert.Equal(t, "z", r["test_resource.c"].Attributes["required"].New)
+
+	changes["test_resource.x"] = set("x")
+	_, err = ctx.ApplyMutations(s, changes)
+	assert.Error(t, err)
+}
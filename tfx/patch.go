@@ -3,6 +3,7 @@ package tfx
 import (
 	"context"
 	"fmt"
+	"log"
 	"reflect"
 	"sync"
 
@@ -17,12 +18,37 @@ var (
 	walkApply     tf.Interpolater
 )
 
+// PatchMode determines how Ctx.Patch handles graph transformers and evaluation
+// nodes that it does not recognize, which may happen after a Terraform update.
+// Unknown types are most likely config-related, so skipping them is usually
+// safe, but the result should be verified.
+type PatchMode int
+
+const (
+	PatchStrict PatchMode = iota // Panic on unknown types (default)
+	PatchSkip                    // Log and skip unknown types
+	PatchError                   // Return an error for unknown types
+)
+
+// unknown handles an unknown type according to mode. It returns a non-nil
+// error in PatchError mode.
+func (mode PatchMode) unknown(kind string, v interface{}) error {
+	switch mode {
+	case PatchSkip:
+		log.Printf("[WARN] tfx: skipping unknown %s type %T", kind, v)
+		return nil
+	case PatchError:
+		return fmt.Errorf("tfx: unknown %s type %T", kind, v)
+	}
+	panic(fmt.Sprintf("tfx: unknown %s type %T", kind, v))
+}
+
 // patch performs an apply operation without a config and returns the new state.
 // ResourceProvider.Apply() only requires state and diff. Regular apply uses the
 // config to fill in some blanks, such as the lifecycle info, and to validate
 // the diff, which we don't want to do. So while the graph and evaluation have
 // to be modified, the core idea here is perfectly safe and (mostly) hack-free.
-func patch(opts *tf.ContextOpts) (*tf.State, error) {
+func patch(opts *tf.ContextOpts, mode PatchMode) (*tf.State, error) {
 	if opts.Destroy {
 		// Need walkDestroy to implement this
 		panic("tfx: patch does not support pure destroy operations")
@@ -41,7 +67,7 @@ func patch(opts *tf.ContextOpts) (*tf.State, error) {
 		EnterPath(tf.RootModulePath).(*tf.BuiltinEvalContext).Components
 
 	// Build patch graph
-	graph, err := (&patchGraphBuilder{tf.ApplyGraphBuilder{
+	graph, err := (&patchGraphBuilder{ApplyGraphBuilder: tf.ApplyGraphBuilder{
 		Diff:         opts.Diff,
 		State:        state,
 		Providers:    comps.ResourceProviders(),
@@ -49,7 +75,7 @@ func patch(opts *tf.ContextOpts) (*tf.State, error) {
 		Targets:      opts.Targets,
 		Destroy:      opts.Destroy,
 		Validate:     true,
-	}}).Build(tf.RootModulePath)
+	}, mode: mode}).Build(tf.RootModulePath)
 	if err != nil {
 		return nil, err
 	}
@@ -95,12 +121,28 @@ func (w *patchGraphWalker) EnterPath(path []string) tf.EvalContext {
 	return ctx
 }
 
-// patchGraphBuilder is a config-free ApplyGraphBuilder.
-type patchGraphBuilder struct{ tf.ApplyGraphBuilder }
+// Tests may set these functions to modify the graph transformers and
+// evaluation nodes obtained from Terraform before they are filtered.
+var (
+	injectSteps func([]tf.GraphTransformer) []tf.GraphTransformer
+	injectEval  func([]tf.EvalNode) []tf.EvalNode
+)
+
+// patchGraphBuilder is a config-free ApplyGraphBuilder. Errors for unknown
+// transformer types are saved in err.
+type patchGraphBuilder struct {
+	tf.ApplyGraphBuilder
+	mode PatchMode
+	err  error
+}
 
 func (b *patchGraphBuilder) Build(path []string) (*tf.Graph, error) {
+	steps := b.Steps()
+	if b.err != nil {
+		return nil, b.err
+	}
 	return (&tf.BasicGraphBuilder{
-		Steps:    b.Steps(),
+		Steps:    steps,
 		Validate: b.Validate,
 		Name:     "PatchGraphBuilder",
 	}).Build(path)
@@ -110,9 +152,12 @@ func (b *patchGraphBuilder) Steps() []tf.GraphTransformer {
 	concreteResource := func(a *tf.NodeAbstractResource) dag.Vertex {
 		return &nodePatchableResource{tf.NodeApplyableResource{
 			NodeAbstractResource: a,
-		}}
+		}, b.mode}
 	}
 	steps := b.ApplyGraphBuilder.Steps()
+	if injectSteps != nil {
+		steps = injectSteps(steps)
+	}
 	multi := reflect.TypeOf(tf.GraphTransformMulti())
 
 	// Filter transformers, keeping only those that do not require a config
@@ -148,7 +193,10 @@ func (b *patchGraphBuilder) Steps() []tf.GraphTransformer {
 
 		default:
 			if reflect.TypeOf(t) != multi {
-				panic(fmt.Sprintf("tfx: unknown GraphTransformer type %T", t))
+				if err := b.mode.unknown("GraphTransformer", t); b.err == nil {
+					b.err = err
+				}
+				continue
 			}
 		}
 		keep = append(keep, t)
@@ -157,7 +205,10 @@ func (b *patchGraphBuilder) Steps() []tf.GraphTransformer {
 }
 
 // nodePatchableResource is a config-free NodeApplyableResource.
-type nodePatchableResource struct{ tf.NodeApplyableResource }
+type nodePatchableResource struct {
+	tf.NodeApplyableResource
+	mode PatchMode
+}
 
 func (n *nodePatchableResource) EvalTree() tf.EvalNode {
 	// NodeApplyableResource.EvalTree() expects a valid Config pointer, so we
@@ -178,6 +229,9 @@ func (n *nodePatchableResource) EvalTree() tf.EvalNode {
 	seq := n.NodeApplyableResource.EvalTree().(*tf.EvalSequence)
 	n.Config.RawCount = nil
 	n.Config.RawConfig = nil
+	if injectEval != nil {
+		seq.Nodes = injectEval(seq.Nodes)
+	}
 
 	// Filter nodes, keeping only those that do not require a config
 	keep := seq.Nodes[:0]
@@ -206,10 +260,19 @@ func (n *nodePatchableResource) EvalTree() tf.EvalNode {
 			continue
 
 		default:
-			panic(fmt.Sprintf("tfx: unknown EvalNode type %T", e))
+			if err := n.mode.unknown("EvalNode", e); err != nil {
+				// Fail when the node is evaluated
+				return &tf.EvalSequence{Nodes: []tf.EvalNode{evalError{err}}}
+			}
+			continue
 		}
 		keep = append(keep, e)
 	}
 	seq.Nodes = keep
 	return seq
 }
+
+// evalError is an EvalNode that returns an error.
+type evalError struct{ err error }
+
+func (e evalError) Eval(tf.EvalContext) (interface{}, error) { return nil, e.err }
@@ -1,6 +1,7 @@
 package tfx
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -8,6 +9,8 @@ import (
 	"testing"
 
 	"github.com/hashicorp/terraform/builtin/providers/test"
+	tf "github.com/hashicorp/terraform/terraform"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -53,3 +56,81 @@ func TestPatch(t *testing.T) {
 		require.Equal(t, want, have, "%s", config)
 	}
 }
+
+func TestPatchModeUnknown(t *testing.T) {
+	type unknown struct{ tf.GraphTransformer }
+	v := &unknown{}
+	assert.Panics(t, func() { PatchStrict.unknown("GraphTransformer", v) })
+	assert.NoError(t, PatchSkip.unknown("GraphTransformer", v))
+	err := PatchError.unknown("GraphTransformer", v)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown GraphTransformer type")
+
+	want := errors.New("eval")
+	_, err = evalError{want}.Eval(nil)
+	assert.Equal(t, want, err)
+}
+
+type unknownTransformer struct{}
+
+func (unknownTransformer) Transform(*tf.Graph) error { return nil }
+
+type unknownEval struct{}
+
+func (unknownEval) Eval(tf.EvalContext) (interface{}, error) { return nil, nil }
+
+func TestPatchUnknownTypes(t *testing.T) {
+	var ctx Ctx
+	ctx.Providers.Add("test", "", MakeFactory(test.Provider))
+	s, err := ctx.Apply(loadCfg(t, `
+		resource "test_resource" "r" {
+			required     = "a"
+			required_map = {x = 0}
+		}
+	`), nil)
+	require.NoError(t, err)
+	cfg := loadCfg(t, `
+		resource "test_resource" "r" {
+			required     = "b"
+			required_map = {x = 0}
+		}
+	`)
+	d, err := ctx.Diff(cfg, s)
+	require.NoError(t, err)
+	want, err := ctx.Apply(cfg, s)
+	require.NoError(t, err)
+
+	defer func() { injectSteps, injectEval = nil, nil }()
+	for _, tc := range []struct {
+		kind   string
+		inject func()
+	}{{
+		kind: "GraphTransformer",
+		inject: func() {
+			injectSteps = func(v []tf.GraphTransformer) []tf.GraphTransformer {
+				return append(v, unknownTransformer{})
+			}
+			injectEval = nil
+		},
+	}, {
+		kind: "EvalNode",
+		inject: func() {
+			injectSteps = nil
+			injectEval = func(v []tf.EvalNode) []tf.EvalNode {
+				return append(v, unknownEval{})
+			}
+		},
+	}} {
+		tc.inject()
+
+		ctx.PatchMode = PatchSkip
+		have, err := ctx.Patch(s, d)
+		require.NoError(t, err, "%s", tc.kind)
+		assert.Equal(t, want, have, "%s", tc.kind)
+
+		ctx.PatchMode = PatchError
+		_, err = ctx.Patch(s, d)
+		require.Error(t, err, "%s", tc.kind)
+		assert.Contains(t, err.Error(), "unknown "+tc.kind+" type", "%s", tc.kind)
+	}
+}
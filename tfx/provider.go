@@ -1,11 +1,21 @@
 package tfx
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/config/module"
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/plugin/discovery"
 	tf "github.com/hashicorp/terraform/terraform"
@@ -14,6 +24,30 @@ import (
 // Providers is the default in-memory provider registry.
 var Providers ProviderMap
 
+// regMu serializes updates to the global Providers and Deps registries.
+var regMu sync.Mutex
+
+// RegisterProvider adds a provider to the global Providers registry and merges
+// its dependency map, which may be nil, into Deps. It is safe for concurrent
+// use, which makes it suitable for plugin loaders that register providers from
+// multiple goroutines. Like Providers.Add, it panics if the provider name is
+// already registered or the registry is frozen.
+//
+// Provider packages normally call RegisterProvider from init. Go runs package
+// init functions sequentially in dependency order, so such registrations never
+// run concurrently, but the relative order of unrelated provider packages
+// should not be relied upon. Since overlapping Deps entries are merged, only
+// the order of specs within a resource type depends on registration order.
+// All registration must be complete before either registry is used.
+func RegisterProvider(name, version string, f tf.ResourceProviderFactory, deps DepMap) {
+	regMu.Lock()
+	defer regMu.Unlock()
+	Providers.Add(name, version, f)
+	if deps != nil {
+		Deps.Add(deps)
+	}
+}
+
 // MakeFactory adds a nil error return to a standard provider constructor to
 // match factory function signature. This should be used instead of
 // terraform.ResourceProviderFactoryFixed.
@@ -21,6 +55,79 @@ func MakeFactory(f func() tf.ResourceProvider) tf.ResourceProviderFactory {
 	return func() (tf.ResourceProvider, error) { return f(), nil }
 }
 
+// FixedFactory returns a factory for an existing provider instance. Since
+// factories must return a new instance for each call, schema.Provider instances
+// are cloned, including all resource and data source schemas. If p is already
+// configured, each clone shares its meta value, and configuring a clone keeps
+// that value instead of calling ConfigureFunc again. Other provider
+// implementations are returned as-is and only support standard operations
+// (i.e. they cannot be used with SchemaResolver or PassthroughResolver).
+func FixedFactory(p tf.ResourceProvider) tf.ResourceProviderFactory {
+	sp, ok := p.(*schema.Provider)
+	if !ok {
+		return tf.ResourceProviderFactoryFixed(p)
+	}
+	return func() (tf.ResourceProvider, error) {
+		c := &schema.Provider{
+			Schema:         cloneSchemaMap(sp.Schema),
+			ResourcesMap:   cloneResourceMap(sp.ResourcesMap),
+			DataSourcesMap: cloneResourceMap(sp.DataSourcesMap),
+			ConfigureFunc:  sp.ConfigureFunc,
+			MetaReset:      sp.MetaReset,
+		}
+		if meta := sp.Meta(); meta != nil {
+			c.ConfigureFunc = func(*schema.ResourceData) (interface{}, error) {
+				return meta, nil
+			}
+			c.SetMeta(meta)
+		}
+		return c, nil
+	}
+}
+
+// cloneResourceMap returns a deep copy of resource map m.
+func cloneResourceMap(m map[string]*schema.Resource) map[string]*schema.Resource {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]*schema.Resource, len(m))
+	for k, r := range m {
+		out[k] = cloneResource(r)
+	}
+	return out
+}
+
+// cloneResource returns a deep copy of resource r.
+func cloneResource(r *schema.Resource) *schema.Resource {
+	c := *r
+	c.Schema = cloneSchemaMap(r.Schema)
+	return &c
+}
+
+// cloneSchemaMap returns a deep copy of schema map m.
+func cloneSchemaMap(m map[string]*schema.Schema) map[string]*schema.Schema {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]*schema.Schema, len(m))
+	for k, s := range m {
+		out[k] = cloneSchema(s)
+	}
+	return out
+}
+
+// cloneSchema returns a deep copy of schema s.
+func cloneSchema(s *schema.Schema) *schema.Schema {
+	c := *s
+	switch e := s.Elem.(type) {
+	case *schema.Schema:
+		c.Elem = cloneSchema(e)
+	case *schema.Resource:
+		c.Elem = cloneResource(e)
+	}
+	return &c
+}
+
 // Config creates schema.ResourceData from a raw config.
 func Config(s map[string]*schema.Schema, raw map[string]interface{}) (*schema.ResourceData, error) {
 	r, err := config.NewRawConfig(raw)
@@ -34,6 +141,35 @@ func Config(s map[string]*schema.Schema, raw map[string]interface{}) (*schema.Re
 	return b.Config(), nil
 }
 
+// WalkSchema calls fn for each attribute of resource r, including attributes of
+// nested resources, in lexical order. Elements of lists, sets, and maps are
+// visited with an extra "*" path segment (e.g. ["list", "*", "attr"]). The path
+// slice is reused between calls and must not be retained by fn.
+func WalkSchema(r *schema.Resource, fn func(path []string, s *schema.Schema)) {
+	walkSchema(make([]string, 0, 8), r.Schema, fn)
+}
+
+func walkSchema(path []string, m map[string]*schema.Schema, fn func([]string, *schema.Schema)) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		walkAttr(append(path, k), m[k], fn)
+	}
+}
+
+func walkAttr(path []string, s *schema.Schema, fn func([]string, *schema.Schema)) {
+	fn(path, s)
+	switch e := s.Elem.(type) {
+	case *schema.Schema:
+		walkAttr(append(path, "*"), e, fn)
+	case *schema.Resource:
+		walkSchema(append(path, "*"), e.Schema, fn)
+	}
+}
+
 // InitSchemaProvider should be called from factory functions to initialize new
 // schema.Provider instances. It disables DefaultFuncs to ensure deterministic
 // behavior (these are normally used to get environment variables), and sets
@@ -58,13 +194,56 @@ func InitSchemaProvider(rp tf.ResourceProvider) *schema.Provider {
 
 // ProviderMap is an in-memory provider registry. It returns provider resolvers
 // for Terraform context operations and provides access to provider schemas.
+// Providers are initialized lazily, so a map is not safe for concurrent use
+// until it is frozen. All providers should be added before the map is used.
 type ProviderMap map[string]*provider
 
+// frozenMaps is the set of frozen ProviderMaps, keyed by map address. Frozen
+// maps are retained, so their addresses cannot be reused by new maps.
+var frozenMaps = struct {
+	sync.RWMutex
+	m map[uintptr]ProviderMap
+}{m: make(map[uintptr]ProviderMap)}
+
+// Freeze initializes all registered providers and makes pm immutable, causing
+// any subsequent Add call to panic. A frozen map is safe for concurrent use.
+func (pm *ProviderMap) Freeze() {
+	if *pm == nil {
+		*pm = make(map[string]*provider)
+	}
+	for _, p := range *pm {
+		p.init()
+	}
+	frozenMaps.Lock()
+	defer frozenMaps.Unlock()
+	frozenMaps.m[pm.addr()] = *pm
+}
+
+// Frozen returns true if pm is immutable.
+func (pm ProviderMap) Frozen() bool {
+	if pm == nil {
+		return false
+	}
+	frozenMaps.RLock()
+	defer frozenMaps.RUnlock()
+	_, ok := frozenMaps.m[pm.addr()]
+	return ok
+}
+
+// addr returns the address of the map referenced by pm.
+func (pm ProviderMap) addr() uintptr {
+	return reflect.ValueOf(pm).Pointer()
+}
+
 // Add adds a new provider to the registry. Version is optional. The factory
 // function must return a new provider instance for each call (i.e. do not use
-// terraform.ResourceProviderFactoryFixed wrapper).
+// terraform.ResourceProviderFactoryFixed wrapper). It panics if pm is frozen.
 func (pm *ProviderMap) Add(name, version string, f tf.ResourceProviderFactory) {
-	if *pm == nil {
+	if name == "" {
+		panic("tfx: invalid provider name")
+	} else if pm.Frozen() {
+		panic("tfx: provider map is frozen: " + name)
+	} else if *pm == nil {
 		*pm = make(map[string]*provider)
 	} else if _, dup := (*pm)[name]; dup {
 		panic("tfx: provider already registered: " + name)
@@ -74,6 +253,54 @@ func (pm *ProviderMap) Add(name, version string, f tf.ResourceProviderFactory) {
 	(*pm)[name] = p
 }
 
+// Register is a chainable version of Add that returns pm.
+func (pm *ProviderMap) Register(name, version string, f tf.ResourceProviderFactory) *ProviderMap {
+	pm.Add(name, version, f)
+	return pm
+}
+
+// AddAs adds a provider that was implemented as provider orig under a different
+// name. Terraform maps resource types to providers using the type prefix up to
+// the first underscore, so all resource and data source types of the provider
+// are renamed by replacing the orig prefix with name (e.g. "test_resource"
+// becomes "test1_resource" when orig is "test" and name is "test1"). The same
+// provider can be added under multiple names, and ResourceSchema will route
+// each renamed type to its own registration. The factory must return a
+// schema.Provider.
+func (pm *ProviderMap) AddAs(name, orig, version string, f tf.ResourceProviderFactory) {
+	if name == orig {
+		pm.Add(name, version, f)
+		return
+	}
+	pm.Add(name, version, func() (tf.ResourceProvider, error) {
+		rp, err := f()
+		if err != nil {
+			return nil, err
+		}
+		p, ok := rp.(*schema.Provider)
+		if !ok {
+			return nil, fmt.Errorf("tfx: provider %q is not a schema.Provider", orig)
+		}
+		renameTypes(p.ResourcesMap, orig+"_", name+"_")
+		renameTypes(p.DataSourcesMap, orig+"_", name+"_")
+		return p, nil
+	})
+}
+
+// renameTypes replaces type prefix from with to in all keys of m.
+func renameTypes(m map[string]*schema.Resource, from, to string) {
+	tmp := make(map[string]*schema.Resource, len(m))
+	for typ, r := range m {
+		if strings.HasPrefix(typ, from) {
+			tmp[to+typ[len(from):]] = r
+			delete(m, typ)
+		}
+	}
+	for typ, r := range tmp {
+		m[typ] = r
+	}
+}
+
 // Schema returns the schema for the specified provider. It returns nil if the
 // provider is not registered or not implemented via schema.Provider. The
 // returned value is cached and must only be used for local schema operations.
@@ -98,6 +325,29 @@ func (pm ProviderMap) ResourceSchema(typ string) (*schema.Provider, *schema.Reso
 	return nil, nil
 }
 
+// ErrUnknownType is returned when a resource type is not provided by any
+// registered provider or the provider is not implemented via schema.Provider.
+type ErrUnknownType string
+
+// Error implements error interface.
+func (e ErrUnknownType) Error() string {
+	return fmt.Sprintf("tfx: unknown resource type %q", string(e))
+}
+
+// VersionConstraintError is returned by provider resolvers when the version of
+// a registered provider does not satisfy the configured version constraints.
+type VersionConstraintError struct {
+	Provider    string
+	Version     discovery.Version
+	Constraints discovery.Constraints
+}
+
+// Error implements error interface.
+func (e *VersionConstraintError) Error() string {
+	return fmt.Sprintf("provider %q v%s does not satisfy %q",
+		e.Provider, e.Version, e.Constraints)
+}
+
 // Resource associates a state key with tf.ResourceState.
 type Resource struct {
 	Key string
@@ -109,11 +359,13 @@ type Resource struct {
 // NewResource returns a skeleton resource state for the specified resource type
 // and ID. If useImport is true, the resource importer is applied to the new
 // resource. Importers that return multiple new states or make API calls are not
-// supported.
+// supported (see Ctx.Import). Imported resources are also migrated to the
+// current schema version (see MigrateResource). ErrUnknownType is returned if
+// the resource type is not registered.
 func (pm ProviderMap) NewResource(typ, id string, useImport bool) (Resource, error) {
 	_, s := pm.ResourceSchema(typ)
 	if s == nil {
-		return Resource{}, fmt.Errorf("tfx: unknown resource type %q", typ)
+		return Resource{}, ErrUnknownType(typ)
 	}
 	if id == "" {
 		return Resource{}, fmt.Errorf("tfx: empty id for resource type %q", typ)
@@ -148,12 +400,64 @@ func (pm ProviderMap) NewResource(typ, id string, useImport bool) (Resource, err
 				typ, len(d)))
 		}
 		rs.Primary = d[0].State()
+		if err = pm.MigrateResource(&rs); err != nil {
+			return Resource{}, err
+		}
 	}
 	return rs, nil
 }
 
-// Schema returns resource schema.
+// MigrateResource runs the MigrateState function of the resource schema if the
+// "schema_version" of r is older than the current schema version, and updates
+// the version. Migration is normally done by Terraform during refresh, but
+// provider instances used for schema-only operations never migrate state.
+// Migration functions do not have access to a configured provider.
+// ErrUnknownType is returned if the resource type is not registered.
+func (pm ProviderMap) MigrateResource(r *Resource) error {
+	_, s := pm.ResourceSchema(r.Type)
+	if s == nil {
+		return ErrUnknownType(r.Type)
+	}
+	var v int
+	if raw, ok := r.Primary.Meta["schema_version"]; ok {
+		var err error
+		if v, err = strconv.Atoi(fmt.Sprint(raw)); err != nil {
+			return fmt.Errorf("tfx: invalid schema_version for %q: %v",
+				r.Key, raw)
+		}
+	}
+	if v >= s.SchemaVersion {
+		return nil
+	}
+	p := pm.get(config.ResourceProviderFullName(r.Type, ""))
+	rp, err := p.factory[defaultMode]()
+	if err != nil {
+		return err
+	}
+	if migrate := rp.(*schema.Provider).ResourcesMap[r.Type].MigrateState; migrate != nil {
+		is, err := migrate(v, r.Primary.DeepCopy(), nil)
+		if err != nil {
+			return err
+		}
+		r.Primary = is
+	}
+	if r.Primary.Meta == nil {
+		r.Primary.Meta = make(map[string]interface{})
+	}
+	r.Primary.Meta["schema_version"] = strconv.Itoa(s.SchemaVersion)
+	r.data = nil
+	return nil
+}
+
+// Schema returns resource schema or nil if the resource type is unknown. Data
+// source schemas are returned for keys with a "data." prefix.
 func (r *Resource) Schema() *schema.Resource {
+	if strings.HasPrefix(r.Key, "data.") {
+		if p := Providers.Schema(config.ResourceProviderFullName(r.Type, "")); p != nil {
+			return p.DataSourcesMap[r.Type]
+		}
+		return nil
+	}
 	_, s := Providers.ResourceSchema(r.Type)
 	return s
 }
@@ -166,22 +470,191 @@ func (r *Resource) Data() *schema.ResourceData {
 	return r.data
 }
 
+// GetAttr returns the value of a flatmap attribute key (e.g. "list.0.attr").
+func (r *Resource) GetAttr(key string) (string, bool) {
+	v, ok := r.Primary.Attributes[key]
+	return v, ok
+}
+
+// SetAttr sets the value of a flatmap attribute key. Setting "id" also updates
+// the instance ID. Any cached resource data is discarded.
+func (r *Resource) SetAttr(key, value string) {
+	if r.Primary.Attributes == nil {
+		r.Primary.Attributes = make(map[string]string)
+	}
+	if r.Primary.Attributes[key] = value; key == "id" {
+		r.Primary.ID = value
+	}
+	r.data = nil
+}
+
+// SetNestedAttr sets the value of a nested attribute specified by path (e.g.
+// {"list", "0", "attr"}). List count keys ("list.#") for all numeric path
+// elements are updated to include the new index.
+func (r *Resource) SetNestedAttr(path []string, value string) {
+	for i := 1; i < len(path); i++ {
+		idx, err := strconv.Atoi(path[i])
+		if err != nil || idx < 0 {
+			continue
+		}
+		k := strings.Join(path[:i], ".") + ".#"
+		if n, _ := strconv.Atoi(r.Primary.Attributes[k]); n <= idx {
+			r.SetAttr(k, strconv.Itoa(idx+1))
+		}
+	}
+	r.SetAttr(strings.Join(path, "."), value)
+}
+
+// Equal returns true if r and o have the same type, ID, and attribute values.
+// Attributes are compared by their schema-normalized values, so unset and zero
+// values are equal, and set elements are compared by content rather than by
+// their hash keys. Resource keys and dependencies are ignored.
+func (r *Resource) Equal(o Resource) bool {
+	return r.Type == o.Type && r.Primary.ID == o.Primary.ID &&
+		bytes.Equal(r.normAttrs(), o.normAttrs())
+}
+
+// Fingerprint returns a stable hash of the resource type, ID, and normalized
+// attribute values. Resources that are Equal have the same fingerprint.
+func (r *Resource) Fingerprint() string {
+	h := sha256.New()
+	h.Write([]byte(r.Type + "\x00" + r.Primary.ID + "\x00"))
+	h.Write(r.normAttrs())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// normAttrs returns the canonical JSON encoding of resource attributes. Raw
+// flatmap attributes are used if the resource type is unknown.
+func (r *Resource) normAttrs() []byte {
+	var v interface{} = r.Primary.Attributes
+	if s := r.Schema(); s != nil {
+		d := r.Data()
+		m := make(map[string]interface{}, len(s.Schema))
+		for k := range s.Schema {
+			m[k] = normValue(d.Get(k))
+		}
+		v = m
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// normValue converts sets to lists sorted by the JSON encoding of each element.
+func normValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *schema.Set:
+		elems := v.List()
+		enc := make([]string, len(elems))
+		for i, e := range elems {
+			b, err := json.Marshal(normValue(e))
+			if err != nil {
+				panic(err)
+			}
+			enc[i] = string(b)
+		}
+		sort.Strings(enc)
+		out := make([]interface{}, len(enc))
+		for i, e := range enc {
+			out[i] = json.RawMessage(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = normValue(e)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = normValue(e)
+		}
+		return out
+	}
+	return v
+}
+
 // AttrGen is an attribute value generator used to create resources. Valid value
-// types are: string, []string, func(i int) string, and func(i int) *string.
-// Functions must return values for i in the range [0,n). Use "#" key to specify
-// n when there are no []string attributes.
+// types are: string, []string, func(i int) string, func(i int) *string, and
+// func(i int) (string, error). Functions must return values for i in the range
+// [0,n). Use "#" key to specify n when there are no []string attributes. Errors
+// returned by generator functions are returned by MakeResources. Setting a value
+// to Computed marks the attribute as unknown. The "id" generator may also be
+// func(i int, attrs map[string]string) string, which is called after all other
+// attributes are generated to compose the ID from their values (e.g. Azure
+// resource IDs). The attrs map must not be modified. The NameKey generator
+// specifies resource names used in state keys. It does not support *string or
+// composite functions.
 type AttrGen map[string]interface{}
 
+// NameKey is the AttrGen key for the resource name generator. By default, names
+// are derived from resource IDs, which may result in collisions if the IDs are
+// not unique after normalization. Generated names are normalized the same way.
+const NameKey = "#name"
+
+// Computed is an attribute value indicating that the actual value is unknown
+// (e.g. the resource is being created and the attribute has not been computed
+// yet). It is the same value that Terraform uses for unknown attributes in
+// partial states. Computed values are ignored by DepMap.Infer.
+const Computed = config.UnknownVariableValue
+
 // MakeResources calls NewResource for each "id" attribute (or for "#"
 // invocations of its generator function) and populates any remaining attribute
-// values.
+// values. An error is returned if two resources end up with the same state key.
+// ErrUnknownType is returned if the resource type is not registered, even if
+// there are no resources to create.
 func (pm ProviderMap) MakeResources(typ string, attrs AttrGen) ([]Resource, error) {
 	return pm.makeResources(typ, attrs, false)
 }
 
+// MakeCountResources is similar to MakeResources, but it creates n instances of
+// a single resource with the specified name, as if it was configured with
+// count = n. Instance keys are indexed (e.g. "type.name.0"), except when n is 1,
+// which matches Terraform behavior. The "#" attribute is set to n and NameKey is
+// ignored.
+func (pm ProviderMap) MakeCountResources(typ, name string, n int, attrs AttrGen) ([]Resource, error) {
+	if !config.NameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("tfx: invalid resource name %q", name)
+	}
+	gen := make(AttrGen, len(attrs)+2)
+	for k, v := range attrs {
+		gen[k] = v
+	}
+	gen["#"] = n
+	gen[NameKey] = strconv.Itoa
+	rs, err := pm.makeResources(typ, gen, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(rs) != n {
+		return nil, fmt.Errorf("tfx: have %d %q resources, want %d",
+			len(rs), typ, n)
+	}
+	for i := range rs {
+		k := tf.ResourceStateKey{
+			Name:  name,
+			Type:  typ,
+			Mode:  config.ManagedResourceMode,
+			Index: i,
+		}
+		if n == 1 {
+			k.Index = -1
+		}
+		if _, err := tf.ParseResourceStateKey(k.String()); err != nil {
+			return nil, err
+		}
+		rs[i].Key = k.String()
+	}
+	return rs, nil
+}
+
 // ImportResources calls NewResource for each "id" attribute (or for "#"
 // invocations of its generator function), applies the resource importer, and
-// populates any remaining attribute values.
+// populates any remaining attribute values. Unknown resource types are handled
+// the same way as in MakeResources.
 func (pm ProviderMap) ImportResources(typ string, attrs AttrGen) ([]Resource, error) {
 	return pm.makeResources(typ, attrs, true)
 }
@@ -204,6 +677,22 @@ func (pm ProviderMap) PassthroughResolver() tf.ResourceProviderResolver {
 	return pm.resolver(passthroughMode)
 }
 
+// Required returns the provider requirements of module t, which are the same
+// requirements that a resolver receives when a new context is created for t. A
+// non-nil error is also returned if any required provider is not registered or
+// does not satisfy its version constraints.
+func (pm ProviderMap) Required(t *module.Tree) (discovery.PluginRequirements, error) {
+	reqd := tf.ModuleTreeDependencies(t, nil).AllPluginRequirements()
+	_, errs := pm.resolver(defaultMode).ResolveProviders(reqd)
+	if len(errs) == 0 {
+		return reqd, nil
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+	return reqd, multierror.Append(nil, errs...)
+}
+
 // get returns the provider with the specified name.
 func (pm ProviderMap) get(name string) *provider {
 	p := pm[name]
@@ -225,8 +714,7 @@ func (pm ProviderMap) resolver(mode providerMode) tf.ResourceProviderResolver {
 				err = fmt.Errorf("provider %q is not available", name)
 			} else if !req.Versions.Unconstrained() && p.version != "" &&
 				!req.Versions.Allows(p.discVer) {
-				err = fmt.Errorf("provider %q v%s does not satisfy %q",
-					name, strings.TrimPrefix(p.version, "v"), req.Versions)
+				err = &VersionConstraintError{name, p.discVer, req.Versions}
 			} else if f := p.factory[mode]; f == nil {
 				err = fmt.Errorf("provider %q does not support mode %v",
 					name, mode)
@@ -240,16 +728,83 @@ func (pm ProviderMap) resolver(mode providerMode) tf.ResourceProviderResolver {
 	})
 }
 
+// limitResolver wraps the factories returned by resolver r to limit concurrent
+// API operations for each provider in limits.
+func limitResolver(r tf.ResourceProviderResolver, limits map[string]int) tf.ResourceProviderResolver {
+	if len(limits) == 0 {
+		return r
+	}
+	return tf.ResourceProviderResolverFunc(func(reqd discovery.PluginRequirements) (
+		map[string]tf.ResourceProviderFactory, []error,
+	) {
+		m, errs := r.ResolveProviders(reqd)
+		for name, f := range m {
+			if n := limits[name]; n > 0 {
+				m[name] = limitFactory(f, make(chan struct{}, n))
+			}
+		}
+		return m, errs
+	})
+}
+
+// limitFactory returns a factory for providers that share semaphore sem.
+func limitFactory(f tf.ResourceProviderFactory, sem chan struct{}) tf.ResourceProviderFactory {
+	return func() (tf.ResourceProvider, error) {
+		p, err := f()
+		if err != nil {
+			return nil, err
+		}
+		return &limitedProvider{p, sem}, nil
+	}
+}
+
+// limitedProvider limits concurrent API operations via a shared semaphore.
+type limitedProvider struct {
+	tf.ResourceProvider
+	sem chan struct{}
+}
+
+func (p *limitedProvider) Apply(info *tf.InstanceInfo, s *tf.InstanceState, d *tf.InstanceDiff) (*tf.InstanceState, error) {
+	p.sem <- struct{}{}
+	defer func() { <-p.sem }()
+	return p.ResourceProvider.Apply(info, s, d)
+}
+
+func (p *limitedProvider) Refresh(info *tf.InstanceInfo, s *tf.InstanceState) (*tf.InstanceState, error) {
+	p.sem <- struct{}{}
+	defer func() { <-p.sem }()
+	return p.ResourceProvider.Refresh(info, s)
+}
+
+func (p *limitedProvider) ReadDataApply(info *tf.InstanceInfo, d *tf.InstanceDiff) (*tf.InstanceState, error) {
+	p.sem <- struct{}{}
+	defer func() { <-p.sem }()
+	return p.ResourceProvider.ReadDataApply(info, d)
+}
+
+func (p *limitedProvider) ImportState(info *tf.InstanceInfo, id string) ([]*tf.InstanceState, error) {
+	p.sem <- struct{}{}
+	defer func() { <-p.sem }()
+	return p.ResourceProvider.ImportState(info, id)
+}
+
+// Close implements tf.ResourceProviderCloser, which is hidden by embedding.
+func (p *limitedProvider) Close() error {
+	if c, ok := p.ResourceProvider.(tf.ResourceProviderCloser); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 // makeResources implements MakeResources and ImportResources.
 func (pm ProviderMap) makeResources(typ string, attrs AttrGen, useImport bool) ([]Resource, error) {
+	_, s := pm.ResourceSchema(typ)
+	if s == nil {
+		return nil, ErrUnknownType(typ)
+	}
+
 	// Generate IDs
-	var ids []string
-	switch v := attrs["id"].(type) {
-	case string:
-		ids = []string{v}
-	case []string:
-		ids = v
-	case func(int) string:
+	count := func() int {
 		n := attrs["#"]
 		if n == nil {
 			for _, v := range attrs {
@@ -262,12 +817,15 @@ func (pm ProviderMap) makeResources(typ string, attrs AttrGen, useImport bool) (
 				panic("tfx: '#' value required for 'id' function")
 			}
 		}
-		ids = make([]string, n.(int))
-		for i := range ids {
-			ids[i] = v(i)
-		}
-	default:
-		panic("tfx: invalid 'id' attribute value type")
+		return n.(int)
+	}
+	idFn, composite := attrs["id"].(func(int, map[string]string) string)
+	var ids []string
+	var err error
+	if composite {
+		ids = make([]string, count())
+	} else if ids, err = genValues("id", attrs["id"], count); err != nil {
+		return nil, err
 	}
 
 	// Make sure all []string values have identical lengths
@@ -282,20 +840,63 @@ func (pm ProviderMap) makeResources(typ string, attrs AttrGen, useImport bool) (
 		return nil, nil
 	}
 
+	// Generate additional attributes and composite IDs
+	vals := make([]map[string]string, len(ids))
+	for i := range vals {
+		if vals[i], err = genAttrs(typ, s, attrs, i); err != nil {
+			return nil, err
+		}
+		if composite {
+			ids[i] = idFn(i, vals[i])
+		}
+	}
+
+	// Generate names
+	var names []string
+	if v, ok := attrs[NameKey]; ok {
+		if names, err = genValues(NameKey, v, func() int { return len(ids) }); err != nil {
+			return nil, err
+		}
+		if len(names) != len(ids) {
+			panic(fmt.Sprintf(
+				"tfx: invalid number of %q values (have %d, want %d)",
+				NameKey, len(names), len(ids)))
+		}
+	}
+
 	// Create resources
 	rs := make([]Resource, len(ids))
-	var err error
+	keys := make(map[string]int, len(ids))
 	for i, id := range ids {
 		if rs[i], err = pm.NewResource(typ, id, useImport); err != nil {
 			return nil, err
 		}
+		if names != nil {
+			if names[i] == "" {
+				return nil, fmt.Errorf("tfx: empty name for %q resource %q",
+					typ, id)
+			}
+			rs[i].Key = typ + "." + makeName(names[i])
+		}
+		if j, dup := keys[rs[i].Key]; dup {
+			return nil, fmt.Errorf("tfx: resource key collision %q (ids %q and %q)",
+				rs[i].Key, ids[j], id)
+		}
+		keys[rs[i].Key] = i
+		for k, v := range vals[i] {
+			rs[i].Primary.Attributes[k] = v
+		}
 	}
+	return rs, nil
+}
 
-	// Set additional attributes
-	_, s := pm.ResourceSchema(typ)
+// genAttrs returns the values of all attributes in attrs, other than "#", "id",
+// and NameKey, for the resource at index i.
+func genAttrs(typ string, s *schema.Resource, attrs AttrGen, i int) (map[string]string, error) {
+	out := make(map[string]string, len(attrs))
 	for k, v := range attrs {
 		switch k {
-		case "#", "id":
+		case "#", "id", NameKey:
 			continue
 		}
 		if s.Schema[k] == nil {
@@ -303,28 +904,52 @@ func (pm ProviderMap) makeResources(typ string, attrs AttrGen, useImport bool) (
 		}
 		switch v := v.(type) {
 		case string:
-			for _, r := range rs {
-				r.Primary.Attributes[k] = v
-			}
+			out[k] = v
 		case []string:
-			for i, r := range rs {
-				r.Primary.Attributes[k] = v[i]
-			}
+			out[k] = v[i]
 		case func(int) string:
-			for i, r := range rs {
-				r.Primary.Attributes[k] = v(i)
-			}
+			out[k] = v(i)
 		case func(int) *string:
-			for i, r := range rs {
-				if p := v(i); p != nil {
-					r.Primary.Attributes[k] = *p
-				}
+			if p := v(i); p != nil {
+				out[k] = *p
+			}
+		case func(int) (string, error):
+			var err error
+			if out[k], err = v(i); err != nil {
+				return nil, err
 			}
 		default:
 			panic(fmt.Sprintf("tfx: invalid %q attribute value type", k))
 		}
 	}
-	return rs, nil
+	return out, nil
+}
+
+// genValues returns the values of an "id" or NameKey generator. The count
+// function is called to determine the number of values for function types.
+func genValues(k string, v interface{}, count func() int) ([]string, error) {
+	switch v := v.(type) {
+	case string:
+		return []string{v}, nil
+	case []string:
+		return v, nil
+	case func(int) string:
+		out := make([]string, count())
+		for i := range out {
+			out[i] = v(i)
+		}
+		return out, nil
+	case func(int) (string, error):
+		out := make([]string, count())
+		for i := range out {
+			var err error
+			if out[i], err = v(i); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	panic(fmt.Sprintf("tfx: invalid %q attribute value type", k))
 }
 
 // provider contains information for a single provider.
@@ -355,6 +980,9 @@ func (p *provider) init() {
 		p.factory[passthroughMode] = func() (tf.ResourceProvider, error) {
 			return p.schemaProvider(passthroughMode)
 		}
+		p.factory[uniqueMode] = func() (tf.ResourceProvider, error) {
+			return p.schemaProvider(uniqueMode)
+		}
 	}
 }
 
@@ -382,6 +1010,7 @@ const (
 	defaultMode     providerMode = iota // Standard operation
 	schemaMode                          // Schema-only (no config or API calls)
 	passthroughMode                     // Schema-only and no validation
+	uniqueMode                          // Passthrough with unique computed values
 	modeCount
 )
 
@@ -409,7 +1038,11 @@ func (m providerMode) updateResource(r *schema.Resource) {
 	r.Update = noop
 	r.Delete = noop
 	r.Exists = nil
-	if m == passthroughMode {
+	switch m {
+	case uniqueMode:
+		r.Create = uniqueCreate(r)
+		fallthrough
+	case passthroughMode:
 		r.CustomizeDiff = nil
 	}
 }
@@ -424,7 +1057,7 @@ func (m providerMode) updateSchema(s *schema.Schema) {
 	default:
 		panic("tfx: unsupported schema elem type")
 	}
-	if m == passthroughMode {
+	if m >= passthroughMode {
 		s.ValidateFunc = nil
 	}
 }
@@ -435,3 +1068,27 @@ func noopCreate(r *schema.ResourceData, _ interface{}) error {
 }
 
 func noop(_ *schema.ResourceData, _ interface{}) error { return nil }
+
+// uniqueID is the last ID assigned by uniqueCreate.
+var uniqueID uint64
+
+// uniqueCreate returns a create function that assigns a unique ID to the new
+// resource and derives unique values for all unset computed string attributes,
+// such that no two resources have attribute values in common unless they are
+// copied via interpolation.
+func uniqueCreate(r *schema.Resource) schema.CreateFunc {
+	return func(d *schema.ResourceData, _ interface{}) error {
+		id := "unique-" + strconv.FormatUint(atomic.AddUint64(&uniqueID, 1), 10)
+		d.SetId(id)
+		for k, s := range r.Schema {
+			if s.Computed && s.Type == schema.TypeString {
+				if _, ok := d.GetOk(k); !ok {
+					if err := d.Set(k, id+"-"+k); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+}
@@ -1,11 +1,19 @@
 package tfx
 
 import (
+	"errors"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/hashicorp/terraform/builtin/providers/test"
+	"github.com/hashicorp/terraform/config"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/plugin/discovery"
+	tf "github.com/hashicorp/terraform/terraform"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -17,6 +25,50 @@ func TestConfig(t *testing.T) {
 	require.Equal(t, "abc", d.Get("label"))
 }
 
+func TestUnknownType(t *testing.T) {
+	var pm ProviderMap
+	pm.Add("test", "", MakeFactory(test.Provider))
+	_, err := pm.NewResource("test_unknown", "id", false)
+	require.Equal(t, ErrUnknownType("test_unknown"), err)
+	_, err = pm.MakeResources("test_unknown", AttrGen{"id": []string(nil)})
+	require.Equal(t, ErrUnknownType("test_unknown"), err)
+	_, err = pm.NewResource("test_resource", "id", false)
+	require.NoError(t, err)
+
+	s := NewState()
+	s.RootModule().Resources["test_unknown.id"] = &tf.ResourceState{
+		Type:    "test_unknown",
+		Primary: &tf.InstanceState{ID: "id"},
+	}
+	ctx := Ctx{Providers: pm}
+	d, err := ctx.Mutate(s, &MutateCfg{})
+	require.NoError(t, err)
+	require.True(t, d.Empty())
+	_, err = ctx.Mutate(s, &MutateCfg{Strict: true})
+	require.Equal(t, ErrUnknownType("test_unknown"), err)
+}
+
+func TestResourceAttr(t *testing.T) {
+	r := Resource{ResourceState: &tf.ResourceState{Primary: &tf.InstanceState{}}}
+	_, ok := r.GetAttr("id")
+	assert.False(t, ok)
+	r.SetAttr("id", "a")
+	assert.Equal(t, "a", r.Primary.ID)
+	v, ok := r.GetAttr("id")
+	assert.True(t, ok)
+	assert.Equal(t, "a", v)
+
+	r.SetNestedAttr([]string{"list", "1", "inner", "0"}, "x")
+	r.SetNestedAttr([]string{"list", "0", "attr"}, "y")
+	assert.Equal(t, map[string]string{
+		"id":             "a",
+		"list.#":         "2",
+		"list.0.attr":    "y",
+		"list.1.inner.#": "1",
+		"list.1.inner.0": "x",
+	}, r.Primary.Attributes)
+}
+
 func TestProviderFields(t *testing.T) {
 	// Changes to schema.Provider fields may require updates to providerMode
 	fields := []string{
@@ -59,3 +111,433 @@ func TestResourceFields(t *testing.T) {
 		require.Equal(t, f, r.Field(i).Name)
 	}
 }
+
+func TestVersionConstraintError(t *testing.T) {
+	var pm ProviderMap
+	pm.Add("test", "1.2.0", MakeFactory(test.Provider))
+	req := discovery.PluginRequirements{"test": &discovery.PluginConstraints{
+		Versions: discovery.ConstraintStr("~> 2.0").MustParse(),
+	}}
+	_, errs := pm.DefaultResolver().ResolveProviders(req)
+	require.Len(t, errs, 1)
+	err, ok := errs[0].(*VersionConstraintError)
+	require.True(t, ok)
+	assert.Equal(t, "test", err.Provider)
+	assert.Equal(t, "1.2.0", err.Version.String())
+	assert.False(t, err.Constraints.Allows(err.Version))
+	assert.Equal(t, `provider "test" v1.2.0 does not satisfy "~> 2.0"`, err.Error())
+
+	req["test"].Versions = discovery.ConstraintStr("~> 1.0").MustParse()
+	_, errs = pm.DefaultResolver().ResolveProviders(req)
+	require.Empty(t, errs)
+}
+
+func TestFixedFactory(t *testing.T) {
+	exists := func(*schema.ResourceData, interface{}) (bool, error) { return true, nil }
+	p := &schema.Provider{ResourcesMap: map[string]*schema.Resource{
+		"x_res": {
+			Schema: map[string]*schema.Schema{
+				"list": {
+					Type:         schema.TypeList,
+					Optional:     true,
+					Elem:         &schema.Schema{Type: schema.TypeString},
+					ValidateFunc: func(interface{}, string) ([]string, []error) { return nil, nil },
+				},
+			},
+			Exists: exists,
+		},
+	}}
+	f := FixedFactory(p)
+	a, err := f()
+	require.NoError(t, err)
+	b, err := f()
+	require.NoError(t, err)
+	assert.False(t, a == b)
+	assert.False(t, a == tf.ResourceProvider(p))
+
+	var pm ProviderMap
+	pm.Register("x", "", f).Register("test", "", MakeFactory(test.Provider))
+	_, r := pm.ResourceSchema("x_res")
+	require.NotNil(t, r)
+	for _, mode := range []providerMode{schemaMode, passthroughMode} {
+		_, err := pm.get("x").schemaProvider(mode)
+		require.NoError(t, err)
+	}
+	assert.NotNil(t, p.ResourcesMap["x_res"].Exists)
+	assert.NotNil(t, p.ResourcesMap["x_res"].Schema["list"].ValidateFunc)
+	assert.Len(t, pm, 2)
+
+	p.ConfigureFunc = func(*schema.ResourceData) (interface{}, error) {
+		return "new", nil
+	}
+	a, err = f()
+	require.NoError(t, err)
+	require.NoError(t, a.Configure(tf.NewResourceConfig(nil)))
+	assert.Equal(t, "new", a.(*schema.Provider).Meta())
+
+	p.SetMeta("configured")
+	a, err = f()
+	require.NoError(t, err)
+	assert.Equal(t, "configured", a.(*schema.Provider).Meta())
+	require.NoError(t, a.Configure(tf.NewResourceConfig(nil)))
+	assert.Equal(t, "configured", a.(*schema.Provider).Meta())
+}
+
+type closeProvider struct {
+	tf.ResourceProvider
+	closed bool
+}
+
+func (p *closeProvider) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestLimitFactoryClose(t *testing.T) {
+	cp := &closeProvider{ResourceProvider: test.Provider()}
+	f := limitFactory(func() (tf.ResourceProvider, error) {
+		return cp, nil
+	}, make(chan struct{}, 1))
+	p, err := f()
+	require.NoError(t, err)
+	c, ok := p.(tf.ResourceProviderCloser)
+	require.True(t, ok)
+	require.NoError(t, c.Close())
+	assert.True(t, cp.closed)
+
+	p, err = limitFactory(MakeFactory(test.Provider), make(chan struct{}, 1))()
+	require.NoError(t, err)
+	assert.NoError(t, p.(tf.ResourceProviderCloser).Close())
+}
+
+func TestAttrGenComputed(t *testing.T) {
+	var pm ProviderMap
+	pm.Add("test", "", MakeFactory(test.Provider))
+	src, err := pm.MakeResources("test_resource_with_custom_diff", AttrGen{
+		"id":       []string{"a", "b"},
+		"required": []string{Computed, "x"},
+	})
+	require.NoError(t, err)
+	dst, err := pm.MakeResources("test_resource", AttrGen{
+		"id":       []string{"c", "d"},
+		"required": []string{Computed, "x"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Computed, src[0].Primary.Attributes["required"])
+	assert.Equal(t, config.UnknownVariableValue, dst[0].Primary.Attributes["required"])
+
+	s := NewState()
+	for _, r := range append(src, dst...) {
+		s.RootModule().Resources[r.Key] = r.ResourceState
+	}
+	DepMap{"test_resource": {{
+		Attr:    "required",
+		SrcType: "test_resource_with_custom_diff",
+		SrcAttr: "required",
+	}}}.Infer(s)
+	assert.Empty(t, dst[0].Dependencies)
+	assert.Equal(t, []string{"test_resource_with_custom_diff.b"}, dst[1].Dependencies)
+}
+
+func TestRequired(t *testing.T) {
+	var pm ProviderMap
+	pm.Add("test", "1.2.0", MakeFactory(test.Provider))
+	cfg := loadCfg(t, `
+		provider "test" {
+			version = "~> 1.0"
+		}
+		resource "test_resource" "a" {}
+	`)
+	reqd, err := pm.Required(cfg)
+	require.NoError(t, err)
+	require.Len(t, reqd, 1)
+	assert.True(t, reqd["test"].Versions.Allows(discovery.VersionStr("1.2.0").MustParse()))
+
+	cfg = loadCfg(t, `
+		provider "test" {
+			version = "~> 2.0"
+		}
+		resource "test_resource" "a" {}
+		resource "other_resource" "b" {}
+	`)
+	reqd, err = pm.Required(cfg)
+	require.Error(t, err)
+	assert.Len(t, reqd, 2)
+	assert.Contains(t, err.Error(), `provider "other" is not available`)
+	assert.Contains(t, err.Error(), `provider "test" v1.2.0 does not satisfy "~> 2.0"`)
+}
+
+func TestFreeze(t *testing.T) {
+	var pm ProviderMap
+	assert.False(t, pm.Frozen())
+	pm.Add("test", "", MakeFactory(test.Provider))
+	pm.Freeze()
+	assert.True(t, pm.Frozen())
+	assert.Len(t, pm, 1)
+	cp := ProviderMap{"test": pm["test"]}
+	assert.False(t, cp.Frozen())
+	assert.Panics(t, func() { pm.Add("other", "", MakeFactory(test.Provider)) })
+	assert.Panics(t, func() { pm.Add("", "", MakeFactory(test.Provider)) })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, s := pm.ResourceSchema("test_resource")
+			assert.NotNil(t, s)
+			assert.Nil(t, pm.Schema("other"))
+		}()
+	}
+	wg.Wait()
+
+	var empty ProviderMap
+	empty.Freeze()
+	assert.True(t, empty.Frozen())
+	assert.Nil(t, empty.Schema("test"))
+}
+
+func TestWalkSchema(t *testing.T) {
+	r := &schema.Resource{Schema: map[string]*schema.Schema{
+		"name": {Type: schema.TypeString, Required: true},
+		"tags": {Type: schema.TypeMap, Optional: true},
+		"rule": {
+			Type:     schema.TypeList,
+			Optional: true,
+			Elem: &schema.Resource{Schema: map[string]*schema.Schema{
+				"ports": {
+					Type: schema.TypeSet,
+					Elem: &schema.Schema{Type: schema.TypeInt},
+				},
+				"cidr": {Type: schema.TypeString, Computed: true},
+			}},
+		},
+	}}
+	var have []string
+	WalkSchema(r, func(path []string, s *schema.Schema) {
+		have = append(have, strings.Join(path, ".")+":"+s.Type.String())
+	})
+	want := []string{
+		"name:TypeString",
+		"rule:TypeList",
+		"rule.*.cidr:TypeString",
+		"rule.*.ports:TypeSet",
+		"rule.*.ports.*:TypeInt",
+		"tags:TypeMap",
+	}
+	assert.Equal(t, want, have)
+}
+
+func TestResourceEqual(t *testing.T) {
+	Providers.Add("test", "", MakeFactory(test.Provider))
+	defer delete(Providers, "test")
+	r, err := Providers.MakeResources("test_resource", AttrGen{
+		"id": []string{"a", "a", "b"},
+	})
+	require.NoError(t, err)
+	r[1].Key = "test_resource.other"
+	r[0].Data().Set("set", []interface{}{"x", "y"})
+	r[0].Primary = r[0].data.State()
+	r[0].data = nil
+	for k, v := range map[string]string{
+		"set.#":   "2",
+		"set.111": "y",
+		"set.222": "x",
+	} {
+		r[1].SetAttr(k, v)
+	}
+	r[2].Primary.Attributes = r[1].Primary.Attributes
+
+	assert.True(t, r[0].Equal(r[1]))
+	assert.True(t, r[1].Equal(r[0]))
+	assert.Equal(t, r[0].Fingerprint(), r[1].Fingerprint())
+	assert.False(t, r[0].Equal(r[2]))
+	assert.NotEqual(t, r[0].Fingerprint(), r[2].Fingerprint())
+
+	r[1].SetAttr("required", "z")
+	assert.False(t, r[0].Equal(r[1]))
+	assert.NotEqual(t, r[0].Fingerprint(), r[1].Fingerprint())
+
+	u := Resource{ResourceState: &tf.ResourceState{
+		Type:    "unknown_type",
+		Primary: &tf.InstanceState{ID: "a", Attributes: map[string]string{"x": "1"}},
+	}}
+	v := Resource{ResourceState: DeepCopy(u.ResourceState).(*tf.ResourceState)}
+	assert.True(t, u.Equal(v))
+	assert.Equal(t, u.Fingerprint(), v.Fingerprint())
+}
+
+func TestMakeCountResources(t *testing.T) {
+	var pm ProviderMap
+	pm.Add("test", "", MakeFactory(test.Provider))
+	rs, err := pm.MakeCountResources("test_resource", "r", 3, AttrGen{
+		"id":       func(i int) string { return "id" + strconv.Itoa(i) },
+		"required": []string{"a", "b", "c"},
+	})
+	require.NoError(t, err)
+	require.Len(t, rs, 3)
+	for i, r := range rs {
+		assert.Equal(t, "test_resource.r."+strconv.Itoa(i), r.Key)
+		assert.Equal(t, "id"+strconv.Itoa(i), r.Primary.ID)
+		k, err := tf.ParseResourceStateKey(r.Key)
+		require.NoError(t, err)
+		assert.Equal(t, i, k.Index)
+	}
+	assert.Equal(t, "c", rs[2].Primary.Attributes["required"])
+
+	rs, err = pm.MakeCountResources("test_resource", "r", 1, AttrGen{"id": "x"})
+	require.NoError(t, err)
+	require.Len(t, rs, 1)
+	assert.Equal(t, "test_resource.r", rs[0].Key)
+
+	_, err = pm.MakeCountResources("test_resource", "r", 2, AttrGen{"id": "x"})
+	assert.Error(t, err)
+	_, err = pm.MakeCountResources("test_resource", "a.b", 1, AttrGen{"id": "x"})
+	assert.Error(t, err)
+}
+
+func TestAttrGenName(t *testing.T) {
+	var pm ProviderMap
+	pm.Add("test", "", MakeFactory(test.Provider))
+	ids := []string{"a/b", "a-b", "a:b"}
+	_, err := pm.MakeResources("test_resource", AttrGen{"id": ids})
+	assert.Error(t, err)
+
+	rs, err := pm.MakeResources("test_resource", AttrGen{
+		"id":    ids,
+		NameKey: func(i int) string { return "r/" + strconv.Itoa(i) },
+	})
+	require.NoError(t, err)
+	require.Len(t, rs, 3)
+	assert.Equal(t, "test_resource.r_0", rs[0].Key)
+	assert.Equal(t, "a/b", rs[0].Primary.ID)
+	assert.Equal(t, "test_resource.r_2", rs[2].Key)
+	assert.NotContains(t, rs[0].Primary.Attributes, NameKey)
+
+	_, err = pm.MakeResources("test_resource", AttrGen{
+		"id":    ids,
+		NameKey: []string{"x", "y", "x"},
+	})
+	assert.Error(t, err)
+}
+
+func TestAttrGenCompositeID(t *testing.T) {
+	var pm ProviderMap
+	pm.Add("test", "", MakeFactory(test.Provider))
+	rs, err := pm.MakeResources("test_resource", AttrGen{
+		"#":        2,
+		"required": []string{"a", "b"},
+		"optional": func(i int) string { return "rg" + strconv.Itoa(i) },
+		"id": func(i int, attrs map[string]string) string {
+			return "/groups/" + attrs["optional"] + "/res/" + attrs["required"]
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, rs, 2)
+	assert.Equal(t, "/groups/rg0/res/a", rs[0].Primary.ID)
+	assert.Equal(t, "/groups/rg1/res/b", rs[1].Primary.ID)
+	assert.Equal(t, "/groups/rg1/res/b", rs[1].Primary.Attributes["id"])
+	assert.Equal(t, "rg1", rs[1].Primary.Attributes["optional"])
+}
+
+func TestAttrGenError(t *testing.T) {
+	var pm ProviderMap
+	pm.Add("test", "", MakeFactory(test.Provider))
+	errGen := errors.New("gen")
+	gen := func(i int) (string, error) {
+		if i == 1 {
+			return "", errGen
+		}
+		return strconv.Itoa(i), nil
+	}
+	rs, err := pm.MakeResources("test_resource", AttrGen{
+		"#":        1,
+		"id":       gen,
+		"required": gen,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "0", rs[0].Primary.ID)
+	assert.Equal(t, "0", rs[0].Primary.Attributes["required"])
+
+	_, err = pm.MakeResources("test_resource", AttrGen{"#": 2, "id": gen})
+	assert.Equal(t, errGen, err)
+	_, err = pm.MakeResources("test_resource", AttrGen{
+		"id":       []string{"a", "b"},
+		"required": gen,
+	})
+	assert.Equal(t, errGen, err)
+}
+
+func TestMigrateResource(t *testing.T) {
+	var calls int
+	var pm ProviderMap
+	pm.Add("test", "", func() (tf.ResourceProvider, error) {
+		p := test.Provider().(*schema.Provider)
+		p.ResourcesMap["test_migrate"] = &schema.Resource{
+			SchemaVersion: 1,
+			Schema: map[string]*schema.Schema{
+				"new": {Type: schema.TypeString, Optional: true},
+			},
+			MigrateState: func(v int, is *tf.InstanceState, _ interface{}) (*tf.InstanceState, error) {
+				calls++
+				if v != 0 {
+					return nil, errors.New("bad version")
+				}
+				is.Attributes["new"] = is.Attributes["old"]
+				delete(is.Attributes, "old")
+				return is, nil
+			},
+		}
+		return p, nil
+	})
+	r := Resource{Key: "test_migrate.a", ResourceState: &tf.ResourceState{
+		Type: "test_migrate",
+		Primary: &tf.InstanceState{ID: "a", Attributes: map[string]string{
+			"id":  "a",
+			"old": "x",
+		}},
+	}}
+	orig := r.Primary
+	require.NoError(t, pm.MigrateResource(&r))
+	assert.Equal(t, map[string]string{"id": "a", "new": "x"}, r.Primary.Attributes)
+	assert.Equal(t, "1", r.Primary.Meta["schema_version"])
+	assert.Equal(t, "x", orig.Attributes["old"])
+	require.NoError(t, pm.MigrateResource(&r))
+	assert.Equal(t, 1, calls)
+
+	r, err := pm.NewResource("test_migrate", "b", false)
+	require.NoError(t, err)
+	require.NoError(t, pm.MigrateResource(&r))
+	assert.Equal(t, 1, calls)
+
+	r.Type = "test_unknown"
+	assert.Equal(t, ErrUnknownType("test_unknown"), pm.MigrateResource(&r))
+}
+
+func TestRegisterProvider(t *testing.T) {
+	deps := Deps
+	Deps = make(DepMap)
+	defer func() { Deps = deps }()
+	spec := []DepSpec{{Attr: "required", SrcType: "test_resource", SrcAttr: "id"}}
+	names := []string{"test1", "test2", "test3", "test4"}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			RegisterProvider(name, "", MakeFactory(test.Provider),
+				DepMap{"test_resource": spec})
+		}(name)
+	}
+	wg.Wait()
+	for _, name := range names {
+		assert.Contains(t, Providers, name)
+		delete(Providers, name)
+	}
+	assert.Equal(t, DepMap{"test_resource": spec}, Deps)
+	assert.Panics(t, func() {
+		RegisterProvider("test1", "", nil, nil)
+		RegisterProvider("test1", "", nil, nil)
+	})
+	delete(Providers, "test1")
+}
@@ -0,0 +1,282 @@
+package tfx
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+// LoadSchemaJSON reads the output of 'terraform providers schema -json' and
+// returns resource schemas for all providers, indexed by resource type. Data
+// sources are ignored. The schemas are suitable for schema-only operations,
+// such as attribute lookups and WalkSchema, but do not implement any CRUD
+// functions. Number attributes are converted to TypeFloat. Single and group
+// nested blocks become lists with MaxItems set to 1. Nested blocks with map
+// nesting mode cannot be represented and cause an error.
+func LoadSchemaJSON(r io.Reader) (map[string]*schema.Resource, error) {
+	var v struct {
+		FormatVersion   string `json:"format_version"`
+		ProviderSchemas map[string]struct {
+			ResourceSchemas map[string]struct {
+				Version int             `json:"version"`
+				Block   jsonSchemaBlock `json:"block"`
+			} `json:"resource_schemas"`
+		} `json:"provider_schemas"`
+	}
+	if err := json.NewDecoder(r).Decode(&v); err != nil {
+		return nil, err
+	}
+	if v.FormatVersion == "" {
+		return nil, fmt.Errorf("tfx: missing schema format_version")
+	}
+	out := make(map[string]*schema.Resource)
+	for _, p := range v.ProviderSchemas {
+		for typ, rs := range p.ResourceSchemas {
+			r, err := rs.Block.resource(typ)
+			if err != nil {
+				return nil, err
+			}
+			r.SchemaVersion = rs.Version
+			out[typ] = r
+		}
+	}
+	return out, nil
+}
+
+// jsonSchemaBlock is the JSON representation of a configuration block schema.
+type jsonSchemaBlock struct {
+	Attributes map[string]struct {
+		Type      json.RawMessage `json:"type"`
+		Required  bool            `json:"required"`
+		Optional  bool            `json:"optional"`
+		Computed  bool            `json:"computed"`
+		Sensitive bool            `json:"sensitive"`
+	} `json:"attributes"`
+	BlockTypes map[string]struct {
+		NestingMode string          `json:"nesting_mode"`
+		Block       jsonSchemaBlock `json:"block"`
+		MinItems    int             `json:"min_items"`
+		MaxItems    int             `json:"max_items"`
+	} `json:"block_types"`
+}
+
+// resource converts block b into a resource schema. Path is used for error
+// messages.
+func (b *jsonSchemaBlock) resource(path string) (*schema.Resource, error) {
+	m := make(map[string]*schema.Schema, len(b.Attributes)+len(b.BlockTypes))
+	for k, a := range b.Attributes {
+		s, err := jsonSchemaType(path+"."+k, a.Type)
+		if err != nil {
+			return nil, err
+		}
+		s.Required = a.Required
+		s.Optional = a.Optional
+		s.Computed = a.Computed || (!a.Required && !a.Optional)
+		s.Sensitive = a.Sensitive
+		m[k] = s
+	}
+	for k, bt := range b.BlockTypes {
+		s := &schema.Schema{
+			Required: bt.MinItems > 0,
+			Optional: bt.MinItems == 0,
+			MinItems: bt.MinItems,
+			MaxItems: bt.MaxItems,
+		}
+		switch bt.NestingMode {
+		case "single", "group":
+			s.Type, s.MaxItems = schema.TypeList, 1
+		case "list":
+			s.Type = schema.TypeList
+		case "set":
+			s.Type = schema.TypeSet
+		default:
+			return nil, fmt.Errorf("tfx: unsupported nesting mode %q for %s",
+				bt.NestingMode, path+"."+k)
+		}
+		r, err := bt.Block.resource(path + "." + k)
+		if err != nil {
+			return nil, err
+		}
+		s.Elem = r
+		m[k] = s
+	}
+	return &schema.Resource{Schema: m}, nil
+}
+
+// jsonSchemaType converts a JSON-encoded attribute type (e.g. "string" or
+// ["list","string"]) into a schema without any behavior flags set.
+func jsonSchemaType(path string, raw json.RawMessage) (*schema.Schema, error) {
+	var prim string
+	if json.Unmarshal(raw, &prim) == nil {
+		switch prim {
+		case "string", "dynamic":
+			return &schema.Schema{Type: schema.TypeString}, nil
+		case "number":
+			return &schema.Schema{Type: schema.TypeFloat}, nil
+		case "bool":
+			return &schema.Schema{Type: schema.TypeBool}, nil
+		}
+		return nil, fmt.Errorf("tfx: unsupported type %q for %s", prim, path)
+	}
+	var pair []json.RawMessage
+	if err := json.Unmarshal(raw, &pair); err != nil || len(pair) != 2 {
+		return nil, fmt.Errorf("tfx: invalid type %s for %s", raw, path)
+	}
+	var kind string
+	if err := json.Unmarshal(pair[0], &kind); err != nil {
+		return nil, fmt.Errorf("tfx: invalid type %s for %s", raw, path)
+	}
+	s := new(schema.Schema)
+	switch kind {
+	case "list":
+		s.Type = schema.TypeList
+	case "set":
+		s.Type = schema.TypeSet
+	case "map":
+		s.Type = schema.TypeMap
+	case "object":
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(pair[1], &attrs); err != nil {
+			return nil, fmt.Errorf("tfx: invalid type %s for %s", raw, path)
+		}
+		r := &schema.Resource{Schema: make(map[string]*schema.Schema, len(attrs))}
+		for k, t := range attrs {
+			e, err := jsonSchemaType(path+"."+k, t)
+			if err != nil {
+				return nil, err
+			}
+			e.Optional = true
+			r.Schema[k] = e
+		}
+		return &schema.Schema{Type: schema.TypeList, MaxItems: 1, Elem: r}, nil
+	default:
+		return nil, fmt.Errorf("tfx: unsupported type %s for %s", raw, path)
+	}
+	e, err := jsonSchemaType(path, pair[1])
+	if err != nil {
+		return nil, err
+	}
+	if s.Elem = e; e.Type == schema.TypeList && e.MaxItems == 1 {
+		if r, ok := e.Elem.(*schema.Resource); ok {
+			s.Elem = r // Collection of objects
+		}
+	}
+	return s, nil
+}
+
+// ResourceJSONSchema returns a JSON Schema (draft-07) document describing the
+// configuration of resource r. Lists and sets become arrays, maps become objects
+// with additionalProperties, and nested resources become objects that do not
+// allow any unknown properties. Computed-only attributes are marked read-only.
+func ResourceJSONSchema(r *schema.Resource) ([]byte, error) {
+	root := newJSONSchemaObject()
+	root.Schema = "http://json-schema.org/draft-07/schema#"
+	nodes := map[string]*jsonSchemaNode{"": root}
+	var err error
+	WalkSchema(r, func(path []string, s *schema.Schema) {
+		if err != nil {
+			return
+		}
+		var n *jsonSchemaNode
+		if n, err = newJSONSchemaNode(path, s); err != nil {
+			return
+		}
+		k := strings.Join(path, ".")
+		nodes[k] = n
+		if _, ok := s.Elem.(*schema.Resource); ok {
+			obj := newJSONSchemaObject()
+			n.setElem(obj)
+			nodes[k+".*"] = obj
+		}
+		last := len(path) - 1
+		parent := nodes[strings.Join(path[:last], ".")]
+		if path[last] == "*" {
+			parent.setElem(n)
+			return
+		}
+		parent.Properties[path[last]] = n
+		if s.Required {
+			parent.Required = append(parent.Required, path[last])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(root)
+}
+
+// jsonSchemaNode is a subset of JSON Schema used by ResourceJSONSchema.
+type jsonSchemaNode struct {
+	Schema               string                     `json:"$schema,omitempty"`
+	Type                 string                     `json:"type"`
+	Description          string                     `json:"description,omitempty"`
+	Properties           map[string]*jsonSchemaNode `json:"properties,omitempty"`
+	Required             []string                   `json:"required,omitempty"`
+	AdditionalProperties interface{}                `json:"additionalProperties,omitempty"`
+	Items                *jsonSchemaNode            `json:"items,omitempty"`
+	MinItems             int                        `json:"minItems,omitempty"`
+	MaxItems             int                        `json:"maxItems,omitempty"`
+	UniqueItems          bool                       `json:"uniqueItems,omitempty"`
+	Default              interface{}                `json:"default,omitempty"`
+	ReadOnly             bool                       `json:"readOnly,omitempty"`
+	Deprecated           bool                       `json:"deprecated,omitempty"`
+}
+
+// newJSONSchemaObject returns a node for a nested resource.
+func newJSONSchemaObject() *jsonSchemaNode {
+	return &jsonSchemaNode{
+		Type:                 "object",
+		Properties:           make(map[string]*jsonSchemaNode),
+		AdditionalProperties: false,
+	}
+}
+
+// newJSONSchemaNode converts attribute schema s into a JSON Schema node without
+// any element or property information. Path is used for error messages.
+func newJSONSchemaNode(path []string, s *schema.Schema) (*jsonSchemaNode, error) {
+	n := &jsonSchemaNode{
+		Description: s.Description,
+		Default:     s.Default,
+		ReadOnly:    s.Computed && !s.Optional && !s.Required,
+		Deprecated:  s.Deprecated != "" || s.Removed != "",
+	}
+	switch s.Type {
+	case schema.TypeBool:
+		n.Type = "boolean"
+	case schema.TypeInt:
+		n.Type = "integer"
+	case schema.TypeFloat:
+		n.Type = "number"
+	case schema.TypeString:
+		n.Type = "string"
+	case schema.TypeList, schema.TypeSet:
+		n.Type = "array"
+		n.MinItems, n.MaxItems = s.MinItems, s.MaxItems
+		n.UniqueItems = s.Type == schema.TypeSet
+		if s.Elem == nil {
+			return nil, fmt.Errorf("tfx: missing element type for %s",
+				strings.Join(path, "."))
+		}
+	case schema.TypeMap:
+		n.Type = "object"
+		if s.Elem == nil {
+			n.AdditionalProperties = &jsonSchemaNode{Type: "string"}
+		}
+	default:
+		return nil, fmt.Errorf("tfx: unsupported type %v for %s", s.Type,
+			strings.Join(path, "."))
+	}
+	return n, nil
+}
+
+// setElem sets the element schema of an array or map node.
+func (n *jsonSchemaNode) setElem(e *jsonSchemaNode) {
+	if n.Type == "array" {
+		n.Items = e
+	} else {
+		n.AdditionalProperties = e
+	}
+}
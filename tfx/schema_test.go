@@ -0,0 +1,138 @@
+package tfx
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSchemaJSON(t *testing.T) {
+	const js = `{
+		"format_version": "0.1",
+		"provider_schemas": {
+			"x": {
+				"resource_schemas": {
+					"x_res": {
+						"version": 1,
+						"block": {
+							"attributes": {
+								"id": {"type": "string", "optional": true, "computed": true},
+								"name": {"type": "string", "required": true},
+								"port": {"type": "number", "optional": true},
+								"arn": {"type": "string", "computed": true},
+								"tags": {"type": ["map", "string"], "optional": true},
+								"rules": {"type": ["list", ["object", {"cidr": "string"}]], "optional": true}
+							},
+							"block_types": {
+								"config": {
+									"nesting_mode": "set",
+									"min_items": 1,
+									"block": {"attributes": {"key": {"type": "string", "sensitive": true, "optional": true}}}
+								},
+								"timeouts": {"nesting_mode": "single", "block": {}}
+							}
+						}
+					}
+				},
+				"data_source_schemas": {"x_data": {"block": {}}}
+			}
+		}
+	}`
+	m, err := LoadSchemaJSON(strings.NewReader(js))
+	require.NoError(t, err)
+	require.Len(t, m, 1)
+	r := m["x_res"]
+	require.NotNil(t, r)
+	assert.Equal(t, 1, r.SchemaVersion)
+
+	var have []string
+	WalkSchema(r, func(path []string, s *schema.Schema) {
+		have = append(have, strings.Join(path, ".")+":"+s.Type.String())
+	})
+	assert.Equal(t, []string{
+		"arn:TypeString",
+		"config:TypeSet",
+		"config.*.key:TypeString",
+		"id:TypeString",
+		"name:TypeString",
+		"port:TypeFloat",
+		"rules:TypeList",
+		"rules.*.cidr:TypeString",
+		"tags:TypeMap",
+		"tags.*:TypeString",
+		"timeouts:TypeList",
+	}, have)
+
+	s := r.Schema
+	assert.True(t, s["name"].Required)
+	assert.True(t, s["arn"].Computed)
+	assert.True(t, s["id"].Optional && s["id"].Computed)
+	assert.True(t, s["config"].Required)
+	assert.True(t, s["config"].Elem.(*schema.Resource).Schema["key"].Sensitive)
+	assert.Equal(t, 1, s["timeouts"].MaxItems)
+
+	_, err = LoadSchemaJSON(strings.NewReader(`{}`))
+	assert.Error(t, err)
+	_, err = LoadSchemaJSON(strings.NewReader(`{"format_version": "0.1",
+		"provider_schemas": {"x": {"resource_schemas": {"x_res": {"block": {
+		"block_types": {"m": {"nesting_mode": "map", "block": {}}}}}}}}}`))
+	assert.EqualError(t, err, `tfx: unsupported nesting mode "map" for x_res.m`)
+}
+
+func TestResourceJSONSchema(t *testing.T) {
+	r := &schema.Resource{Schema: map[string]*schema.Schema{
+		"name": {Type: schema.TypeString, Required: true, Description: "Name"},
+		"arn":  {Type: schema.TypeString, Computed: true},
+		"port": {Type: schema.TypeInt, Optional: true, Default: 80},
+		"tags": {Type: schema.TypeMap, Optional: true},
+		"ids": {
+			Type:     schema.TypeSet,
+			Optional: true,
+			Elem:     &schema.Schema{Type: schema.TypeString},
+		},
+		"block": {
+			Type:     schema.TypeList,
+			Optional: true,
+			MaxItems: 1,
+			Elem: &schema.Resource{Schema: map[string]*schema.Schema{
+				"on": {Type: schema.TypeBool, Required: true},
+			}},
+		},
+	}}
+	b, err := ResourceJSONSchema(r)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"type": "object",
+		"additionalProperties": false,
+		"required": ["name"],
+		"properties": {
+			"arn": {"type": "string", "readOnly": true},
+			"block": {
+				"type": "array",
+				"maxItems": 1,
+				"items": {
+					"type": "object",
+					"additionalProperties": false,
+					"required": ["on"],
+					"properties": {"on": {"type": "boolean"}}
+				}
+			},
+			"ids": {
+				"type": "array",
+				"uniqueItems": true,
+				"items": {"type": "string"}
+			},
+			"name": {"type": "string", "description": "Name"},
+			"port": {"type": "integer", "default": 80},
+			"tags": {"type": "object", "additionalProperties": {"type": "string"}}
+		}
+	}`, string(b))
+
+	r.Schema["bad"] = &schema.Schema{Type: schema.TypeList, Optional: true}
+	_, err = ResourceJSONSchema(r)
+	assert.Error(t, err)
+}
@@ -1,14 +1,22 @@
 package tfx
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/state"
 	tf "github.com/hashicorp/terraform/terraform"
 	"github.com/mitchellh/copystructure"
@@ -29,18 +37,378 @@ func NewState() *tf.State {
 	return s
 }
 
-// ReadStateFile reads Terraform state from the specified file.
+// ReadStateFile reads Terraform state from the specified file. It supports both
+// the native state format and the JSON representation produced by 'terraform
+// show -json' (see ReadStateJSON). The file may be an http or https URL.
 func ReadStateFile(file string) (*tf.State, error) {
 	r, err := open(file)
 	if err != nil {
 		return nil, err
 	}
 	defer r.Close()
-	return tf.ReadState(r)
+	b := bufio.NewReader(r)
+	if v, _ := b.Peek(64); bytes.Contains(v, []byte(`"format_version"`)) {
+		return ReadStateJSON(b)
+	}
+	return tf.ReadState(b)
+}
+
+// ReadStateWithBackup reads Terraform state from file and its "<file>.backup"
+// sibling and returns the state with the higher serial number, along with the
+// name of the file that it was read from. A file that is missing or cannot be
+// parsed is ignored as long as the other one is read successfully. Otherwise,
+// the error for the primary file is returned.
+func ReadStateWithBackup(file string) (*tf.State, string, error) {
+	backup := file + ".backup"
+	s, err := ReadStateFile(file)
+	b, berr := ReadStateFile(backup)
+	switch {
+	case berr != nil:
+		return s, file, err
+	case err != nil || s.Serial < b.Serial:
+		return b, backup, nil
+	}
+	return s, file, nil
+}
+
+// ReadStateDir reads all "*.tfstate" files in dir and merges them into a single
+// state. Backup and unnamed files are skipped. The contents of each file are
+// namespaced by moving them into a module named after the file, without the
+// extension and normalized in the same way as resource names. For example,
+// resource "a.b" in the root module of "prod-1.tfstate" becomes
+// "module.prod-1.a.b", and module "m" becomes "module.prod-1.module.m". The
+// root module of the merged state is empty. Since normalization is lossy (e.g.
+// "acct 2" becomes "acct_2"), the returned map gives the path of the file that
+// was read into each module. Use ExtractModule to reverse the operation for any
+// one file. Dangling resource dependencies within a file are logged.
+func ReadStateDir(dir string) (*tf.State, map[string]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tfstate"))
+	if err != nil {
+		return nil, nil, err
+	}
+	out := NewState()
+	names := make(map[string]string, len(files))
+	for _, file := range files {
+		base := filepath.Base(file)
+		name := strings.TrimSuffix(base, ".tfstate")
+		if name == "" {
+			continue
+		}
+		name = makeName(name)
+		if other, dup := names[name]; dup {
+			return nil, nil, fmt.Errorf(
+				"tfx: %q and %q map to the same module %q",
+				filepath.Base(other), base, name)
+		}
+		names[name] = file
+		s, err := ReadStateFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, m := range s.Modules {
+			m.Path = append([]string{"root", name}, m.Path[1:]...)
+		}
+		_, dangling := MergeStates(out, s, nil)
+		for _, d := range dangling {
+			log.Printf("[WARN] tfx: %s: dangling dependency of %s on %s",
+				base, d.Addr, d.Dep)
+		}
+	}
+	return out, names, nil
+}
+
+// WalkStateResources calls fn for each resource in a native (version 3) state
+// file. Resources are decoded one at a time, so the entire state is never held
+// in memory. Resource states passed to fn are not upgraded or validated the way
+// that tf.ReadState would. The JSON representation produced by 'terraform show
+// -json' is not supported. If fn returns an error, the walk stops and that
+// error is returned.
+func WalkStateResources(file string, fn func(path []string, key string, r *tf.ResourceState) error) error {
+	f, err := open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	return walkJSONObject(dec, func(k string) error {
+		switch k {
+		case "version":
+			var v int
+			if err := dec.Decode(&v); err != nil {
+				return err
+			}
+			if v != tf.StateVersion {
+				return fmt.Errorf("tfx: unsupported state version %d", v)
+			}
+			return nil
+		case "modules":
+			return walkJSONArray(dec, func() error {
+				return walkStateModule(dec, fn)
+			})
+		}
+		var skip json.RawMessage
+		return dec.Decode(&skip)
+	})
 }
 
-// WriteStateFile writes Terraform state to the specified file.
+// CountResources returns the number of resources in a native state file. See
+// WalkStateResources.
+func CountResources(file string) (n int, err error) {
+	err = WalkStateResources(file, func([]string, string, *tf.ResourceState) error {
+		n++
+		return nil
+	})
+	return
+}
+
+// walkStateModule decodes one module from dec and calls fn for each resource.
+func walkStateModule(dec *json.Decoder, fn func([]string, string, *tf.ResourceState) error) error {
+	var path []string
+	var pending map[string]json.RawMessage
+	err := walkJSONObject(dec, func(k string) error {
+		switch k {
+		case "path":
+			return dec.Decode(&path)
+		case "resources":
+			if path == nil {
+				// Path normally comes first, but it isn't guaranteed
+				return dec.Decode(&pending)
+			}
+			return walkJSONObject(dec, func(key string) error {
+				r := new(tf.ResourceState)
+				if err := dec.Decode(r); err != nil {
+					return err
+				}
+				return fn(path, key, r)
+			})
+		}
+		var skip json.RawMessage
+		return dec.Decode(&skip)
+	})
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+	keys := make([]string, 0, len(pending))
+	for k := range pending {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		r := new(tf.ResourceState)
+		if err = json.Unmarshal(pending[k], r); err == nil {
+			err = fn(path, k, r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkJSONObject reads an object from dec and calls fn for each key. Fn must
+// consume the value.
+func walkJSONObject(dec *json.Decoder, fn func(key string) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if err = fn(tok.(string)); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// walkJSONArray reads an array from dec and calls fn for each element. Fn must
+// consume the element.
+func walkJSONArray(dec *json.Decoder, fn func() error) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	for dec.More() {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+// expectDelim reads the next token from dec and verifies that it is d.
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	tok, err := dec.Token()
+	if err == nil && tok != d {
+		err = fmt.Errorf("tfx: expected %v in JSON, found %v", d, tok)
+	}
+	return err
+}
+
+// ReadStateJSON reads state in the format produced by 'terraform show -json'
+// and converts it to the native representation. The conversion is lossy:
+// outputs, deposed and tainted status, lineage, and serial are discarded;
+// null attribute values are omitted; set elements are indexed by position
+// rather than hash; and resources using for_each (string indices) are not
+// supported. Resource values are flattened into primary instance attributes,
+// with the "id" attribute used as the instance ID.
+func ReadStateJSON(r io.Reader) (*tf.State, error) {
+	var js struct {
+		FormatVersion string `json:"format_version"`
+		Values        struct {
+			RootModule jsonModule `json:"root_module"`
+		} `json:"values"`
+	}
+	if err := json.NewDecoder(r).Decode(&js); err != nil {
+		return nil, err
+	}
+	if js.FormatVersion == "" {
+		return nil, fmt.Errorf("tfx: missing JSON state format version")
+	}
+	s := NewState()
+	if err := js.Values.RootModule.addTo(s, tf.RootModulePath); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// jsonModule is a module in 'terraform show -json' output.
+type jsonModule struct {
+	Address   string `json:"address"`
+	Resources []struct {
+		Address       string                 `json:"address"`
+		Mode          string                 `json:"mode"`
+		Type          string                 `json:"type"`
+		Name          string                 `json:"name"`
+		Index         interface{}            `json:"index"`
+		ProviderName  string                 `json:"provider_name"`
+		SchemaVersion int                    `json:"schema_version"`
+		Values        map[string]interface{} `json:"values"`
+		DependsOn     []string               `json:"depends_on"`
+	} `json:"resources"`
+	ChildModules []*jsonModule `json:"child_modules"`
+}
+
+// addTo converts module resources and adds them to state s.
+func (jm *jsonModule) addTo(s *tf.State, path []string) error {
+	m := s.ModuleByPath(path)
+	if m == nil {
+		m = s.AddModule(path)
+	}
+	prefix := ""
+	if jm.Address != "" {
+		prefix = jm.Address + "."
+	}
+	for _, jr := range jm.Resources {
+		sk := tf.ResourceStateKey{Name: jr.Name, Type: jr.Type, Index: -1}
+		switch jr.Mode {
+		case "managed":
+			sk.Mode = config.ManagedResourceMode
+		case "data":
+			sk.Mode = config.DataResourceMode
+		default:
+			return fmt.Errorf("tfx: invalid mode for %q: %q", jr.Address, jr.Mode)
+		}
+		switch i := jr.Index.(type) {
+		case nil:
+		case float64:
+			sk.Index = int(i)
+		default:
+			return fmt.Errorf("tfx: unsupported index for %q: %v", jr.Address, i)
+		}
+		attrs := make(map[string]string, len(jr.Values))
+		flattenJSON(attrs, "", jr.Values)
+		var meta map[string]interface{}
+		if jr.SchemaVersion > 0 {
+			meta = map[string]interface{}{
+				"schema_version": strconv.Itoa(jr.SchemaVersion),
+			}
+		}
+		provider := jr.ProviderName
+		if i := strings.LastIndexByte(provider, '/'); i >= 0 {
+			provider = provider[i+1:] // Strip registry host and namespace
+		}
+		var deps []string
+		for _, dep := range jr.DependsOn {
+			if strings.HasPrefix(dep, prefix) {
+				dep = dep[len(prefix):]
+			}
+			if !strings.HasPrefix(dep, "module.") {
+				dep = strings.TrimSuffix(strings.Replace(dep, "[", ".", 1), "]")
+			}
+			deps = append(deps, dep)
+		}
+		m.Resources[sk.String()] = &tf.ResourceState{
+			Type:         jr.Type,
+			Dependencies: deps,
+			Primary: &tf.InstanceState{
+				ID:         attrs["id"],
+				Attributes: attrs,
+				Meta:       meta,
+			},
+			Provider: "provider." + provider,
+		}
+	}
+	for _, c := range jm.ChildModules {
+		name := strings.TrimPrefix(c.Address[strings.LastIndex(c.Address, "module."):], "module.")
+		child := make([]string, len(path), len(path)+1)
+		copy(child, path)
+		if err := c.addTo(s, append(child, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flattenJSON converts a JSON value into flatmap attributes. Objects that are
+// list elements are treated as nested blocks, which do not have a "%" count.
+// All other objects are treated as maps.
+func flattenJSON(attrs map[string]string, k string, v interface{}) {
+	flattenJSONHelper(attrs, k, v, false)
+}
+
+func flattenJSONHelper(attrs map[string]string, k string, v interface{}, elem bool) {
+	if k != "" {
+		k += "."
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if k != "" && !elem {
+			attrs[k+"%"] = strconv.Itoa(len(v))
+		}
+		for name, e := range v {
+			flattenJSONHelper(attrs, k+name, e, false)
+		}
+		return
+	case []interface{}:
+		attrs[k+"#"] = strconv.Itoa(len(v))
+		for i, e := range v {
+			flattenJSONHelper(attrs, k+strconv.Itoa(i), e, true)
+		}
+		return
+	case nil:
+		return
+	}
+	k = strings.TrimSuffix(k, ".")
+	switch v := v.(type) {
+	case string:
+		attrs[k] = v
+	case bool:
+		attrs[k] = strconv.FormatBool(v)
+	case float64:
+		attrs[k] = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		panic(fmt.Sprintf("tfx: unexpected JSON value type %T", v))
+	}
+}
+
+// WriteStateFile writes Terraform state to the specified file ("-" means
+// stdout).
 func WriteStateFile(file string, s *tf.State) error {
+	if file == "" {
+		return errNoPath
+	}
 	if isStdio(file) {
 		return tf.WriteState(s, os.Stdout)
 	}
@@ -66,6 +434,76 @@ func AddState(a, b *tf.State) *tf.State {
 	return a
 }
 
+// MergeOpts controls MergeStates behavior. If FixDeps is true, dangling
+// dependencies of resources copied from b are removed.
+type MergeOpts struct{ FixDeps bool }
+
+// DanglingDep is a resource dependency that does not refer to any resource in
+// the same module. Addr is the resource address, formatted as in ExplainDiff.
+type DanglingDep struct{ Addr, Dep string }
+
+// MergeStates is like AddState, but it also checks the dependencies of all
+// resources copied from b against the merged modules of a, as in PruneDeps.
+// A dependency is dangling if neither a nor b contain the resource that it
+// refers to, which happens when b is a partial state (e.g. one extracted or
+// filtered from a larger state). All dangling dependencies are returned, sorted
+// by address. Resources that were already in a are not checked or modified.
+func MergeStates(a, b *tf.State, opts *MergeOpts) (*tf.State, []DanglingDep) {
+	type copied struct {
+		m    *tf.ModuleState
+		keys []string
+	}
+	var all []copied
+	for _, bm := range b.Modules {
+		am := a.ModuleByPath(bm.Path)
+		if am == nil {
+			am = DeepCopy(bm).(*tf.ModuleState)
+			a.AddModuleState(am)
+			c := copied{am, make([]string, 0, len(am.Resources))}
+			for k := range am.Resources {
+				c.keys = append(c.keys, k)
+			}
+			all = append(all, c)
+			continue
+		}
+		c := copied{m: am}
+		for k, r := range bm.Resources {
+			if am.Resources[k] == nil {
+				am.Resources[k] = DeepCopy(r).(*tf.ResourceState)
+				c.keys = append(c.keys, k)
+			}
+		}
+		all = append(all, c)
+	}
+	var dangling []DanglingDep
+	for _, c := range all {
+		var multi map[string]bool
+		prefix := modulePrefix(c.m.Path)
+		for _, k := range c.keys {
+			r := c.m.Resources[k]
+			keep := r.Dependencies[:0]
+			for _, dep := range r.Dependencies {
+				if validDep(c.m, &multi, dep) {
+					keep = append(keep, dep)
+				} else {
+					dangling = append(dangling, DanglingDep{prefix + k, dep})
+					if opts == nil || !opts.FixDeps {
+						keep = append(keep, dep)
+					}
+				}
+			}
+			r.Dependencies = keep
+		}
+	}
+	sort.Slice(dangling, func(i, j int) bool {
+		if dangling[i].Addr != dangling[j].Addr {
+			return dangling[i].Addr < dangling[j].Addr
+		}
+		return dangling[i].Dep < dangling[j].Dep
+	})
+	return a, dangling
+}
+
 // SubState performs 'a -= b' operation on resources in a.
 func SubState(a, b *tf.State) *tf.State {
 	for _, bm := range b.Modules {
@@ -78,6 +516,68 @@ func SubState(a, b *tf.State) *tf.State {
 	return a
 }
 
+// Census returns the number of resources of each type in all modules of s.
+// Data resource types have a "data." prefix. Resources with a count are
+// counted once per instance.
+func Census(s *tf.State) map[string]int {
+	out := make(map[string]int)
+	for _, m := range s.Modules {
+		census(out, m)
+	}
+	return out
+}
+
+// CensusByModule is like Census, but the counts are grouped by module address
+// (e.g. "module.a.module.b"). The root module address is an empty string.
+// Modules without any resources are omitted.
+func CensusByModule(s *tf.State) map[string]map[string]int {
+	out := make(map[string]map[string]int)
+	for _, m := range s.Modules {
+		if len(m.Resources) > 0 {
+			addr := strings.TrimSuffix(modulePrefix(m.Path), ".")
+			if out[addr] == nil {
+				out[addr] = make(map[string]int)
+			}
+			census(out[addr], m)
+		}
+	}
+	return out
+}
+
+// TypeCount is the number of resources of one type.
+type TypeCount struct {
+	Type  string
+	Count int
+}
+
+// CensusSorted returns Census results sorted by count in descending order, with
+// ties sorted by type.
+func CensusSorted(s *tf.State) []TypeCount {
+	c := Census(s)
+	out := make([]TypeCount, 0, len(c))
+	for typ, n := range c {
+		out = append(out, TypeCount{typ, n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Type < out[j].Type
+	})
+	return out
+}
+
+// census adds resource type counts of module m to out.
+func census(out map[string]int, m *tf.ModuleState) {
+	for k, r := range m.Resources {
+		typ := r.Type
+		if strings.HasPrefix(k, "data.") {
+			typ = "data." + typ
+		}
+		out[typ]++
+	}
+}
+
 // ClearDeps clears all resource dependencies.
 func ClearDeps(s *tf.State) {
 	for _, m := range s.Modules {
@@ -87,14 +587,203 @@ func ClearDeps(s *tf.State) {
 	}
 }
 
+// PruneDeps removes resource dependencies that refer to resources missing from
+// the same module, keeping all valid dependencies intact. A "type.name.*"
+// dependency is valid if there is at least one "type.name" or "type.name.N"
+// resource. Module dependencies ("module.name") are not checked.
+func PruneDeps(s *tf.State) {
+	for _, m := range s.Modules {
+		var multi map[string]bool
+		for _, r := range m.Resources {
+			keep := r.Dependencies[:0]
+			for _, dep := range r.Dependencies {
+				if validDep(m, &multi, dep) {
+					keep = append(keep, dep)
+				}
+			}
+			r.Dependencies = keep
+		}
+	}
+}
+
+// validDep returns true if dep is a module dependency or refers to a resource
+// in m. Multi is initialized on first use with the "type.name" prefixes of all
+// resources in m for checking "type.name.*" dependencies.
+func validDep(m *tf.ModuleState, multi *map[string]bool, dep string) bool {
+	if strings.HasPrefix(dep, "module.") || m.Resources[dep] != nil {
+		return true
+	}
+	if !strings.HasSuffix(dep, ".*") {
+		return false
+	}
+	if *multi == nil {
+		*multi = make(map[string]bool, len(m.Resources))
+		for k := range m.Resources {
+			if sk, err := tf.ParseResourceStateKey(k); err == nil {
+				sk.Index = -1
+				(*multi)[sk.String()] = true
+			}
+		}
+	}
+	return (*multi)[strings.TrimSuffix(dep, ".*")]
+}
+
+// PruneEmptyModules removes all modules other than root that have no resources
+// and no outputs, similar to how empty modules are removed from planned diffs.
+func PruneEmptyModules(s *tf.State) {
+	keep := s.Modules[:0]
+	for _, m := range s.Modules {
+		if isRootModule(m.Path) || len(m.Resources) > 0 || len(m.Outputs) > 0 {
+			keep = append(keep, m)
+		}
+	}
+	for i := len(keep); i < len(s.Modules); i++ {
+		s.Modules[i] = nil
+	}
+	s.Modules = keep
+}
+
+// DependencyOrder returns the keys of all resources in s ordered such that each
+// resource follows all of its dependencies in the same module. Modules are
+// ordered by path, and resources in child modules are identified by
+// module-qualified addresses, as in ExplainDiff. A "type.name.*" dependency
+// refers to all "type.name" and "type.name.N" resources. Dependencies on modules
+// and missing resources are ignored. Resources that do not depend on one another
+// are sorted by key, so the order is stable. An error is returned if there is a
+// dependency cycle.
+func DependencyOrder(s *tf.State) ([]string, error) {
+	mods := make([]*tf.ModuleState, len(s.Modules))
+	copy(mods, s.Modules)
+	sort.Slice(mods, func(i, j int) bool {
+		return lessModulePath(mods[i].Path, mods[j].Path)
+	})
+	var order []string
+	for _, m := range mods {
+		multi := make(map[string][]string, len(m.Resources))
+		for k := range m.Resources {
+			if sk, err := tf.ParseResourceStateKey(k); err == nil {
+				sk.Index = -1
+				multi[sk.String()] = append(multi[sk.String()], k)
+			}
+		}
+		next := make(map[string][]string, len(m.Resources))
+		wait := make(map[string]int, len(m.Resources))
+		for k, r := range m.Resources {
+			seen := make(map[string]bool, len(r.Dependencies))
+			for _, dep := range r.Dependencies {
+				var keys []string
+				if m.Resources[dep] != nil {
+					keys = []string{dep}
+				} else if strings.HasSuffix(dep, ".*") {
+					keys = multi[strings.TrimSuffix(dep, ".*")]
+				}
+				for _, d := range keys {
+					if d != k && !seen[d] {
+						seen[d] = true
+						next[d] = append(next[d], k)
+						wait[k]++
+					}
+				}
+			}
+		}
+		var ready []string
+		for k := range m.Resources {
+			if wait[k] == 0 {
+				ready = append(ready, k)
+			}
+		}
+		sort.Strings(ready)
+		prefix := modulePrefix(m.Path)
+		n := len(order)
+		for len(ready) > 0 {
+			k := ready[0]
+			ready = ready[1:]
+			order = append(order, prefix+k)
+			for _, d := range next[k] {
+				if wait[d]--; wait[d] == 0 {
+					i := sort.SearchStrings(ready, d)
+					ready = append(ready, "")
+					copy(ready[i+1:], ready[i:])
+					ready[i] = d
+				}
+			}
+		}
+		if len(order)-n != len(m.Resources) {
+			var cycle []string
+			for k := range m.Resources {
+				if wait[k] > 0 {
+					cycle = append(cycle, prefix+k)
+				}
+			}
+			sort.Strings(cycle)
+			return nil, fmt.Errorf("tfx: dependency cycle involving %s",
+				strings.Join(cycle, ", "))
+		}
+	}
+	return order, nil
+}
+
+// TaintedResources returns the addresses of all tainted resources in s. Modules
+// are ordered by path, and resources in child modules are identified by
+// module-qualified addresses, as in ExplainDiff.
+func TaintedResources(s *tf.State) []string {
+	mods := make([]*tf.ModuleState, len(s.Modules))
+	copy(mods, s.Modules)
+	sort.Slice(mods, func(i, j int) bool {
+		return lessModulePath(mods[i].Path, mods[j].Path)
+	})
+	var tainted []string
+	for _, m := range mods {
+		n := len(tainted)
+		prefix := modulePrefix(m.Path)
+		for k, r := range m.Resources {
+			if r.Primary != nil && r.Primary.Tainted {
+				tainted = append(tainted, prefix+k)
+			}
+		}
+		sort.Strings(tainted[n:])
+	}
+	return tainted
+}
+
+// Taint marks the resource at addr, formatted as in ExplainDiff, as tainted,
+// which causes Terraform to re-create it on the next apply.
+func Taint(s *tf.State, addr string) error {
+	return setTainted(s, addr, true)
+}
+
+// Untaint clears the tainted flag of the resource at addr.
+func Untaint(s *tf.State, addr string) error {
+	return setTainted(s, addr, false)
+}
+
+// setTainted sets the tainted flag of the primary instance of resource addr.
+func setTainted(s *tf.State, addr string, tainted bool) error {
+	path, key, err := splitAddr(addr)
+	if err != nil {
+		return err
+	}
+	var r *tf.ResourceState
+	if m := s.ModuleByPath(path); m != nil {
+		r = m.Resources[key]
+	}
+	if r == nil || r.Primary == nil {
+		return fmt.Errorf("tfx: resource %q not found", addr)
+	}
+	r.Primary.Tainted = tainted
+	return nil
+}
+
 // DeepCopy returns a deep copy of v.
 func DeepCopy(v interface{}) interface{} {
 	return copystructure.Must(copystructure.Copy(v))
 }
 
 // NormStateKeys returns a transformation that normalizes resource state keys
-// using provider names and resource IDs.
-func NormStateKeys(s *tf.State) (StateTransform, error) {
+// using provider names and resource IDs. If name is not nil, it is called for
+// each managed resource to obtain the name to use instead of the ID. An empty
+// return value selects the ID. Names are always converted to valid identifiers.
+func NormStateKeys(s *tf.State, name func(r *tf.ResourceState) string) (StateTransform, error) {
 	st := make(StateTransform)
 	for _, m := range s.Modules {
 		for k, r := range m.Resources {
@@ -102,16 +791,25 @@ func NormStateKeys(s *tf.State) (StateTransform, error) {
 			if err != nil {
 				return nil, err
 			}
-			norm := makeName(r.Primary.ID)
-			if sk.Mode != config.ManagedResourceMode || sk.Name == norm {
+			if sk.Mode != config.ManagedResourceMode {
+				continue
+			}
+			var norm string
+			if name != nil {
+				norm = name(r)
+			}
+			if norm == "" {
+				norm = r.Primary.ID
+			}
+			if norm = makeName(norm); sk.Name == norm {
 				continue
 			}
 			sk.Name = norm
-			src, err := stateKeyToAddress(m.Path, k)
+			src, err := StateKeyToAddress(m.Path, k)
 			if err != nil {
 				return nil, err
 			}
-			dst, err := stateKeyToAddress(m.Path, sk.String())
+			dst, err := StateKeyToAddress(m.Path, sk.String())
 			if err != nil {
 				return nil, err
 			}
@@ -124,6 +822,114 @@ func NormStateKeys(s *tf.State) (StateTransform, error) {
 	return st, nil
 }
 
+// NormalizeSetKeys rewrites the keys of all set attributes in s using the hash
+// functions of their resource schemas. Set keys in a refreshed state may have
+// been computed from different values (e.g. with computed fields populated),
+// which causes spurious differences in state comparisons. Attributes that are
+// not set are left unchanged, and resources of unknown types are skipped.
+func NormalizeSetKeys(s *tf.State, pm ProviderMap) error {
+	for _, m := range s.Modules {
+		for key, r := range m.Resources {
+			if r.Primary == nil {
+				continue
+			}
+			_, rs := pm.ResourceSchema(r.Type)
+			if rs == nil {
+				continue
+			}
+			var d *schema.ResourceData
+			attrs := r.Primary.Attributes
+			for k, sch := range rs.Schema {
+				if !hasSet(sch) {
+					continue
+				}
+				if d == nil {
+					d = rs.Data(r.Primary)
+				}
+				v, ok := d.GetOk(k)
+				if !ok {
+					continue
+				}
+				w := schema.MapFieldWriter{Schema: rs.Schema}
+				if err := w.WriteField([]string{k}, v); err != nil {
+					return fmt.Errorf("tfx: failed to normalize %s%s.%s (%v)",
+						modulePrefix(m.Path), key, k, err)
+				}
+				prefix := k + "."
+				for ak := range attrs {
+					if strings.HasPrefix(ak, prefix) {
+						delete(attrs, ak)
+					}
+				}
+				for wk, wv := range w.Map() {
+					attrs[wk] = wv
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// hasSet returns true if s or any of its elements is a set.
+func hasSet(s *schema.Schema) bool {
+	if s.Type == schema.TypeSet {
+		return true
+	}
+	switch e := s.Elem.(type) {
+	case *schema.Schema:
+		return hasSet(e)
+	case *schema.Resource:
+		for _, s := range e.Schema {
+			if hasSet(s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StripComputed returns a copy of s with all computed-only attributes removed,
+// including those of nested resources. Attributes that are also optional are
+// kept, as is the resource ID. The result is suitable for comparison with the
+// attributes set by config. Resources of unknown types are copied as-is.
+func StripComputed(s *tf.State, pm ProviderMap) *tf.State {
+	s = s.DeepCopy()
+	for _, m := range s.Modules {
+		for _, r := range m.Resources {
+			if r.Primary == nil {
+				continue
+			}
+			if _, rs := pm.ResourceSchema(r.Type); rs != nil {
+				for k := range r.Primary.Attributes {
+					if k != "id" && isComputedOnly(rs.Schema, k) {
+						delete(r.Primary.Attributes, k)
+					}
+				}
+			}
+		}
+	}
+	return s
+}
+
+// isComputedOnly returns true if flatmap attribute key refers to a computed
+// attribute that cannot be set by config, or to any element thereof.
+func isComputedOnly(m map[string]*schema.Schema, key string) bool {
+	for path := strings.Split(key, "."); ; {
+		s := m[path[0]]
+		if s == nil {
+			return false
+		}
+		if s.Computed && !s.Optional && !s.Required {
+			return true
+		}
+		r, ok := s.Elem.(*schema.Resource)
+		if !ok || len(path) < 3 {
+			return false
+		}
+		m, path = r.Schema, path[2:] // Skip list/set index
+	}
+}
+
 // StateTransform defines state resource address transformations. It can change
 // resource keys, move resources between modules, and remove resources.
 // Dependencies are updated as needed as long as they stay within the same
@@ -136,7 +942,9 @@ type StateTransform map[string]string
 // ignored. Address collisions are resolved in favor of the transformation, so
 // the map {A: B} will replace an existing resource B with A. Without an
 // explicit {B: ""} entry, resources that depended on B will depend on A after
-// such transformation.
+// such transformation. Dependencies on removed resources are cleared, including
+// those in the "type.name.*" form once no resource with that name remains in
+// the module. Empty modules are removed afterwards (see PruneEmptyModules).
 func (st StateTransform) Apply(s *tf.State) error {
 	if len(st) == 0 {
 		return nil
@@ -150,8 +958,19 @@ func (st StateTransform) Apply(s *tf.State) error {
 		deps []*node
 	}
 
-	// Step 1: Add resources from all modules to stateMap, indexed by address
-	stateMap := make(map[string]*node, len(s.RootModule().Resources))
+	// Step 1: Add resources from all modules to stateMap, indexed by address.
+	// Nodes and dependency links for all modules are allocated up front.
+	numRes, numDeps := 0, 0
+	for _, m := range s.Modules {
+		numRes += len(m.Resources)
+		for _, r := range m.Resources {
+			numDeps += len(r.Dependencies)
+		}
+	}
+	stateMap := make(map[string]*node, numRes)
+	nodePool := make([]node, numRes)
+	linkPool := make([]*node, numDeps)
+	var moduleMap map[string]*node
 	for _, m := range s.Modules {
 		if len(m.Resources) == 0 {
 			continue
@@ -159,11 +978,16 @@ func (st StateTransform) Apply(s *tf.State) error {
 
 		// Add a node for each resource to stateMap and moduleMap, the latter
 		// indexed by state key to resolve dependencies.
-		moduleMap := make(map[string]*node, len(m.Resources))
-		nodePool := make([]node, len(m.Resources))
+		if moduleMap == nil {
+			moduleMap = make(map[string]*node, len(m.Resources))
+		} else {
+			for k := range moduleMap {
+				delete(moduleMap, k)
+			}
+		}
 		totalDeps := 0
 		for k, r := range m.Resources {
-			addr, err := stateKeyToAddress(m.Path, k)
+			addr, err := StateKeyToAddress(m.Path, k)
 			if err != nil {
 				return err
 			}
@@ -186,7 +1010,6 @@ func (st StateTransform) Apply(s *tf.State) error {
 		if totalDeps == 0 {
 			continue
 		}
-		linkPool := make([]*node, totalDeps)
 		for _, n := range moduleMap {
 			if deps := n.res.Dependencies; len(deps) > 0 {
 				n.deps = linkPool[:len(deps):len(deps)]
@@ -198,9 +1021,11 @@ func (st StateTransform) Apply(s *tf.State) error {
 		}
 	}
 
-	// Step 2: Apply transformations and store results in transMap
+	// Step 2: Apply transformations and store results in transMap. The names
+	// of removed resources are recorded in removed, indexed by module.
 	const rootPrefix = "module.root."
 	transMap := make(map[string]*node, len(stateMap))
+	removed := make(map[*tf.ModuleState]map[string]bool)
 	for _, n := range stateMap {
 		addr, ok := st[n.addr]
 		if !ok && strings.HasPrefix(n.addr, rootPrefix) {
@@ -221,6 +1046,10 @@ func (st StateTransform) Apply(s *tf.State) error {
 
 		// A resource mapped to an empty address is removed
 		if addr == "" {
+			if removed[n.mod] == nil {
+				removed[n.mod] = make(map[string]bool)
+			}
+			removed[n.mod][depName(n.key)] = true
 			n.mod = nil
 			continue
 		}
@@ -248,7 +1077,7 @@ func (st StateTransform) Apply(s *tf.State) error {
 	var tmpState tf.State
 	for _, n := range transMap {
 		if n.key == "" {
-			path, key, err := addressToStateKey(n.addr)
+			path, key, err := AddressToStateKey(n.addr)
 			if err != nil {
 				return err
 			}
@@ -277,17 +1106,32 @@ func (st StateTransform) Apply(s *tf.State) error {
 		s.AddModuleState(m)
 	}
 
-	// Step 5: Add transformed resources and update dependencies
-	depSet := make(map[string]struct{})
+	// Step 5: Add transformed resources
+	kept := make(map[*tf.ModuleState]map[string]bool)
 	for _, n := range transMap {
 		if n.mod.Resources[n.key] != nil {
 			// Shouldn't happen since keys are derived from addresses
 			panic("tfx: resource state key collision: " + n.key)
 		}
 		n.mod.Resources[n.key] = n.res
+		if removed[n.mod] != nil {
+			if kept[n.mod] == nil {
+				kept[n.mod] = make(map[string]bool)
+			}
+			kept[n.mod][depName(n.key)] = true
+		}
+	}
+
+	// Step 6: Update dependencies
+	depSet := make(map[string]struct{})
+	for _, n := range transMap {
 		for i, d := range n.deps {
 			if d == nil {
-				depSet[n.res.Dependencies[i]] = struct{}{}
+				dep := n.res.Dependencies[i]
+				if name := depName(dep); !removed[n.mod][name] ||
+					kept[n.mod][name] {
+					depSet[dep] = struct{}{}
+				}
 			} else if d.mod == n.mod {
 				depSet[d.key] = struct{}{}
 			}
@@ -301,11 +1145,15 @@ func (st StateTransform) Apply(s *tf.State) error {
 		sort.Strings(deps)
 		n.res.Dependencies = deps
 	}
+
+	// Step 7: Remove empty modules
+	PruneEmptyModules(s)
 	return nil
 }
 
 // ApplyToDiff updates resource diff keys according to the transformation map.
-// The diff may be modified after an error.
+// Modules that become empty are removed and the remaining modules are sorted by
+// path, as in a planned diff. The diff may be modified after an error.
 func (st StateTransform) ApplyToDiff(d *tf.Diff) error {
 	if len(d.Modules) == 0 {
 		return nil
@@ -313,7 +1161,7 @@ func (st StateTransform) ApplyToDiff(d *tf.Diff) error {
 	diffMap := make(map[string]*tf.InstanceDiff, len(d.Modules[0].Resources))
 	for _, m := range d.Modules {
 		for k, r := range m.Resources {
-			addr, err := stateKeyToAddress(m.Path, k)
+			addr, err := StateKeyToAddress(m.Path, k)
 			if err != nil {
 				return err
 			}
@@ -331,7 +1179,7 @@ func (st StateTransform) ApplyToDiff(d *tf.Diff) error {
 		}
 	}
 	for addr, r := range diffMap {
-		path, key, err := addressToStateKey(addr)
+		path, key, err := AddressToStateKey(addr)
 		if err != nil {
 			return err
 		}
@@ -341,6 +1189,7 @@ func (st StateTransform) ApplyToDiff(d *tf.Diff) error {
 		}
 		m.Resources[key] = r
 	}
+	normDiff(d)
 	return nil
 }
 
@@ -357,8 +1206,96 @@ func (st StateTransform) Inverse() StateTransform {
 	return inv
 }
 
-// stateKeyToAddress converts a resource state key into a normalized address.
-func stateKeyToAddress(path []string, key string) (string, error) {
+// ExtractModule returns a copy of module path and all of its descendants from s,
+// rebased such that path becomes the root module. This allows operations such
+// as Ctx.Diff to be performed on a single module in isolation. The returned
+// transformation maps rebased resource addresses back to their original ones,
+// but it only covers resources that existed at the time of extraction. To
+// complete the round trip after resources were added, use RebaseModule instead
+// and merge the result back into s, for example, with SubState followed by
+// AddState.
+func ExtractModule(s *tf.State, path []string) (*tf.State, StateTransform, error) {
+	if len(path) == 0 || path[0] != "root" {
+		path = append([]string{"root"}, path...)
+	}
+	out := NewState()
+	st := make(StateTransform)
+	found := false
+	for _, m := range s.Modules {
+		if !isPrefix(path, m.Path) {
+			continue
+		}
+		found = true
+		rm := DeepCopy(m).(*tf.ModuleState)
+		rm.Path = append([]string{"root"}, m.Path[len(path):]...)
+		for k := range rm.Resources {
+			from, err := StateKeyToAddress(rm.Path, k)
+			if err != nil {
+				return nil, nil, err
+			}
+			to, err := StateKeyToAddress(m.Path, k)
+			if err != nil {
+				return nil, nil, err
+			}
+			st[from] = to
+		}
+		out.AddModuleState(rm)
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("tfx: module %q not found",
+			strings.Join(path, "."))
+	}
+	return out, st, nil
+}
+
+// RebaseModule is the inverse of ExtractModule. It returns a copy of s with all
+// modules moved under path, such that the root module of s becomes module path.
+// Unlike the transformation returned by ExtractModule, it applies to all
+// resources, including those created after extraction.
+func RebaseModule(s *tf.State, path []string) *tf.State {
+	if len(path) == 0 || path[0] != "root" {
+		path = append([]string{"root"}, path...)
+	}
+	out := NewState()
+	for _, m := range s.Modules {
+		rm := DeepCopy(m).(*tf.ModuleState)
+		rm.Path = make([]string, 0, len(path)+len(m.Path)-1)
+		rm.Path = append(append(rm.Path, path...), m.Path[1:]...)
+		out.AddModuleState(rm)
+	}
+	return out
+}
+
+// isPrefix returns true if path starts with all elements of prefix.
+func isPrefix(prefix, path []string) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// depName returns the resource name of a state key or dependency without any
+// count index or "*" suffix (e.g. "type.name.1" becomes "type.name").
+func depName(k string) string {
+	if i := strings.LastIndexByte(k, '.'); i >= 0 {
+		if idx := k[i+1:]; idx == "*" {
+			return k[:i]
+		} else if _, err := strconv.Atoi(idx); err == nil {
+			return k[:i]
+		}
+	}
+	return k
+}
+
+// StateKeyToAddress converts a resource state key into a normalized address.
+// An empty path refers to the root module. The returned address always includes
+// the module path (e.g. "module.root.type.name").
+func StateKeyToAddress(path []string, key string) (string, error) {
 	k, err := tf.ParseResourceStateKey(key)
 	if err != nil {
 		return "", err
@@ -376,8 +1313,9 @@ func stateKeyToAddress(path []string, key string) (string, error) {
 	return addr.String(), nil
 }
 
-// addressToStateKey converts a resource address into a state key.
-func addressToStateKey(addr string) (path []string, key string, err error) {
+// AddressToStateKey converts a resource address into a module path and state
+// key. Addresses without a module path refer to the root module.
+func AddressToStateKey(addr string) (path []string, key string, err error) {
 	k, err := tf.ParseResourceAddress(addr)
 	if err != nil {
 		return
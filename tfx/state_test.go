@@ -1,8 +1,17 @@
 package tfx
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/hashicorp/terraform/builtin/providers/test"
+	"github.com/hashicorp/terraform/helper/schema"
 	tf "github.com/hashicorp/terraform/terraform"
 	"github.com/mxk/go-cloud/azure/az"
 	"github.com/stretchr/testify/assert"
@@ -16,6 +25,244 @@ func TestNewState(t *testing.T) {
 	assert.Equal(t, want, have)
 }
 
+func TestReadStateJSON(t *testing.T) {
+	const js = `{
+		"format_version": "0.1",
+		"values": {"root_module": {
+			"resources": [{
+				"address": "test_resource.a",
+				"mode": "managed",
+				"type": "test_resource",
+				"name": "a",
+				"index": 1,
+				"provider_name": "registry.terraform.io/hashicorp/test",
+				"schema_version": 2,
+				"values": {
+					"id": "a-id",
+					"bool": true,
+					"num": 1.5,
+					"null": null,
+					"list": ["x", "y"],
+					"map": {"k": "v"},
+					"block": [{"attr": "b"}]
+				}
+			}],
+			"child_modules": [{
+				"address": "module.child",
+				"resources": [{
+					"address": "module.child.data.test_data_source.d",
+					"mode": "data",
+					"type": "test_data_source",
+					"name": "d",
+					"provider_name": "test",
+					"values": {"id": "d-id"},
+					"depends_on": ["module.child.test_resource.b[0]"]
+				}]
+			}]
+		}}
+	}`
+	s, err := ReadStateJSON(strings.NewReader(js))
+	require.NoError(t, err)
+	want := NewState()
+	want.RootModule().Resources["test_resource.a.1"] = &tf.ResourceState{
+		Type: "test_resource",
+		Primary: &tf.InstanceState{
+			ID: "a-id",
+			Attributes: map[string]string{
+				"id":           "a-id",
+				"bool":         "true",
+				"num":          "1.5",
+				"list.#":       "2",
+				"list.0":       "x",
+				"list.1":       "y",
+				"map.%":        "1",
+				"map.k":        "v",
+				"block.#":      "1",
+				"block.0.attr": "b",
+			},
+			Meta: map[string]interface{}{"schema_version": "2"},
+		},
+		Provider: "provider.test",
+	}
+	want.AddModule(append(tf.RootModulePath, "child")).Resources["data.test_data_source.d"] = &tf.ResourceState{
+		Type:         "test_data_source",
+		Dependencies: []string{"test_resource.b.0"},
+		Primary: &tf.InstanceState{
+			ID:         "d-id",
+			Attributes: map[string]string{"id": "d-id"},
+		},
+		Provider: "provider.test",
+	}
+	assert.Equal(t, want, s)
+
+	_, err = ReadStateJSON(strings.NewReader(`{"version": 3}`))
+	assert.Error(t, err)
+}
+
+func TestReadStateWithBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfx")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "terraform.tfstate")
+	backup := file + ".backup"
+	write := func(name string, serial int64) {
+		s := NewState()
+		s.Serial = serial
+		var b bytes.Buffer
+		require.NoError(t, tf.WriteState(s, &b))
+		require.NoError(t, ioutil.WriteFile(name, b.Bytes(), 0666))
+	}
+
+	_, _, err = ReadStateWithBackup(file)
+	assert.Error(t, err)
+
+	write(file, 2)
+	s, name, err := ReadStateWithBackup(file)
+	require.NoError(t, err)
+	assert.Equal(t, file, name)
+	assert.Equal(t, int64(2), s.Serial)
+
+	write(backup, 1)
+	s, name, err = ReadStateWithBackup(file)
+	require.NoError(t, err)
+	assert.Equal(t, file, name)
+	assert.Equal(t, int64(2), s.Serial)
+
+	write(backup, 3)
+	s, name, err = ReadStateWithBackup(file)
+	require.NoError(t, err)
+	assert.Equal(t, backup, name)
+	assert.Equal(t, int64(3), s.Serial)
+
+	write(backup, 1)
+	require.NoError(t, ioutil.WriteFile(file, []byte(`{"version": 3,`), 0666))
+	s, name, err = ReadStateWithBackup(file)
+	require.NoError(t, err)
+	assert.Equal(t, backup, name)
+	assert.Equal(t, int64(1), s.Serial)
+}
+
+func TestReadStateDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfx")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	write := func(name string, s *tf.State) {
+		var b bytes.Buffer
+		require.NoError(t, tf.WriteState(s, &b))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), b.Bytes(), 0666))
+	}
+	a := NewState()
+	a.RootModule().Resources["x.x"] = &tf.ResourceState{
+		Type:    "x",
+		Primary: &tf.InstanceState{ID: "1"},
+	}
+	a.AddModule([]string{"root", "m"}).Resources["x.x"] = &tf.ResourceState{
+		Type:    "x",
+		Primary: &tf.InstanceState{ID: "2"},
+	}
+	b := NewState()
+	b.RootModule().Resources["x.x"] = &tf.ResourceState{
+		Type:    "x",
+		Primary: &tf.InstanceState{ID: "3"},
+	}
+	write("acct-1.tfstate", a)
+	write("acct 2.tfstate", b)
+	write("acct-1.tfstate.backup", NewState())
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "x.tf"), nil, 0666))
+
+	s, files, err := ReadStateDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"acct-1": filepath.Join(dir, "acct-1.tfstate"),
+		"acct_2": filepath.Join(dir, "acct 2.tfstate"),
+	}, files)
+	assert.Empty(t, s.RootModule().Resources)
+	get := func(path ...string) string {
+		m := s.ModuleByPath(append([]string{"root"}, path...))
+		require.NotNil(t, m, "%v", path)
+		return m.Resources["x.x"].Primary.ID
+	}
+	assert.Equal(t, "1", get("acct-1"))
+	assert.Equal(t, "2", get("acct-1", "m"))
+	assert.Equal(t, "3", get("acct_2"))
+
+	// Reverse
+	out, _, err := ExtractModule(s, []string{"acct-1"})
+	require.NoError(t, err)
+	assert.Len(t, out.Modules, 2)
+	assert.Equal(t, "2", out.ModuleByPath([]string{"root", "m"}).Resources["x.x"].Primary.ID)
+
+	// Collision
+	write("acct_2.tfstate", b)
+	_, _, err = ReadStateDir(dir)
+	assert.Error(t, err)
+}
+
+func TestWalkStateResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tfx")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "terraform.tfstate")
+
+	s := NewState()
+	s.AddModule([]string{"root", "m"})
+	want := map[string]*tf.ResourceState{
+		"root/a.a":   {Type: "a", Primary: &tf.InstanceState{ID: "1"}},
+		"root/a.b":   {Type: "a", Primary: &tf.InstanceState{ID: "2"}},
+		"root/m/a.c": {Type: "a", Primary: &tf.InstanceState{ID: "3"}},
+	}
+	for k, r := range want {
+		i := strings.LastIndexByte(k, '/')
+		s.ModuleByPath(strings.Split(k[:i], "/")).Resources[k[i+1:]] = r
+	}
+	var b bytes.Buffer
+	require.NoError(t, tf.WriteState(s, &b))
+	require.NoError(t, ioutil.WriteFile(file, b.Bytes(), 0666))
+
+	have := make(map[string]*tf.ResourceState)
+	err = WalkStateResources(file, func(path []string, key string, r *tf.ResourceState) error {
+		have[strings.Join(path, "/")+"/"+key] = r
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, have, len(want))
+	for k, r := range want {
+		require.NotNil(t, have[k], "%s", k)
+		assert.True(t, r.Equal(have[k]), "%s", k)
+	}
+	n, err := CountResources(file)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	stop := errors.New("stop")
+	n = 0
+	err = WalkStateResources(file, func([]string, string, *tf.ResourceState) error {
+		n++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, n)
+
+	const pathLast = `{"version": 3, "modules": [{
+		"resources": {"a.a": {"type": "a", "primary": {"id": "1"}}},
+		"path": ["root"]
+	}]}`
+	require.NoError(t, ioutil.WriteFile(file, []byte(pathLast), 0666))
+	err = WalkStateResources(file, func(path []string, key string, r *tf.ResourceState) error {
+		assert.Equal(t, tf.RootModulePath, path)
+		assert.Equal(t, "a.a", key)
+		assert.Equal(t, "1", r.Primary.ID)
+		n++
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte(`{"version": 1}`), 0666))
+	_, err = CountResources(file)
+	assert.Error(t, err)
+}
+
 func TestAddSub(t *testing.T) {
 	a := NewState()
 	a.RootModule().Resources["a.a"] = &tf.ResourceState{Type: "a"}
@@ -35,6 +282,80 @@ func TestAddSub(t *testing.T) {
 	assert.Equal(t, orig, a)
 }
 
+func TestCensus(t *testing.T) {
+	s := NewState()
+	root := s.RootModule().Resources
+	root["a.a"] = &tf.ResourceState{Type: "a"}
+	root["a.b.0"] = &tf.ResourceState{Type: "a"}
+	root["a.b.1"] = &tf.ResourceState{Type: "a"}
+	root["data.a.a"] = &tf.ResourceState{Type: "a"}
+	s.AddModule([]string{"root", "m"}).Resources["b.b"] = &tf.ResourceState{Type: "b"}
+	s.ModuleByPath([]string{"root", "m"}).Resources["a.a"] = &tf.ResourceState{Type: "a"}
+	s.AddModule([]string{"root", "m", "empty"})
+
+	assert.Equal(t, map[string]int{"a": 4, "b": 1, "data.a": 1}, Census(s))
+	assert.Equal(t, map[string]map[string]int{
+		"":         {"a": 3, "data.a": 1},
+		"module.m": {"a": 1, "b": 1},
+	}, CensusByModule(s))
+	assert.Equal(t, []TypeCount{{"a", 4}, {"b", 1}, {"data.a", 1}}, CensusSorted(s))
+}
+
+func TestPruneDeps(t *testing.T) {
+	s := NewState()
+	s.Modules = append(s.Modules, &tf.ModuleState{
+		Path: append(tf.RootModulePath, "child"),
+		Resources: map[string]*tf.ResourceState{
+			"a.a": {Type: "a", Dependencies: []string{"a.b", "b.b"}},
+		},
+	})
+	root := s.RootModule().Resources
+	root["a.a"] = &tf.ResourceState{
+		Type:         "a",
+		Dependencies: []string{"a.b", "b.b", "c.c.*", "d.d.*", "module.child"},
+	}
+	root["b.b"] = &tf.ResourceState{Type: "b"}
+	root["c.c.0"] = &tf.ResourceState{Type: "c"}
+	root["c.c.1"] = &tf.ResourceState{Type: "c"}
+	PruneDeps(s)
+	assert.Equal(t, []string{"b.b", "c.c.*", "module.child"}, root["a.a"].Dependencies)
+	assert.Empty(t, s.Modules[1].Resources["a.a"].Dependencies)
+	assert.Empty(t, root["b.b"].Dependencies)
+}
+
+func TestDependencyOrder(t *testing.T) {
+	s := NewState()
+	s.Modules = append(s.Modules, &tf.ModuleState{
+		Path: append(tf.RootModulePath, "child"),
+		Resources: map[string]*tf.ResourceState{
+			"a.a": {Type: "a", Dependencies: []string{"a.b"}},
+			"a.b": {Type: "a"},
+		},
+	})
+	root := s.RootModule().Resources
+	root["a.a"] = &tf.ResourceState{Type: "a", Dependencies: []string{"c.c.*", "module.child"}}
+	root["b.b"] = &tf.ResourceState{Type: "b", Dependencies: []string{"missing.x"}}
+	root["c.c.0"] = &tf.ResourceState{Type: "c", Dependencies: []string{"d.d"}}
+	root["c.c.1"] = &tf.ResourceState{Type: "c"}
+	root["d.d"] = &tf.ResourceState{Type: "d", Dependencies: []string{"d.d"}}
+	s.Modules[0], s.Modules[1] = s.Modules[1], s.Modules[0]
+
+	want := []string{
+		"b.b", "c.c.1", "d.d", "c.c.0", "a.a",
+		"module.child.a.b", "module.child.a.a",
+	}
+	for i := 0; i < 3; i++ {
+		have, err := DependencyOrder(s)
+		require.NoError(t, err)
+		assert.Equal(t, want, have)
+	}
+
+	root["d.d"].Dependencies = []string{"a.a"}
+	_, err := DependencyOrder(s)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "a.a, c.c.0, d.d")
+}
+
 func TestDeepCopy(t *testing.T) {
 	s := NewState()
 	s.RootModule().Resources["a.a"] = &tf.ResourceState{Type: "a"}
@@ -71,12 +392,136 @@ func TestNormStateKeys(t *testing.T) {
 	want := NewState()
 	normKey := "azurerm_resource_group._subscriptions_" + az.NilGUID + "_resourceGroups_tf-test-rg"
 	want.RootModule().Resources[normKey] = DeepCopy(rg).(*tf.ResourceState)
-	st, err := NormStateKeys(have)
+	st, err := NormStateKeys(have, nil)
+	require.NoError(t, err)
+	require.NoError(t, st.Apply(have))
+	assert.Equal(t, want, have)
+
+	// Custom names
+	rg2 := DeepCopy(rg).(*tf.ResourceState)
+	rg2.Primary.ID += "2"
+	have = NewState()
+	have.RootModule().Resources["azurerm_resource_group.rg"] = rg
+	have.RootModule().Resources["azurerm_resource_group.rg2"] = rg2
+	want = NewState()
+	want.RootModule().Resources["azurerm_resource_group.tf-test-rg"] = DeepCopy(rg).(*tf.ResourceState)
+	want.RootModule().Resources[normKey+"2"] = DeepCopy(rg2).(*tf.ResourceState)
+	st, err = NormStateKeys(have, func(r *tf.ResourceState) string {
+		if id := r.Primary.ID; !strings.HasSuffix(id, "2") {
+			return id[strings.LastIndexByte(id, '/')+1:]
+		}
+		return ""
+	})
 	require.NoError(t, err)
 	require.NoError(t, st.Apply(have))
 	assert.Equal(t, want, have)
 }
 
+func TestNormalizeSetKeys(t *testing.T) {
+	var pm ProviderMap
+	pm.Add("test", "", MakeFactory(test.Provider))
+	r, err := pm.NewResource("test_resource", "a", false)
+	require.NoError(t, err)
+	_, rs := pm.ResourceSchema(r.Type)
+	d := rs.Data(r.Primary)
+	require.NoError(t, d.Set("set", []interface{}{"1", "2"}))
+	want := d.State().Attributes
+
+	s := NewState()
+	s.RootModule().Resources[r.Key] = r.ResourceState
+	attrs := make(map[string]string, len(want))
+	for k, v := range want {
+		switch v {
+		case "1":
+			k = "set.111"
+		case "2":
+			k = "set.222"
+		}
+		attrs[k] = v
+	}
+	require.NotEqual(t, want, attrs)
+	r.Primary.Attributes = attrs
+
+	// Absent set attributes must not gain count keys
+	b, err := pm.NewResource("test_resource", "b", false)
+	require.NoError(t, err)
+	s.RootModule().Resources[b.Key] = b.ResourceState
+	bAttrs := DeepCopy(b.Primary.Attributes)
+
+	require.NoError(t, NormalizeSetKeys(s, pm))
+	assert.Equal(t, want, r.Primary.Attributes)
+	assert.Equal(t, bAttrs, b.Primary.Attributes)
+}
+
+func TestStripComputed(t *testing.T) {
+	var pm ProviderMap
+	pm.Add("test", "", func() (tf.ResourceProvider, error) {
+		p := test.Provider().(*schema.Provider)
+		p.ResourcesMap["test_strip"] = &schema.Resource{Schema: map[string]*schema.Schema{
+			"name": {Type: schema.TypeString, Required: true},
+			"arn":  {Type: schema.TypeString, Computed: true},
+			"zone": {Type: schema.TypeString, Optional: true, Computed: true},
+			"ips":  {Type: schema.TypeList, Computed: true, Elem: &schema.Schema{Type: schema.TypeString}},
+			"rule": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Resource{Schema: map[string]*schema.Schema{
+					"port": {Type: schema.TypeInt, Optional: true},
+					"hash": {Type: schema.TypeString, Computed: true},
+				}},
+			},
+		}}
+		return p, nil
+	})
+	s := NewState()
+	m := s.RootModule()
+	m.Resources["test_strip.a"] = &tf.ResourceState{
+		Type: "test_strip",
+		Primary: &tf.InstanceState{ID: "a", Attributes: map[string]string{
+			"id":          "a",
+			"name":        "n",
+			"arn":         "arn:a",
+			"zone":        "z",
+			"ips.#":       "1",
+			"ips.0":       "1.2.3.4",
+			"rule.#":      "1",
+			"rule.0.port": "80",
+			"rule.0.hash": "h",
+		}},
+	}
+	m.Resources["test_unknown.b"] = &tf.ResourceState{
+		Type:    "test_unknown",
+		Primary: &tf.InstanceState{ID: "b", Attributes: map[string]string{"arn": "b"}},
+	}
+	out := StripComputed(s, pm)
+	assert.Equal(t, map[string]string{
+		"id":          "a",
+		"name":        "n",
+		"zone":        "z",
+		"rule.#":      "1",
+		"rule.0.port": "80",
+	}, out.RootModule().Resources["test_strip.a"].Primary.Attributes)
+	assert.Equal(t, map[string]string{"arn": "b"},
+		out.RootModule().Resources["test_unknown.b"].Primary.Attributes)
+	assert.Len(t, m.Resources["test_strip.a"].Primary.Attributes, 9)
+}
+
+func TestStateKeyAddress(t *testing.T) {
+	addr, err := StateKeyToAddress(nil, "a.b")
+	require.NoError(t, err)
+	assert.Equal(t, "module.root.a.b", addr)
+	path, key, err := AddressToStateKey(addr)
+	require.NoError(t, err)
+	assert.Equal(t, tf.RootModulePath, path)
+	assert.Equal(t, "a.b", key)
+	path, key, err = AddressToStateKey("a.b")
+	require.NoError(t, err)
+	assert.Equal(t, tf.RootModulePath, path)
+	assert.Equal(t, "a.b", key)
+	_, _, err = AddressToStateKey("module.x")
+	require.Error(t, err)
+}
+
 func TestStateTransform(t *testing.T) {
 	orig := NewState()
 	orig.Modules = []*tf.ModuleState{{
@@ -123,3 +568,265 @@ func TestStateTransform(t *testing.T) {
 
 	// TODO: Module tests
 }
+
+func TestStateTransformRemoveDeps(t *testing.T) {
+	s := NewState()
+	s.RootModule().Resources = map[string]*tf.ResourceState{
+		"a.a":   {Type: "a"},
+		"b.b.0": {Type: "b"},
+		"b.b.1": {Type: "b"},
+		"c.c.0": {Type: "c"},
+		"c.c.1": {Type: "c"},
+		"d.d": {
+			Type:         "d",
+			Dependencies: []string{"a.a", "b.b.*", "c.c.*", "unknown.resource.*"},
+		},
+	}
+	st := StateTransform{
+		"a.a":   "",
+		"b.b.0": "",
+		"b.b.1": "",
+		"c.c.0": "",
+	}
+	require.NoError(t, st.Apply(s))
+	r := s.RootModule().Resources
+	assert.Len(t, r, 2)
+	assert.NotNil(t, r["c.c.1"])
+	assert.Equal(t, []string{"c.c.*", "unknown.resource.*"}, r["d.d"].Dependencies)
+}
+
+func TestMergeStates(t *testing.T) {
+	res := func(deps ...string) *tf.ResourceState {
+		return &tf.ResourceState{
+			Type:         "a",
+			Dependencies: deps,
+			Primary:      &tf.InstanceState{ID: "x"},
+		}
+	}
+	newStates := func() (a, b *tf.State) {
+		a = NewState()
+		a.RootModule().Resources["a.a"] = res("a.gone")
+		b = NewState()
+		b.RootModule().Resources = map[string]*tf.ResourceState{
+			"a.a":   res("a.b"),
+			"a.b":   res("a.a", "a.c.*", "module.m"),
+			"a.c.0": res("a.b"),
+			"a.d":   res("a.b", "a.x", "a.y.*"),
+		}
+		b.AddModule([]string{"root", "m"}).Resources["a.e"] = res("a.f")
+		return
+	}
+	want := []DanglingDep{
+		{"a.d", "a.x"},
+		{"a.d", "a.y.*"},
+		{"module.m.a.e", "a.f"},
+	}
+
+	a, b := newStates()
+	s, dangling := MergeStates(a, b, nil)
+	assert.Equal(t, want, dangling)
+	assert.Equal(t, []string{"a.b", "a.x", "a.y.*"},
+		s.RootModule().Resources["a.d"].Dependencies)
+
+	a, b = newStates()
+	s, dangling = MergeStates(a, b, &MergeOpts{FixDeps: true})
+	assert.Equal(t, want, dangling)
+	root := s.RootModule()
+	assert.Len(t, root.Resources, 4)
+	assert.Equal(t, []string{"a.gone"}, root.Resources["a.a"].Dependencies)
+	assert.Equal(t, []string{"a.a", "a.c.*", "module.m"},
+		root.Resources["a.b"].Dependencies)
+	assert.Equal(t, []string{"a.b"}, root.Resources["a.d"].Dependencies)
+	assert.Empty(t, s.ModuleByPath([]string{"root", "m"}).Resources["a.e"].Dependencies)
+	assert.Equal(t, []string{"a.b", "a.x", "a.y.*"},
+		b.RootModule().Resources["a.d"].Dependencies)
+}
+
+func TestTaint(t *testing.T) {
+	s := NewState()
+	res := func(id string) *tf.ResourceState {
+		return &tf.ResourceState{Type: "a", Primary: &tf.InstanceState{ID: id}}
+	}
+	s.RootModule().Resources["a.a"] = res("a")
+	s.RootModule().Resources["a.b.0"] = res("b0")
+	s.RootModule().Resources["a.b.1"] = res("b1")
+	s.AddModule([]string{"root", "m"}).Resources["a.a"] = res("ma")
+	s.RootModule().Resources["a.nil"] = &tf.ResourceState{Type: "a"}
+	assert.Empty(t, TaintedResources(s))
+
+	require.NoError(t, Taint(s, "module.m.a.a"))
+	require.NoError(t, Taint(s, "a.b.1"))
+	require.NoError(t, Taint(s, "a.a"))
+	assert.Equal(t, []string{"a.a", "a.b.1", "module.m.a.a"}, TaintedResources(s))
+	require.NoError(t, Untaint(s, "a.a"))
+	assert.Equal(t, []string{"a.b.1", "module.m.a.a"}, TaintedResources(s))
+
+	assert.EqualError(t, Taint(s, "a.x"), `tfx: resource "a.x" not found`)
+	assert.EqualError(t, Taint(s, "module.x.a.a"),
+		`tfx: resource "module.x.a.a" not found`)
+	assert.EqualError(t, Taint(s, "a.nil"), `tfx: resource "a.nil" not found`)
+	assert.Error(t, Taint(s, "module.m"))
+
+	dir, err := ioutil.TempDir("", "tfx")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "terraform.tfstate")
+	require.NoError(t, WriteStateFile(file, s))
+	s, err = ReadStateFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.b.1", "module.m.a.a"}, TaintedResources(s))
+	require.NoError(t, Untaint(s, "module.m.a.a"))
+	require.NoError(t, WriteStateFile(file, s))
+	s, err = ReadStateFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.b.1"}, TaintedResources(s))
+}
+
+func TestPruneEmptyModules(t *testing.T) {
+	s := NewState()
+	s.AddModule([]string{"root", "empty"})
+	s.AddModule([]string{"root", "out"}).Outputs["x"] = &tf.OutputState{
+		Type:  "string",
+		Value: "x",
+	}
+	s.AddModule([]string{"root", "m"}).Resources["a.a"] = &tf.ResourceState{Type: "a"}
+	s.ModuleByPath([]string{"root", "m"}).Resources["a.b"] = &tf.ResourceState{
+		Type:         "a",
+		Dependencies: []string{"a.a"},
+	}
+	require.Len(t, s.Modules, 4)
+
+	st := StateTransform{"module.m.a.a": "a.a", "module.m.a.b": ""}
+	require.NoError(t, st.Apply(s))
+	require.Len(t, s.Modules, 2)
+	assert.NotNil(t, s.RootModule().Resources["a.a"])
+	assert.NotNil(t, s.ModuleByPath([]string{"root", "out"}))
+	assert.Nil(t, s.ModuleByPath([]string{"root", "m"}))
+
+	s = NewState()
+	PruneEmptyModules(s)
+	assert.Len(t, s.Modules, 1)
+}
+
+func TestExtractModule(t *testing.T) {
+	s := NewState()
+	s.RootModule().Resources["a.root"] = &tf.ResourceState{Type: "a"}
+	s.AddModule([]string{"root", "m"}).Resources["a.m"] = &tf.ResourceState{
+		Type:         "a",
+		Dependencies: []string{"a.n"},
+	}
+	s.ModuleByPath([]string{"root", "m"}).Resources["a.n"] = &tf.ResourceState{Type: "a"}
+	s.AddModule([]string{"root", "m", "c"}).Resources["a.c"] = &tf.ResourceState{Type: "a"}
+	s.AddModule([]string{"root", "mm"}).Resources["a.mm"] = &tf.ResourceState{Type: "a"}
+
+	out, st, err := ExtractModule(s, []string{"m"})
+	require.NoError(t, err)
+	require.Len(t, out.Modules, 2)
+	r := out.RootModule().Resources
+	assert.Len(t, r, 2)
+	assert.Equal(t, []string{"a.n"}, r["a.m"].Dependencies)
+	assert.NotNil(t, out.ModuleByPath([]string{"root", "c"}).Resources["a.c"])
+
+	// Round trip
+	require.NoError(t, st.Apply(out))
+	assert.Empty(t, out.RootModule().Resources)
+	r = out.ModuleByPath([]string{"root", "m"}).Resources
+	assert.Len(t, r, 2)
+	assert.Equal(t, []string{"a.n"}, r["a.m"].Dependencies)
+	assert.Len(t, out.ModuleByPath([]string{"root", "m", "c"}).Resources, 1)
+	assert.Len(t, s.ModuleByPath([]string{"root", "m"}).Resources, 2)
+
+	_, _, err = ExtractModule(s, []string{"root", "x"})
+	assert.Error(t, err)
+}
+
+func TestRebaseModule(t *testing.T) {
+	s := NewState()
+	s.RootModule().Resources["a.root"] = &tf.ResourceState{Type: "a"}
+	s.AddModule([]string{"root", "m"}).Resources["a.m"] = &tf.ResourceState{Type: "a"}
+	s.AddModule([]string{"root", "m", "c"}).Resources["a.c"] = &tf.ResourceState{Type: "a"}
+
+	out, _, err := ExtractModule(s, []string{"m"})
+	require.NoError(t, err)
+	out.RootModule().Resources["a.new"] = &tf.ResourceState{
+		Type:         "a",
+		Dependencies: []string{"a.m"},
+	}
+	out.AddModule([]string{"root", "d"}).Resources["a.d"] = &tf.ResourceState{Type: "a"}
+
+	in := RebaseModule(out, []string{"m"})
+	assert.Empty(t, in.RootModule().Resources)
+	r := in.ModuleByPath([]string{"root", "m"}).Resources
+	assert.Len(t, r, 2)
+	assert.Equal(t, []string{"a.m"}, r["a.new"].Dependencies)
+	assert.NotNil(t, in.ModuleByPath([]string{"root", "m", "c"}).Resources["a.c"])
+	assert.NotNil(t, in.ModuleByPath([]string{"root", "m", "d"}).Resources["a.d"])
+	assert.Len(t, out.RootModule().Resources, 2)
+
+	// Merge back
+	orig, _, err := ExtractModule(s, []string{"m"})
+	require.NoError(t, err)
+	AddState(SubState(s, RebaseModule(orig, []string{"m"})), in)
+	assert.Len(t, s.RootModule().Resources, 1)
+	assert.Len(t, s.ModuleByPath([]string{"root", "m"}).Resources, 2)
+	assert.NotNil(t, s.ModuleByPath([]string{"root", "m", "d"}).Resources["a.d"])
+}
+
+func BenchmarkStateTransform(b *testing.B) {
+	const mods, n = 5, 10000
+	s := NewState()
+	st := make(StateTransform, mods*n/2)
+	for j := 0; j < mods; j++ {
+		m := s.RootModule()
+		if j > 0 {
+			m = s.AddModule(append(tf.RootModulePath, "m"+strconv.Itoa(j)))
+		}
+		for i := 0; i < n; i++ {
+			k := "a.r" + strconv.Itoa(i)
+			r := &tf.ResourceState{Type: "a"}
+			if i > 0 {
+				r.Dependencies = []string{"a.r" + strconv.Itoa(i-1)}
+			}
+			m.Resources[k] = r
+			if i%2 == 0 {
+				src, err := StateKeyToAddress(m.Path, k)
+				require.NoError(b, err)
+				dst, err := StateKeyToAddress(m.Path, "b.r"+strconv.Itoa(i))
+				require.NoError(b, err)
+				st[src] = dst
+			}
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		c := DeepCopy(s).(*tf.State)
+		b.StartTimer()
+		if err := st.Apply(c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestApplyToDiffModuleOrder(t *testing.T) {
+	d := &tf.Diff{Modules: []*tf.ModuleDiff{{
+		Path:      tf.RootModulePath,
+		Resources: map[string]*tf.InstanceDiff{"a.a": {Destroy: true}},
+	}, {
+		Path:      []string{"root", "m"},
+		Resources: map[string]*tf.InstanceDiff{"b.b": {Destroy: true}},
+	}}}
+	st := StateTransform{
+		"module.root.a.a":          "module.root.module.z.a.a",
+		"module.root.module.m.b.b": "module.root.module.c.b.b",
+	}
+	require.NoError(t, st.ApplyToDiff(d))
+	var paths [][]string
+	for _, m := range d.Modules {
+		paths = append(paths, m.Path)
+	}
+	assert.Equal(t, [][]string{{"root", "c"}, {"root", "z"}}, paths)
+	assert.NotNil(t, d.Modules[0].Resources["b.b"])
+	assert.NotNil(t, d.Modules[1].Resources["a.a"])
+}